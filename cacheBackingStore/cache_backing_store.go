@@ -4,24 +4,61 @@
 package cacheBackingStore
 
 import (
+	"context"
+	"errors"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/offchainlabs/cuckoocache/cacheKeys"
 )
 
-type CacheBackingStore[KeyType cacheKeys.LocalNodeCacheKey] struct {
-	Read func(key KeyType) []byte
+// ErrNotFound is returned by Read when the backing store has no item for the key.
+// This is distinct from an item whose data is empty.
+var ErrNotFound = errors.New("item not found in cache backing store")
+
+type CacheBackingStore[KeyType cacheKeys.LocalNodeCacheKey] interface {
+	Read(ctx context.Context, key KeyType) ([]byte, error)
+}
+
+// CacheBackingStoreFunc adapts an ordinary function to the CacheBackingStore interface.
+type CacheBackingStoreFunc[KeyType cacheKeys.LocalNodeCacheKey] func(ctx context.Context, key KeyType) ([]byte, error)
+
+func (f CacheBackingStoreFunc[KeyType]) Read(ctx context.Context, key KeyType) ([]byte, error) {
+	return f(ctx, key)
 }
 
-func NewMockBackingStore[KeyType cacheKeys.LocalNodeCacheKey]() CacheBackingStore[KeyType] {
-	contents := make(map[KeyType][]byte)
-	return CacheBackingStore[KeyType]{
-		Read: func(key KeyType) []byte {
-			value := contents[key]
-			if value == nil {
-				buf := key.ToCacheKey()
-				value = crypto.Keccak256(buf[:])
-			}
-			return append([]byte{}, value...)
-		},
+// MockBackingStore returns a pseudorandom value for every key, unless the key has been written or deleted.
+type MockBackingStore[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	contents map[KeyType][]byte
+	deleted  map[KeyType]struct{}
+}
+
+func NewMockBackingStore[KeyType cacheKeys.LocalNodeCacheKey]() *MockBackingStore[KeyType] {
+	return &MockBackingStore[KeyType]{
+		contents: make(map[KeyType][]byte),
+		deleted:  make(map[KeyType]struct{}),
 	}
 }
+
+func (m *MockBackingStore[KeyType]) Read(ctx context.Context, key KeyType) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, isDeleted := m.deleted[key]; isDeleted {
+		return nil, ErrNotFound
+	}
+	value, exists := m.contents[key]
+	if !exists {
+		buf := key.ToCacheKey()
+		value = crypto.Keccak256(buf[:])
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (m *MockBackingStore[KeyType]) Write(key KeyType, value []byte) {
+	delete(m.deleted, key)
+	m.contents[key] = append([]byte{}, value...)
+}
+
+func (m *MockBackingStore[KeyType]) Delete(key KeyType) {
+	delete(m.contents, key)
+	m.deleted[key] = struct{}{}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cacheKeys
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+)
+
+var ErrBadEncodedKey = errors.New("malformed encoded cache key")
+
+// LocalNodeCacheKeyCodec converts local keys to and from bytes, so that they can be persisted.
+type LocalNodeCacheKeyCodec[KeyType LocalNodeCacheKey] interface {
+	EncodeKey(key KeyType) []byte
+	DecodeKey(buf []byte) (KeyType, error)
+}
+
+type Uint64KeyCodec struct{}
+
+func (Uint64KeyCodec) EncodeKey(key Uint64LocalCacheKey) []byte {
+	return binary.LittleEndian.AppendUint64([]byte{}, key.key)
+}
+
+func (Uint64KeyCodec) DecodeKey(buf []byte) (Uint64LocalCacheKey, error) {
+	if len(buf) != 8 {
+		return Uint64LocalCacheKey{}, ErrBadEncodedKey
+	}
+	return NewUint64LocalCacheKey(binary.LittleEndian.Uint64(buf)), nil
+}
+
+type AddressKeyCodec struct{}
+
+func (AddressKeyCodec) EncodeKey(key AddressLocalCacheKey) []byte {
+	return key.address.Bytes()
+}
+
+func (AddressKeyCodec) DecodeKey(buf []byte) (AddressLocalCacheKey, error) {
+	if len(buf) != common.AddressLength {
+		return AddressLocalCacheKey{}, ErrBadEncodedKey
+	}
+	return NewAddressLocalCacheKey(common.BytesToAddress(buf)), nil
+}
+
+type CacheKey256Codec struct{}
+
+func (CacheKey256Codec) EncodeKey(key CacheKey256) []byte {
+	return append([]byte{}, key.key[:]...)
+}
+
+func (CacheKey256Codec) DecodeKey(buf []byte) (CacheKey256, error) {
+	if len(buf) != len(onChainIndex.CacheItemKey{}) {
+		return CacheKey256{}, ErrBadEncodedKey
+	}
+	key := CacheKey256{}
+	copy(key.key[:], buf)
+	return key, nil
+}
+
+// Addresses aren't hashed by ToCacheKey, so an AddressLocalCacheKey can be recovered from its on-chain item key.
+func AddressLocalCacheKeyFromCacheKey(itemKey onChainIndex.CacheItemKey) (AddressLocalCacheKey, bool) {
+	if [4]byte(itemKey[20:24]) != [4]byte(itemKey[0:4]) {
+		return AddressLocalCacheKey{}, false
+	}
+	return NewAddressLocalCacheKey(common.BytesToAddress(itemKey[0:20])), true
+}
+
+// A CacheKey256 is its own on-chain item key, so it can always be recovered.
+func CacheKey256FromCacheKey(itemKey onChainIndex.CacheItemKey) (CacheKey256, bool) {
+	return CacheKey256{itemKey}, true
+}
@@ -0,0 +1,91 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cacheMetrics
+
+import (
+	"sync"
+)
+
+// Names of the metrics reported by the caches.
+const (
+	LocalHits          = "local/hits"      // reads of items that were in the local cache
+	LocalMisses        = "local/misses"    // reads of items that had to be brought into the local cache
+	LocalEvictions     = "local/evictions" // items evicted from the local cache to make room
+	LocalFlushes       = "local/flushes"   // flushes of the whole local cache
+	LocalItemFlushes   = "local/itemflushes"
+	OnChainHits        = "onchain/hits"
+	OnChainMisses      = "onchain/misses"
+	Relocations        = "onchain/relocations"      // items moved to another lane to make room for another item
+	RelocationDepth    = "onchain/relocation/depth" // histogram of the number of items moved to make room for one
+	DiscardedItems     = "onchain/discarded"        // items discarded because no lane could be found for them
+	GenerationAdvances = "onchain/generations"      // advances of the current generation
+	OnChainFlushes     = "onchain/flushes"          // flushes of the whole on-chain cache
+	OnChainItemFlushes = "onchain/itemflushes"
+)
+
+// A Sink receives the metrics reported by the caches.
+type Sink interface {
+	IncCounter(name string, delta int64)
+	ObserveHistogram(name string, value int64)
+}
+
+// NoopSink ignores all metrics.
+type NoopSink struct{}
+
+func (NoopSink) IncCounter(string, int64)       {}
+func (NoopSink) ObserveHistogram(string, int64) {}
+
+// InMemorySink keeps metrics in memory, so they can be inspected, such as by tests, or passed on to another sink.
+// It is safe for concurrent use.
+type InMemorySink struct {
+	mutex        sync.Mutex
+	counters     map[string]int64
+	observations map[string][]int64
+}
+
+func NewInMemorySink() *InMemorySink {
+	return &InMemorySink{
+		counters:     make(map[string]int64),
+		observations: make(map[string][]int64),
+	}
+}
+
+func (s *InMemorySink) IncCounter(name string, delta int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counters[name] += delta
+}
+
+func (s *InMemorySink) ObserveHistogram(name string, value int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.observations[name] = append(s.observations[name], value)
+}
+
+func (s *InMemorySink) Counter(name string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.counters[name]
+}
+
+// The values observed for a histogram, in the order they were observed.
+func (s *InMemorySink) Observations(name string) []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]int64{}, s.observations[name]...)
+}
+
+// Pass on everything this sink has received to another sink.
+func (s *InMemorySink) ReplayTo(sink Sink) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, delta := range s.counters {
+		sink.IncCounter(name, delta)
+	}
+	for name, values := range s.observations {
+		for _, value := range values {
+			sink.ObserveHistogram(name, value)
+		}
+	}
+}
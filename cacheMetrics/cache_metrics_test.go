@@ -0,0 +1,25 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cacheMetrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSinks(t *testing.T) {
+	memory := NewInMemorySink()
+	memory.IncCounter(LocalHits, 3)
+	memory.IncCounter(LocalHits, 4)
+	memory.ObserveHistogram(RelocationDepth, 2)
+	memory.ObserveHistogram(RelocationDepth, 5)
+	assert.Equal(t, memory.Counter(LocalHits), int64(7))
+	assert.Equal(t, memory.Counter(LocalMisses), int64(0))
+	assert.Equal(t, memory.Observations(RelocationDepth), []int64{2, 5})
+
+	replayed := NewInMemorySink()
+	memory.ReplayTo(replayed)
+	assert.Equal(t, replayed.Counter(LocalHits), int64(7))
+	assert.Equal(t, replayed.Observations(RelocationDepth), []int64{2, 5})
+}
@@ -0,0 +1,31 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+// Package gethMetrics reports the caches' metrics to a go-ethereum metrics registry. It is a module of its own,
+// so that using the caches doesn't bring in the dependencies of go-ethereum's metrics.
+package gethMetrics
+
+import (
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// Sink reports metrics to a go-ethereum metrics registry, with names prefixed by prefix.
+// Like other go-ethereum metrics, they are only collected if metrics.Enabled is set when they are first reported.
+type Sink struct {
+	registry metrics.Registry
+	prefix   string
+}
+
+func NewSink(registry metrics.Registry, prefix string) *Sink {
+	return &Sink{registry: registry, prefix: prefix}
+}
+
+func (s *Sink) IncCounter(name string, delta int64) {
+	metrics.GetOrRegisterCounter(s.prefix+name, s.registry).Inc(delta)
+}
+
+func (s *Sink) ObserveHistogram(name string, value int64) {
+	metrics.GetOrRegisterHistogramLazy(s.prefix+name, s.registry, func() metrics.Sample {
+		return metrics.NewExpDecaySample(1028, 0.015)
+	}).Update(value)
+}
@@ -0,0 +1,30 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package gethMetrics
+
+import (
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/offchainlabs/cuckoocache/cacheMetrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSink(t *testing.T) {
+	metrics.Enabled = true
+	registry := metrics.NewRegistry()
+	memory := cacheMetrics.NewInMemorySink()
+	memory.IncCounter(cacheMetrics.LocalHits, 7)
+	memory.ObserveHistogram(cacheMetrics.RelocationDepth, 2)
+	memory.ObserveHistogram(cacheMetrics.RelocationDepth, 5)
+
+	memory.ReplayTo(NewSink(registry, "cuckoocache/"))
+	counter, ok := registry.Get("cuckoocache/" + cacheMetrics.LocalHits).(metrics.Counter)
+	assert.True(t, ok)
+	assert.Equal(t, counter.Snapshot().Count(), int64(7))
+	histogram, ok := registry.Get("cuckoocache/" + cacheMetrics.RelocationDepth).(metrics.Histogram)
+	assert.True(t, ok)
+	assert.Equal(t, histogram.Snapshot().Count(), int64(2))
+	assert.Equal(t, histogram.Snapshot().Max(), int64(5))
+	assert.Nil(t, registry.Get("cuckoocache/"+cacheMetrics.LocalMisses))
+}
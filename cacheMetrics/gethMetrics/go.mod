@@ -0,0 +1,25 @@
+module github.com/offchainlabs/cuckoocache/cacheMetrics/gethMetrics
+
+go 1.21.7
+
+require (
+	github.com/ethereum/go-ethereum v1.13.12
+	github.com/offchainlabs/cuckoocache v0.0.0
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
+	github.com/StackExchange/wmi v1.2.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-ole/go-ole v1.3.0 // indirect
+	github.com/holiman/uint256 v1.2.4 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/shirou/gopsutil v3.21.4-0.20210419000835-c7a38de76ee5+incompatible // indirect
+	github.com/tklauser/go-sysconf v0.3.12 // indirect
+	github.com/tklauser/numcpus v0.6.1 // indirect
+	golang.org/x/exp v0.0.0-20231110203233-9a3e6036ecaa // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/offchainlabs/cuckoocache => ../..
@@ -0,0 +1,426 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+// Command cuckoocache inspects on-chain cache indexes and simulates the cache on traces of accesses.
+//
+//	cuckoocache dump -state FILE
+//	cuckoocache stats -state FILE
+//	cuckoocache evaluate -trace FILE -onchain N -local N [-live N] [-threshold N] [-keytype uint64|address]
+//	cuckoocache sweep -trace FILE -onchain N,N,... -local N,N,... [-live N,N,...] [-threshold N,N,...]
+//	        [-keytype uint64|address] [-out FILE]
+//
+// A state file is a JSON object mapping the index's storage locations to their values, as 32-byte hex strings,
+// either on its own or as the "storage" field of an account in a state dump. A trace file has one key per line,
+// either a decimal number or a hex address, depending on -keytype; blank lines and lines starting with # are
+// skipped.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/evaluation"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errUsage = errors.New("usage: cuckoocache dump|stats|evaluate|sweep [flags]")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "dump":
+		return dump(args[1:], stdout)
+	case "stats":
+		return stats(args[1:], stdout)
+	case "evaluate":
+		return evaluate(args[1:], stdout)
+	case "sweep":
+		return sweep(args[1:], stdout)
+	default:
+		return errUsage
+	}
+}
+
+func dump(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	statePath := flags.String("state", "", "JSON file of the on-chain index's storage")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	table, header, err := openState(*statePath)
+	if err != nil {
+		return err
+	}
+	printHeader(stdout, header)
+	_, err = onChainIndex.ForAllOnChainCachedItemsWithAge(
+		table,
+		func(itemKey onChainIndex.CacheItemKey, age uint64, _ struct{}) (struct{}, error) {
+			_, err := fmt.Fprintf(stdout, "%x %d\n", itemKey, header.CurrentGeneration-age)
+			return struct{}{}, err
+		},
+		struct{}{},
+	)
+	return err
+}
+
+func stats(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	statePath := flags.String("state", "", "JSON file of the on-chain index's storage")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	table, header, err := openState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	// entries of the table, and of the old table of a resize, by generation
+	generations, err := onChainIndex.ForAllTableEntries(
+		table,
+		func(
+			region uint8, _, _ uint64, item onChainIndex.CuckooItem, soFar [2]map[uint64]uint64,
+		) ([2]map[uint64]uint64, error) {
+			soFar[region][item.Generation]++
+			return soFar, nil
+		},
+		[2]map[uint64]uint64{{}, {}},
+	)
+	if err != nil {
+		return err
+	}
+	printHeader(stdout, header)
+	printGenerations(stdout, "entries", header, generations[header.TableRegion])
+	if header.Resizing {
+		printGenerations(stdout, "old table entries", header, generations[1-header.TableRegion])
+	}
+
+	report, err := table.Check()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "live entries: %d (current generation %d)\n", report.InCacheCount, report.CurrentGenCount)
+	fmt.Fprintf(stdout, "violations: %d\n", len(report.Violations))
+	for _, violation := range report.Violations {
+		fmt.Fprintf(
+			stdout, "  %s: region %d slot %d lane %d key %x generation %d\n",
+			violation.Kind, violation.Region, violation.Slot, violation.Lane,
+			violation.Item.ItemKey, violation.Item.Generation,
+		)
+	}
+	return nil
+}
+
+func evaluate(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("evaluate", flag.ContinueOnError)
+	tracePath := flags.String("trace", "", "file of keys accessed, one per line")
+	keyType := flags.String("keytype", "uint64", "type of the keys in the trace, uint64 or address")
+	onChainSize := flags.Uint64("onchain", 1024, "capacity of the on-chain index")
+	localSize := flags.Uint64("local", 1024, "capacity of the local node cache")
+	live := flags.Uint64("live", onChainIndex.DefaultLiveGenerations, "number of live generations of the on-chain index")
+	threshold := flags.Uint64("threshold", 0, "current generation threshold of the on-chain index, 0 for the default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	params, err := generationParameters(*live, *threshold)
+	if err != nil {
+		return err
+	}
+	evaluator, numAccesses, err := loadTrace(*tracePath, *keyType)
+	if err != nil {
+		return err
+	}
+	result, err := evaluator(*onChainSize, *localSize, params)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "accesses: %d\n", numAccesses)
+	fmt.Fprintf(stdout, "on-chain hits: %d (%s)\n", result.onChainHits, hitRate(result.onChainHits, numAccesses))
+	fmt.Fprintf(stdout, "local hits: %d (%s)\n", result.localHits, hitRate(result.localHits, numAccesses))
+	fmt.Fprintf(stdout, "storage reads: %d\n", result.storageReads)
+	fmt.Fprintf(stdout, "storage writes: %d\n", result.storageWrites)
+	return nil
+}
+
+func sweep(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("sweep", flag.ContinueOnError)
+	tracePath := flags.String("trace", "", "file of keys accessed, one per line")
+	keyType := flags.String("keytype", "uint64", "type of the keys in the trace, uint64 or address")
+	onChainSizes := flags.String("onchain", "256,1024,4096", "comma-separated capacities of the on-chain index")
+	localSizes := flags.String("local", "256,1024,4096", "comma-separated capacities of the local node cache")
+	lives := flags.String("live", "2", "comma-separated numbers of live generations of the on-chain index")
+	thresholds := flags.String("threshold", "0", "comma-separated current generation thresholds, 0 for the default")
+	outPath := flags.String("out", "", "CSV file to write, instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	onChainList, err := parseSizes(*onChainSizes)
+	if err != nil {
+		return err
+	}
+	localList, err := parseSizes(*localSizes)
+	if err != nil {
+		return err
+	}
+	liveList, err := parseSizes(*lives)
+	if err != nil {
+		return err
+	}
+	thresholdList, err := parseSizes(*thresholds)
+	if err != nil {
+		return err
+	}
+	paramsList := []onChainIndex.GenerationParameters{}
+	for _, live := range liveList {
+		for _, threshold := range thresholdList {
+			params, err := generationParameters(live, threshold)
+			if err != nil {
+				return err
+			}
+			paramsList = append(paramsList, params)
+		}
+	}
+	evaluator, numAccesses, err := loadTrace(*tracePath, *keyType)
+	if err != nil {
+		return err
+	}
+
+	out := stdout
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := csv.NewWriter(out)
+	if err := writer.Write([]string{
+		"onchain_capacity", "local_capacity", "accesses", "onchain_hits", "onchain_hit_rate",
+		"local_hits", "local_hit_rate", "storage_reads", "storage_writes", "live_generations", "current_gen_threshold",
+	}); err != nil {
+		return err
+	}
+	for _, onChainSize := range onChainList {
+		for _, localSize := range localList {
+			for _, params := range paramsList {
+				result, err := evaluator(onChainSize, localSize, params)
+				if err != nil {
+					return err
+				}
+				if err := writer.Write([]string{
+					strconv.FormatUint(onChainSize, 10),
+					strconv.FormatUint(localSize, 10),
+					strconv.FormatUint(numAccesses, 10),
+					strconv.FormatUint(result.onChainHits, 10),
+					hitRate(result.onChainHits, numAccesses),
+					strconv.FormatUint(result.localHits, 10),
+					hitRate(result.localHits, numAccesses),
+					strconv.FormatUint(result.storageReads, 10),
+					strconv.FormatUint(result.storageWrites, 10),
+					strconv.FormatUint(params.NumLiveGenerations(), 10),
+					strconv.FormatUint(uint64(params.CurrentGenThreshold), 10),
+				}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Load the on-chain index's storage from a state file into mock storage, and open the index.
+func openState(path string) (*onChainIndex.OnChainCuckooTable, onChainIndex.OnChainCuckooHeader, error) {
+	if path == "" {
+		return nil, onChainIndex.OnChainCuckooHeader{}, errors.New("no state file given")
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, onChainIndex.OnChainCuckooHeader{}, err
+	}
+	var account struct {
+		Storage map[string]string `json:"storage"`
+	}
+	var contents map[string]string
+	if err := json.Unmarshal(buf, &account); err == nil && account.Storage != nil {
+		contents = account.Storage
+	} else if err := json.Unmarshal(buf, &contents); err != nil {
+		return nil, onChainIndex.OnChainCuckooHeader{}, fmt.Errorf("%s: %w", path, err)
+	}
+	storage := onChainStorage.NewMockOnChainStorage()
+	for location, value := range contents {
+		if err := storage.Set(common.HexToHash(location), common.HexToHash(value)); err != nil {
+			return nil, onChainIndex.OnChainCuckooHeader{}, err
+		}
+	}
+	table := onChainIndex.OpenOnChainCuckooTable(storage, 0)
+	header, err := table.ReadHeader()
+	if err != nil {
+		return nil, onChainIndex.OnChainCuckooHeader{}, err
+	}
+	return table, header, nil
+}
+
+func printGenerations(
+	stdout io.Writer,
+	title string,
+	header onChainIndex.OnChainCuckooHeader,
+	generations map[uint64]uint64,
+) {
+	numEntries := uint64(0)
+	sorted := make([]uint64, 0, len(generations))
+	for generation, count := range generations {
+		numEntries += count
+		sorted = append(sorted, generation)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	fmt.Fprintf(stdout, "%s: %d\n", title, numEntries)
+	for _, generation := range sorted {
+		status := "expired"
+		switch {
+		case generation == 0:
+			status = "empty"
+		case generation > header.CurrentGeneration:
+			status = "future"
+		case generation == header.CurrentGeneration:
+			status = "current"
+		case generation+1 == header.CurrentGeneration:
+			status = "previous"
+		case generation+header.NumLiveGenerations() > header.CurrentGeneration:
+			status = "live"
+		}
+		fmt.Fprintf(stdout, "  generation %d (%s): %d\n", generation, status, generations[generation])
+	}
+}
+
+func printHeader(stdout io.Writer, header onChainIndex.OnChainCuckooHeader) {
+	fmt.Fprintf(stdout, "version: %d\n", header.Version)
+	fmt.Fprintf(stdout, "capacity: %d\n", header.Capacity)
+	fmt.Fprintf(stdout, "generation: %d\n", header.CurrentGeneration)
+	fmt.Fprintf(stdout, "live generations: %d\n", header.NumLiveGenerations())
+	fmt.Fprintf(stdout, "in cache: %d (current generation %d)\n", header.InCacheCount, header.CurrentGenCount)
+	fmt.Fprintf(stdout, "table region: %d\n", header.TableRegion)
+	fmt.Fprintf(stdout, "resizing: %t\n", header.Resizing)
+}
+
+type evaluationResult struct {
+	onChainHits   uint64
+	localHits     uint64
+	storageReads  uint64
+	storageWrites uint64
+}
+
+// Read a trace, and return a function that evaluates the cache on it, and the number of accesses in it.
+func loadTrace(
+	path string,
+	keyType string,
+) (func(uint64, uint64, onChainIndex.GenerationParameters) (evaluationResult, error), uint64, error) {
+	if path == "" {
+		return nil, 0, errors.New("no trace file given")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	lines := []string{}
+	lineNumbers := []int{} // of the lines kept, in the file, for errors
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+			lineNumbers = append(lineNumbers, lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	switch keyType {
+	case "uint64":
+		keys := make([]cacheKeys.Uint64LocalCacheKey, len(lines))
+		for i, line := range lines {
+			key, err := strconv.ParseUint(line, 10, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s:%d: %w", path, lineNumbers[i], err)
+			}
+			keys[i] = cacheKeys.NewUint64LocalCacheKey(key)
+		}
+		return evaluatorFor(keys), uint64(len(keys)), nil
+	case "address":
+		keys := make([]cacheKeys.AddressLocalCacheKey, len(lines))
+		for i, line := range lines {
+			if !common.IsHexAddress(line) {
+				return nil, 0, fmt.Errorf("%s:%d: not an address: %s", path, lineNumbers[i], line)
+			}
+			keys[i] = cacheKeys.NewAddressLocalCacheKey(common.HexToAddress(line))
+		}
+		return evaluatorFor(keys), uint64(len(keys)), nil
+	default:
+		return nil, 0, fmt.Errorf("unknown key type %s", keyType)
+	}
+}
+
+func evaluatorFor[KeyType cacheKeys.LocalNodeCacheKey](
+	keys []KeyType,
+) func(uint64, uint64, onChainIndex.GenerationParameters) (evaluationResult, error) {
+	return func(onChainSize, localSize uint64, params onChainIndex.GenerationParameters) (evaluationResult, error) {
+		onChainHits, localHits, storageReads, storageWrites, err := evaluation.EvaluateOnDataWithParameters(
+			onChainSize,
+			localSize,
+			params,
+			keys,
+		)
+		return evaluationResult{onChainHits, localHits, storageReads, storageWrites}, err
+	}
+}
+
+// The generation parameters for a number of live generations and a current generation threshold, which are checked
+// only for fitting the parameters' fields; the on-chain index checks the rest.
+func generationParameters(live, threshold uint64) (onChainIndex.GenerationParameters, error) {
+	if live > math.MaxUint8 || threshold > math.MaxUint16 {
+		return onChainIndex.GenerationParameters{}, fmt.Errorf("%d live generations or threshold %d out of range", live, threshold)
+	}
+	return onChainIndex.GenerationParameters{LiveGenerations: uint8(live), CurrentGenThreshold: uint16(threshold)}, nil
+}
+
+func parseSizes(list string) ([]uint64, error) {
+	sizes := []uint64{}
+	for _, field := range strings.Split(list, ",") {
+		size, err := strconv.ParseUint(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func hitRate(hits, accesses uint64) string {
+	if accesses == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(hits)/float64(accesses), 'f', 4, 64)
+}
@@ -0,0 +1,160 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/evaluation"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpAndStats(t *testing.T) {
+	capacity := uint64(32)
+	storage := onChainStorage.NewMockOnChainStorage()
+	table := onChainIndex.OpenOnChainCuckooTable(storage, capacity)
+	assert.Nil(t, table.Initialize(capacity))
+	for i := uint64(0); i < 100; i++ {
+		_, _, err := table.AccessItem(cacheKeys.NewUint64LocalCacheKey(i % 45).ToCacheKey())
+		assert.Nil(t, err)
+	}
+	header, err := table.ReadHeader()
+	assert.Nil(t, err)
+	contents := storageContents(storage)
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	writeJSON(t, statePath, contents)
+	accountPath := filepath.Join(dir, "account.json")
+	writeJSON(t, accountPath, map[string]any{"balance": "0", "storage": contents})
+
+	for _, path := range []string{statePath, accountPath} {
+		var out bytes.Buffer
+		assert.Nil(t, run([]string{"dump", "-state", path}, &out))
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		assert.Contains(t, lines, fmt.Sprintf("generation: %d", header.CurrentGeneration))
+		// seven lines of header, then one line per live item
+		assert.Equal(t, uint64(len(lines)-7), header.InCacheCount)
+		key := cacheKeys.NewUint64LocalCacheKey(99 % 45).ToCacheKey() // the latest item accessed
+		assert.Contains(t, lines, fmt.Sprintf("%x %d", key, header.CurrentGeneration))
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, run([]string{"stats", "-state", statePath}, &out))
+	assert.Contains(t, out.String(), fmt.Sprintf("generation %d (current)", header.CurrentGeneration))
+	assert.Contains(t, out.String(), fmt.Sprintf("live entries: %d", header.InCacheCount))
+	assert.Contains(t, out.String(), "violations: 0\n")
+
+	assert.NotContains(t, out.String(), "old table entries")
+
+	// the old table of a resize in progress is counted too
+	assert.Nil(t, table.StartResize(2*capacity))
+	writeJSON(t, statePath, storageContents(storage))
+	out.Reset()
+	assert.Nil(t, run([]string{"stats", "-state", statePath}, &out))
+	assert.Contains(t, out.String(), fmt.Sprintf("entries: %d\n", 2*capacity*onChainIndex.NumLanes))
+	assert.Contains(t, out.String(), fmt.Sprintf("old table entries: %d\n", capacity*onChainIndex.NumLanes))
+
+	// a header that doesn't describe a table is rejected before the table is read
+	assert.Nil(t, storage.NewSlot(0).Set(common.BytesToHash(bytes.Repeat([]byte{0xff}, 32))))
+	writeJSON(t, statePath, storageContents(storage))
+	assert.ErrorIs(t, run([]string{"stats", "-state", statePath}, &out), onChainIndex.ErrCorruptHeader)
+	assert.NotNil(t, run([]string{"stats", "-state", filepath.Join(dir, "missing.json")}, &out))
+	assert.ErrorIs(t, run([]string{"frobnicate"}, &out), errUsage)
+}
+
+func TestEvaluateAndSweep(t *testing.T) {
+	dir := t.TempDir()
+	tracePath := filepath.Join(dir, "trace")
+	trace := "# a trace\n"
+	keys := []cacheKeys.Uint64LocalCacheKey{}
+	for i := uint64(0); i < 500; i++ {
+		trace += fmt.Sprintf("%d\n", (i*i)%53)
+		keys = append(keys, cacheKeys.NewUint64LocalCacheKey((i*i)%53))
+	}
+	assert.Nil(t, os.WriteFile(tracePath, []byte(trace+"\n"), 0o644))
+
+	var out bytes.Buffer
+	assert.Nil(t, run([]string{"evaluate", "-trace", tracePath, "-onchain", "16", "-local", "32"}, &out))
+	onChainHits, localHits, reads, writes, err := evaluation.EvaluateOnData(16, 32, keys)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "accesses: 500\n")
+	assert.Contains(t, out.String(), fmt.Sprintf("on-chain hits: %d (", onChainHits))
+	assert.Contains(t, out.String(), fmt.Sprintf("local hits: %d (", localHits))
+	assert.Contains(t, out.String(), fmt.Sprintf("storage reads: %d\n", reads))
+	assert.Contains(t, out.String(), fmt.Sprintf("storage writes: %d\n", writes))
+
+	csvPath := filepath.Join(dir, "sweep.csv")
+	assert.Nil(t, run([]string{"sweep", "-trace", tracePath, "-onchain", "8,16", "-local", "8,32,64", "-out", csvPath}, &out))
+	file, err := os.Open(csvPath)
+	assert.Nil(t, err)
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, len(rows), 1+2*3)
+	assert.Equal(t, rows[0][0], "onchain_capacity")
+	assert.Equal(t, rows[5][:2], []string{"16", "32"})
+	assert.Equal(t, rows[5][3], fmt.Sprintf("%d", onChainHits))
+	assert.Equal(t, rows[5][9:], []string{"2", "0"})
+
+	args := []string{"sweep", "-trace", tracePath, "-onchain", "16", "-local", "32", "-live", "2,4", "-threshold", "0,375"}
+	assert.Nil(t, run(append(args, "-out", csvPath), &out))
+	file, err = os.Open(csvPath)
+	assert.Nil(t, err)
+	defer file.Close()
+	rows, err = csv.NewReader(file).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, len(rows), 1+2*2)
+	assert.Equal(t, rows[0][9:], []string{"live_generations", "current_gen_threshold"})
+	assert.Equal(t, rows[1][3], fmt.Sprintf("%d", onChainHits))
+	onChainHits, _, _, writes, err = evaluation.EvaluateOnDataWithParameters(
+		16,
+		32,
+		onChainIndex.GenerationParameters{LiveGenerations: 4, CurrentGenThreshold: 375},
+		keys,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, rows[4][3], fmt.Sprintf("%d", onChainHits))
+	assert.Equal(t, rows[4][8:], []string{fmt.Sprintf("%d", writes), "4", "375"})
+	assert.NotNil(t, run([]string{"sweep", "-trace", tracePath, "-live", "300"}, &out))
+	assert.ErrorIs(
+		t,
+		run([]string{"evaluate", "-trace", tracePath, "-live", "9"}, &out),
+		onChainIndex.ErrInvalidGenerationParameters,
+	)
+
+	addressPath := filepath.Join(dir, "addresses")
+	addresses := "# addresses\n0x00000000000000000000000000000000000000aa\n\nnot an address\n"
+	assert.Nil(t, os.WriteFile(addressPath, []byte(addresses), 0o644))
+	assert.ErrorContains(t, run([]string{"evaluate", "-trace", addressPath, "-keytype", "address"}, &out), ":4:")
+	assert.NotNil(t, run([]string{"sweep", "-trace", tracePath, "-onchain", "8,x"}, &out))
+
+	badPath := filepath.Join(dir, "bad")
+	assert.Nil(t, os.WriteFile(badPath, []byte("# keys\n\n12\nx\n"), 0o644))
+	assert.ErrorContains(t, run([]string{"evaluate", "-trace", badPath}, &out), ":4:")
+}
+
+func storageContents(storage onChainStorage.OnChainStorage) map[string]string {
+	contents := map[string]string{}
+	for location, value := range storage.(*onChainStorage.MockOnChainStorage).Snapshot() {
+		contents[location.Hex()] = value.Hex()
+	}
+	return contents
+}
+
+func writeJSON(t *testing.T, path string, contents any) {
+	t.Helper()
+	buf, err := json.Marshal(contents)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, buf, 0o644))
+}
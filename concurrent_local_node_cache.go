@@ -0,0 +1,233 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"bytes"
+	"context"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/replacementPolicy"
+	"io"
+	"sync"
+)
+
+// ConcurrentLocalNodeCache makes a LocalNodeCache safe to share between goroutines.
+//
+// Read-only queries of the local cache (IsInConcurrentCache, PeekItemInConcurrentCache, ForAllInConcurrentCache)
+// only take a shared lock, so they don't wait for each other. Reads of items that are in the local cache also only
+// take the shared lock: their accesses to the on-chain index are serialized by a mutex of their own, because every
+// access to the on-chain index can modify it, and moving them to the front of the LRU order is put off until the
+// exclusive lock is next taken. Values of missing items are fetched from the backing store before the exclusive
+// lock is taken, so slow backing store reads don't block other goroutines; this means the backing store must itself
+// be safe for concurrent use.
+//
+// Once a LocalNodeCache is wrapped, it and its on-chain index must only be used through the wrapper.
+type ConcurrentLocalNodeCache[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	mutex         sync.RWMutex
+	cache         *LocalNodeCache[KeyType]
+	modifications uint64 // how many times the cache has been modified, so views can tell they are outdated
+
+	// onChainMutex serializes accesses to the on-chain index made while holding only the shared lock, and guards
+	// pending and modifications while the shared lock is held
+	onChainMutex sync.Mutex
+	pending      []pendingAccess[KeyType] // hits not yet applied to the local cache, in the order they were made
+}
+
+type pendingAccess[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	key        KeyType
+	generation uint64
+}
+
+// Hits are applied to the local cache once this many are pending, so that hits alone don't grow pending forever.
+const maxPendingAccesses = 1024
+
+func NewConcurrentLocalNodeCache[KeyType cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[KeyType],
+) *ConcurrentLocalNodeCache[KeyType] {
+	return &ConcurrentLocalNodeCache[KeyType]{cache: cache}
+}
+
+func IsInConcurrentCache[CacheKey cacheKeys.LocalNodeCacheKey](cache *ConcurrentLocalNodeCache[CacheKey], key CacheKey) bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return IsInLocalNodeCache(cache.cache, key)
+}
+
+// Get an item's value if it is in the local cache, without accessing the on-chain index or changing the LRU order.
+func PeekItemInConcurrentCache[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *ConcurrentLocalNodeCache[CacheKey],
+	key CacheKey,
+) ([]byte, bool) { // (data, wasInLocalCache)
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	node := cache.cache.index[key]
+	if node == nil {
+		return nil, false
+	}
+	return node.itemValue, true
+}
+
+func ReadItemFromConcurrentCache[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	cache *ConcurrentLocalNodeCache[CacheKey],
+	key CacheKey,
+) ([]byte, bool, error) { // (data, wasHitInCache)
+	value, hitOnChain, wasLocalHit, err := readLocalHit(cache, key)
+	if wasLocalHit || err != nil {
+		return value, hitOnChain, err
+	}
+
+	value, err = cache.cache.backingStore.Read(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	applyPendingAccesses(cache)
+	cache.modifications++
+	// if another goroutine brought the item into the local cache in the meantime, the value we read is ignored
+	return readItem(cache.cache, key, value)
+}
+
+// Access an item that is in the local cache while holding only the shared lock, and queue the hit to be applied to
+// the local cache later.
+func readLocalHit[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *ConcurrentLocalNodeCache[CacheKey],
+	key CacheKey,
+) ([]byte, bool, bool, error) { // (data, wasHitInCache, wasLocalHit, error)
+	cache.mutex.RLock()
+	node := cache.cache.index[key]
+	if node == nil {
+		cache.mutex.RUnlock()
+		return nil, false, false, nil
+	}
+	cache.onChainMutex.Lock()
+	hitOnChain, generationAfterAccess, err := cache.cache.onChain.AccessItem(key.ToCacheKey())
+	if err == nil {
+		cache.pending = append(cache.pending, pendingAccess[CacheKey]{key, generationAfterAccess})
+		cache.modifications++
+	}
+	tooManyPending := len(cache.pending) >= maxPendingAccesses
+	cache.onChainMutex.Unlock()
+	value := node.itemValue
+	cache.mutex.RUnlock()
+	if err != nil {
+		return nil, false, true, err
+	}
+
+	if tooManyPending {
+		cache.mutex.Lock()
+		applyPendingAccesses(cache)
+		cache.mutex.Unlock()
+	}
+	return value, hitOnChain, true, nil
+}
+
+// Apply the hits made while holding only the shared lock to the local cache. The exclusive lock must be held.
+func applyPendingAccesses[CacheKey cacheKeys.LocalNodeCacheKey](cache *ConcurrentLocalNodeCache[CacheKey]) {
+	for _, access := range cache.pending {
+		// items are only removed from the local cache while holding the exclusive lock, after applying pending hits
+		cacheAccessedItem(cache.cache, access.key, nil, access.generation)
+	}
+	cache.pending = nil
+}
+
+func FlushConcurrentCache[CacheKey cacheKeys.LocalNodeCacheKey](cache *ConcurrentLocalNodeCache[CacheKey], flushOnChain bool) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	applyPendingAccesses(cache)
+	cache.modifications++
+	return FlushLocalNodeCache(cache.cache, flushOnChain)
+}
+
+func FlushOneItemFromConcurrentCache[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *ConcurrentLocalNodeCache[CacheKey],
+	key CacheKey,
+	flushOnChain bool,
+) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	applyPendingAccesses(cache)
+	cache.modifications++
+	return FlushOneItemFromLocalNodeCache(cache.cache, key, flushOnChain)
+}
+
+// Choose the items to evict with policy, as SetLocalNodeCacheReplacementPolicy does. The policy is only called
+// while holding the exclusive lock, so it needn't be safe for concurrent use.
+func SetConcurrentCacheReplacementPolicy[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *ConcurrentLocalNodeCache[CacheKey],
+	policy replacementPolicy.ReplacementPolicy[CacheKey],
+) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	applyPendingAccesses(cache)
+	cache.modifications++
+	SetLocalNodeCacheReplacementPolicy(cache.cache, policy)
+}
+
+func PruneConcurrentCacheKeyResolver[CacheKey cacheKeys.LocalNodeCacheKey](cache *ConcurrentLocalNodeCache[CacheKey]) (uint64, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	applyPendingAccesses(cache)
+	return PruneLocalNodeCacheKeyResolver(cache.cache)
+}
+
+// f is called while holding a shared lock, so it must not call back into the cache
+func ForAllInConcurrentCache[CacheKey cacheKeys.LocalNodeCacheKey, Accumulator any](
+	cache *ConcurrentLocalNodeCache[CacheKey],
+	f func(key CacheKey, value []byte, t Accumulator) Accumulator,
+	t Accumulator,
+) Accumulator {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return ForAllInLocalNodeCache(cache.cache, f, t)
+}
+
+// The snapshot is made in memory while holding an exclusive lock, so that it includes the pending hits, and only
+// written to the file once the lock has been released.
+func SaveConcurrentCacheSnapshot[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *ConcurrentLocalNodeCache[CacheKey],
+	path string,
+	codec cacheKeys.LocalNodeCacheKeyCodec[CacheKey],
+	withValues bool,
+) error {
+	var snapshot bytes.Buffer
+	cache.mutex.Lock()
+	applyPendingAccesses(cache)
+	err := WriteLocalNodeCacheSnapshot(cache.cache, &snapshot, codec, withValues)
+	cache.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeSnapshotFile(path, func(w io.Writer) error {
+		_, err := w.Write(snapshot.Bytes())
+		return err
+	})
+}
+
+// The check is made while holding an exclusive lock, because it reads the on-chain index and can repair the cache.
+func VerifyConcurrentCacheInclusion[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	cache *ConcurrentLocalNodeCache[CacheKey],
+	repair bool,
+) (InclusionReport, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	applyPendingAccesses(cache)
+	if repair {
+		cache.modifications++
+	}
+	return VerifyInclusion(ctx, cache.cache, repair)
+}
+
+func ReconcileConcurrentCache[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	cache *ConcurrentLocalNodeCache[CacheKey],
+) (InclusionReport, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	applyPendingAccesses(cache)
+	cache.modifications++
+	return ReconcileLocalNodeCache(ctx, cache.cache)
+}
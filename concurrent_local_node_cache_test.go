@@ -0,0 +1,190 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"context"
+	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/offchainlabs/cuckoocache/replacementPolicy"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentCacheStress(t *testing.T) {
+	onChainCapacity := uint64(32)
+	nodeCapacity := 2*onChainCapacity + 17
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	inner, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+	assert.Nil(t, err)
+	cache := NewConcurrentLocalNodeCache(inner)
+
+	numWorkers := 8
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < numWorkers; worker++ {
+		wg.Add(1)
+		go func(worker uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < 500; i++ {
+				key := cacheKeys.NewUint64LocalCacheKey((worker*7919 + i*31) % (3 * nodeCapacity))
+				switch i % 50 {
+				case 17:
+					assert.Nil(t, FlushOneItemFromConcurrentCache(cache, key, i%2 == 0))
+				case 49:
+					if worker == 0 {
+						assert.Nil(t, FlushConcurrentCache(cache, false))
+					}
+				default:
+					value, _, err := ReadItemFromConcurrentCache(context.Background(), cache, key)
+					assert.Nil(t, err)
+					assert.Equal(t, value, expectedValue(t, backing, key))
+				}
+				if peeked, inCache := PeekItemInConcurrentCache(cache, key); inCache {
+					assert.Equal(t, peeked, expectedValue(t, backing, key))
+				}
+				_ = IsInConcurrentCache(cache, key)
+			}
+		}(uint64(worker))
+	}
+	for reader := 0; reader < 2; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				count := ForAllInConcurrentCache(
+					cache,
+					func(_ cacheKeys.Uint64LocalCacheKey, _ []byte, soFar uint64) uint64 { return soFar + 1 },
+					uint64(0),
+				)
+				assert.LessOrEqual(t, count, nodeCapacity)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cache.mutex.Lock()
+	applyPendingAccesses(cache)
+	cache.mutex.Unlock()
+	verifyCacheInvariants(t, inner)
+	for i := uint64(0); i < 2*nodeCapacity; i++ {
+		_, _, err := ReadItemFromConcurrentCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(1000000+i))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, subsetPropertyHolds(t, inner), true)
+}
+
+func TestConcurrentCacheLocalHits(t *testing.T) {
+	onChainCapacity := uint64(16)
+	nodeCapacity := 2*onChainCapacity + 5
+	newCache := func() (*LocalNodeCache[cacheKeys.Uint64LocalCacheKey], onChainStorage.OnChainStorage) {
+		storage := onChainStorage.NewMockOnChainStorage()
+		onChain := onChainIndex.OpenOnChainCuckooTable(storage, onChainCapacity)
+		assert.Nil(t, onChain.Initialize(onChainCapacity))
+		backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+		cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+		assert.Nil(t, err)
+		return cache, storage
+	}
+	inner, storage := newCache()
+	cache := NewConcurrentLocalNodeCache(inner)
+	reference, referenceStorage := newCache()
+
+	// hits are queued while misses apply them, so the result must be the same as reading in order without queueing
+	for i := uint64(0); i < 3000; i++ {
+		key := cacheKeys.NewUint64LocalCacheKey((i*i + i/5) % (3 * nodeCapacity))
+		value, hit, err := ReadItemFromConcurrentCache(context.Background(), cache, key)
+		assert.Nil(t, err)
+		expectedValue, expectedHit, err := ReadItemFromLocalCache(context.Background(), reference, key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, expectedValue)
+		assert.Equal(t, hit, expectedHit)
+	}
+	assert.NotEmpty(t, cache.pending)
+	cache.mutex.Lock()
+	applyPendingAccesses(cache)
+	cache.mutex.Unlock()
+	verifySameLruList(t, inner, reference)
+	assert.Equal(t, storage.(*onChainStorage.MockOnChainStorage).Snapshot(), referenceStorage.(*onChainStorage.MockOnChainStorage).Snapshot())
+
+	// a snapshot includes the hits that haven't been applied yet
+	for i := uint64(0); i < 20; i++ {
+		_, _, err := ReadItemFromConcurrentCache(context.Background(), cache, inner.lru.itemKey)
+		assert.Nil(t, err)
+	}
+	assert.NotEmpty(t, cache.pending)
+	path := filepath.Join(t.TempDir(), "local-cache")
+	assert.Nil(t, SaveConcurrentCacheSnapshot(cache, path, cacheKeys.Uint64KeyCodec{}, true))
+	restored, err := LoadLocalNodeCacheSnapshot[cacheKeys.Uint64LocalCacheKey](
+		context.Background(), path, nodeCapacity, inner.onChain, inner.backingStore, cacheKeys.Uint64KeyCodec{},
+	)
+	assert.Nil(t, err)
+	verifySameLruList(t, restored, inner)
+
+	// a local hit only takes the shared lock
+	key := cacheKeys.NewUint64LocalCacheKey(0)
+	assert.True(t, IsInConcurrentCache(cache, key))
+	cache.mutex.RLock()
+	done := make(chan error)
+	go func() {
+		_, _, err := ReadItemFromConcurrentCache(context.Background(), cache, key)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("local hit waited for the exclusive lock")
+	}
+	cache.mutex.RUnlock()
+}
+
+func TestConcurrentCacheReplacementPolicy(t *testing.T) {
+	onChainCapacity := uint64(32)
+	nodeCapacity := 3 * onChainCapacity
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	inner, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+	assert.Nil(t, err)
+	cache := NewConcurrentLocalNodeCache(inner)
+	SetConcurrentCacheReplacementPolicy(cache, replacementPolicy.NewArcPolicy[cacheKeys.Uint64LocalCacheKey](nodeCapacity))
+
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < 500; i++ {
+				key := cacheKeys.NewUint64LocalCacheKey(i % 20)
+				if i%2 == 1 {
+					key = cacheKeys.NewUint64LocalCacheKey(1000 + worker*1000 + i)
+				}
+				value, _, err := ReadItemFromConcurrentCache(context.Background(), cache, key)
+				assert.Nil(t, err)
+				assert.Equal(t, value, expectedValue(t, backing, key))
+			}
+		}(uint64(worker))
+	}
+	wg.Wait()
+
+	cache.mutex.Lock()
+	applyPendingAccesses(cache)
+	cache.mutex.Unlock()
+	verifyCacheInvariants(t, inner)
+	assert.Equal(t, subsetPropertyHolds(t, inner), true)
+}
+
+func expectedValue(t *testing.T, backing cacheBackingStore.CacheBackingStore[cacheKeys.Uint64LocalCacheKey], key cacheKeys.Uint64LocalCacheKey) []byte {
+	t.Helper()
+	value, err := backing.Read(context.Background(), key)
+	assert.Nil(t, err)
+	return value
+}
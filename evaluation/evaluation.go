@@ -4,6 +4,7 @@
 package evaluation
 
 import (
+	"context"
 	"github.com/offchainlabs/cuckoocache"
 	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
 	"github.com/offchainlabs/cuckoocache/cacheKeys"
@@ -15,10 +16,21 @@ func EvaluateOnData[KeyType cacheKeys.LocalNodeCacheKey](
 	onChainSize uint64,
 	localSize uint64,
 	accesses []KeyType,
+) (uint64, uint64, uint64, uint64, error) { // (onChainHits, localHits, storageReads, storageWrites)
+	return EvaluateOnDataWithParameters(onChainSize, localSize, onChainIndex.GenerationParameters{}, accesses)
+}
+
+// Like EvaluateOnData, but with an on-chain cache that has the given generation parameters, such as more live
+// generations, so that their tradeoff of hit rate against storage writes can be compared.
+func EvaluateOnDataWithParameters[KeyType cacheKeys.LocalNodeCacheKey](
+	onChainSize uint64,
+	localSize uint64,
+	params onChainIndex.GenerationParameters,
+	accesses []KeyType,
 ) (uint64, uint64, uint64, uint64, error) { // (onChainHits, localHits, storageReads, storageWrites)
 	storage := onChainStorage.NewMockOnChainStorage()
 	onChain := onChainIndex.OpenOnChainCuckooTable(storage, onChainSize)
-	if err := onChain.Initialize(onChainSize); err != nil {
+	if err := onChain.InitializeWithParameters(onChainSize, params); err != nil {
 		return 0, 0, 0, 0, err
 	}
 	cache, err := cuckoocache.NewLocalNodeCache[KeyType](localSize, onChain, cacheBackingStore.NewMockBackingStore[KeyType]())
@@ -33,7 +45,7 @@ func EvaluateOnData[KeyType cacheKeys.LocalNodeCacheKey](
 		if cuckoocache.IsInLocalNodeCache(cache, key) {
 			localHits++
 		}
-		_, hit, err := cuckoocache.ReadItemFromLocalCache(cache, key)
+		_, hit, err := cuckoocache.ReadItemFromLocalCache(context.Background(), cache, key)
 		if err != nil {
 			return 0, 0, 0, 0, err
 		}
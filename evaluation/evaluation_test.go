@@ -5,7 +5,9 @@ package evaluation
 
 import (
 	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
 	"testing"
 )
 
@@ -46,3 +48,37 @@ func TestEvaluation(t *testing.T) {
 	assert.Equal(t, on, uint64(50))
 	assert.Equal(t, local, uint64(64))
 }
+
+func TestLiveGenerationsTradeoff(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	accesses := []cacheKeys.Uint64LocalCacheKey{}
+	for i := 0; i < 5000; i++ {
+		accesses = append(accesses, cacheKeys.NewUint64LocalCacheKey(uint64(rng.ExpFloat64()*100)))
+	}
+
+	// with more live generations, each a smaller slice of the cache, there are more hits but also more writes
+	previousHits, previousWrites := uint64(0), uint64(0)
+	for _, liveGenerations := range []uint8{2, 3, 4, 6, 8} {
+		params := onChainIndex.GenerationParameters{
+			CurrentGenThreshold: 1500 / uint16(liveGenerations),
+			LiveGenerations:     liveGenerations,
+		}
+		on, local, reads, writes, err := EvaluateOnDataWithParameters(128, 256, params, accesses)
+		assert.Nil(t, err)
+		t.Logf("%d live generations: %d on-chain hits, %d local hits, %d reads, %d writes", liveGenerations, on, local, reads, writes)
+		assert.Greater(t, on, previousHits)
+		assert.Greater(t, writes, previousWrites)
+		previousHits, previousWrites = on, writes
+	}
+
+	on, local, reads, writes, err := EvaluateOnData(128, 256, accesses)
+	assert.Nil(t, err)
+	defaultOn, defaultLocal, defaultReads, defaultWrites, err := EvaluateOnDataWithParameters(
+		128,
+		256,
+		onChainIndex.GenerationParameters{LiveGenerations: onChainIndex.DefaultLiveGenerations},
+		accesses,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{on, local, reads, writes}, []uint64{defaultOn, defaultLocal, defaultReads, defaultWrites})
+}
@@ -0,0 +1,139 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"context"
+	"errors"
+	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+)
+
+type InclusionReport struct {
+	NumOnChain uint64 // number of items in the on-chain cache
+	// items in the on-chain cache that are not in the local cache
+	Missing []onChainIndex.CacheItemKey
+	// items in the on-chain cache that are in the local cache, but might be evicted from it first, because the
+	// local cache has them in an older generation than the on-chain cache does
+	Unprotected []onChainIndex.CacheItemKey
+	// the missing and unprotected items that have been repaired
+	Repaired []onChainIndex.CacheItemKey
+}
+
+// Whether the subset property holds, i.e. whether every item in the on-chain cache is safely in the local cache,
+// once the repairs have been made.
+func (report InclusionReport) Holds() bool {
+	return len(report.Missing)+len(report.Unprotected) == len(report.Repaired)
+}
+
+// Check that every item in the on-chain cache is in the local cache, and will stay there for as long as it is in
+// the on-chain cache. This is meant for health checks; it reads every entry of the on-chain cache, but doesn't
+// modify it.
+//
+// If repair is true, missing items are read from the backing store and brought into the local cache, and
+// unprotected items are given their on-chain generation. A missing item can only be repaired if the cache has
+// a key resolver (see SetLocalNodeCacheKeyResolver) that can resolve it, and the backing store has it.
+func VerifyInclusion[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	cache *LocalNodeCache[CacheKey],
+	repair bool,
+) (InclusionReport, error) {
+	report := InclusionReport{}
+	header, err := cache.onChain.ReadHeader()
+	if err != nil {
+		return report, err
+	}
+	type liveItem struct {
+		itemKey    onChainIndex.CacheItemKey
+		generation uint64
+	}
+	live, err := onChainIndex.ForAllOnChainCachedItemsWithAge(
+		cache.onChain,
+		func(itemKey onChainIndex.CacheItemKey, age uint64, soFar []liveItem) ([]liveItem, error) {
+			return append(soFar, liveItem{itemKey, header.CurrentGeneration - age}), nil
+		},
+		[]liveItem{},
+	)
+	if err != nil {
+		return report, err
+	}
+	report.NumOnChain = uint64(len(live))
+
+	localNodes := make(map[onChainIndex.CacheItemKey]*LruNode[CacheKey], cache.numInCache)
+	for node := cache.mru; node != nil; node = node.lessRecent {
+		localNodes[node.itemKey.ToCacheKey()] = node
+	}
+	for _, item := range live {
+		node := localNodes[item.itemKey]
+		if node == nil {
+			report.Missing = append(report.Missing, item.itemKey)
+			if !repair || cache.keyResolver == nil {
+				continue
+			}
+			key, found, err := cache.keyResolver.Resolve(item.itemKey)
+			if err != nil {
+				return report, err
+			}
+			if !found {
+				continue
+			}
+			value, err := cache.backingStore.Read(ctx, key)
+			if errors.Is(err, cacheBackingStore.ErrNotFound) {
+				continue
+			} else if err != nil {
+				return report, err
+			}
+			insertByGeneration(cache, key, value, item.generation)
+			report.Repaired = append(report.Repaired, item.itemKey)
+		} else if node.generation < item.generation {
+			report.Unprotected = append(report.Unprotected, item.itemKey)
+			if repair {
+				removeNode(cache, node)
+				insertByGeneration(cache, node.itemKey, node.itemValue, item.generation)
+				report.Repaired = append(report.Repaired, item.itemKey)
+			}
+		}
+	}
+	evictIfNeeded(cache)
+	return report, nil
+}
+
+// Insert an item as the least recently used of the items whose generations are at least generation, so that
+// generations still never decrease along the LRU list.
+func insertByGeneration[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	key CacheKey,
+	value []byte,
+	generation uint64,
+) {
+	lessRecent := (*LruNode[CacheKey])(nil)
+	moreRecent := cache.lru
+	for moreRecent != nil && moreRecent.generation < generation {
+		lessRecent, moreRecent = moreRecent, moreRecent.moreRecent
+	}
+	node := &LruNode[CacheKey]{
+		itemKey:    key,
+		itemValue:  value,
+		moreRecent: moreRecent,
+		lessRecent: lessRecent,
+		generation: generation,
+	}
+	if lessRecent == nil {
+		cache.lru = node
+	} else {
+		lessRecent.moreRecent = node
+	}
+	if moreRecent == nil {
+		cache.mru = node
+	} else {
+		moreRecent.lessRecent = node
+	}
+	cache.index[key] = node
+	cache.numInCache += 1
+	cache.numBytes += uint64(len(value))
+	if cache.policy != nil {
+		cache.policy.Inserted(key)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"context"
+	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/keyResolver"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVerifyInclusion(t *testing.T) {
+	onChainCapacity := uint64(32)
+	nodeCapacity := 2*onChainCapacity + 17
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	resolver := keyResolver.NewInMemoryKeyResolver[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+	assert.Nil(t, err)
+	SetLocalNodeCacheKeyResolver(cache, resolver)
+	for seed := uint64(0); seed < 3*nodeCapacity; seed += nodeCapacity / 3 {
+		sprayNodeCache(t, cache, seed)
+	}
+
+	report, err := VerifyInclusion(context.Background(), cache, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), true)
+	assert.Equal(t, report.NumOnChain, readHeader(t, onChain).InCacheCount)
+	assert.Equal(t, len(report.Missing), 0)
+	assert.Equal(t, len(report.Unprotected), 0)
+
+	// break the subset property in both possible ways
+	header := readHeader(t, onChain)
+	missing, unprotected := []cacheKeys.Uint64LocalCacheKey{}, []cacheKeys.Uint64LocalCacheKey{}
+	for node := cache.mru; node != nil && len(missing)+len(unprotected) < 6; node = node.lessRecent {
+		in, err := onChain.IsInCache(&header, node.itemKey.ToCacheKey())
+		assert.Nil(t, err)
+		if !in {
+			continue
+		}
+		if len(missing) < 3 {
+			missing = append(missing, node.itemKey)
+		} else {
+			unprotected = append(unprotected, node.itemKey)
+		}
+	}
+	for _, key := range missing {
+		assert.Nil(t, FlushOneItemFromLocalNodeCache(cache, key, false))
+	}
+	for _, key := range unprotected {
+		cache.index[key].generation = 0
+	}
+	assert.Equal(t, subsetPropertyHolds(t, cache), false)
+
+	report, err = VerifyInclusion(context.Background(), cache, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), false)
+	assert.ElementsMatch(t, report.Missing, cacheKeysOf(missing))
+	assert.ElementsMatch(t, report.Unprotected, cacheKeysOf(unprotected))
+	assert.Equal(t, len(report.Repaired), 0)
+
+	// an item can't be repaired if the backing store doesn't have it
+	backing.Delete(missing[0])
+	report, err = VerifyInclusion(context.Background(), cache, true)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), false)
+	assert.ElementsMatch(t, report.Repaired, cacheKeysOf(append(missing[1:], unprotected...)))
+	verifyCacheInvariants(t, cache)
+	verifyGenerationsInLruOrder(t, cache)
+
+	backing.Write(missing[0], []byte("back again"))
+	report, err = VerifyInclusion(context.Background(), cache, true)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), true)
+	assert.ElementsMatch(t, report.Repaired, cacheKeysOf(missing[:1]))
+	assert.Equal(t, subsetPropertyHolds(t, cache), true)
+	verifyCacheInvariants(t, cache)
+	verifyGenerationsInLruOrder(t, cache)
+
+	// the repaired items stay in the cache for as long as they are in the on-chain cache
+	for i := uint64(0); i < 500; i++ {
+		_, _, err = ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(1000000+i))
+		assert.Nil(t, err)
+		assert.Equal(t, subsetPropertyHolds(t, cache), true)
+	}
+	report, err = VerifyInclusion(context.Background(), cache, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), true)
+}
+
+func TestVerifyInclusionWithoutResolver(t *testing.T) {
+	onChainCapacity := uint64(32)
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	sprayOnChainCache(t, onChain, 0)
+
+	// a cold-started cache is missing everything, and can't repair anything without a resolver
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](onChainCapacity, onChain, backing)
+	assert.Nil(t, err)
+	report, err := VerifyConcurrentCacheInclusion(context.Background(), NewConcurrentLocalNodeCache(cache), true)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), false)
+	assert.Equal(t, uint64(len(report.Missing)), report.NumOnChain)
+	assert.Equal(t, len(report.Repaired), 0)
+	assert.Equal(t, cache.numInCache, uint64(0))
+}
+
+func cacheKeysOf(keys []cacheKeys.Uint64LocalCacheKey) []onChainIndex.CacheItemKey {
+	itemKeys := make([]onChainIndex.CacheItemKey, len(keys))
+	for i, key := range keys {
+		itemKeys[i] = key.ToCacheKey()
+	}
+	return itemKeys
+}
+
+func verifyGenerationsInLruOrder(t *testing.T, cache *LocalNodeCache[cacheKeys.Uint64LocalCacheKey]) {
+	t.Helper()
+	for node := cache.mru; node != nil && node.lessRecent != nil; node = node.lessRecent {
+		assert.GreaterOrEqual(t, node.generation, node.lessRecent.generation)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package keyResolver
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+)
+
+// A KeyResolver maps on-chain item keys back to the local keys they were derived from.
+// ToCacheKey is usually a one-way digest, so resolvers generally learn preimages by having keys recorded
+// as they are used.
+type KeyResolver[KeyType cacheKeys.LocalNodeCacheKey] interface {
+	Record(key KeyType) error
+	Resolve(itemKey onChainIndex.CacheItemKey) (KeyType, bool, error) // (key, wasFound, error)
+}
+
+// A PrunableKeyResolver can forget the keys it has recorded that are no longer needed.
+type PrunableKeyResolver[KeyType cacheKeys.LocalNodeCacheKey] interface {
+	KeyResolver[KeyType]
+	Prune(keep func(key KeyType) bool) (uint64, error) // number of keys forgotten
+}
+
+type InMemoryKeyResolver[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	preimages map[onChainIndex.CacheItemKey]KeyType
+}
+
+func NewInMemoryKeyResolver[KeyType cacheKeys.LocalNodeCacheKey]() *InMemoryKeyResolver[KeyType] {
+	return &InMemoryKeyResolver[KeyType]{preimages: make(map[onChainIndex.CacheItemKey]KeyType)}
+}
+
+func (r *InMemoryKeyResolver[KeyType]) Record(key KeyType) error {
+	r.preimages[key.ToCacheKey()] = key
+	return nil
+}
+
+func (r *InMemoryKeyResolver[KeyType]) Resolve(itemKey onChainIndex.CacheItemKey) (KeyType, bool, error) {
+	key, found := r.preimages[itemKey]
+	return key, found, nil
+}
+
+func (r *InMemoryKeyResolver[KeyType]) Prune(keep func(key KeyType) bool) (uint64, error) {
+	pruned := uint64(0)
+	for itemKey, key := range r.preimages {
+		if !keep(key) {
+			delete(r.preimages, itemKey)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+type PreimageDatabase interface {
+	ethdb.KeyValueReader
+	ethdb.KeyValueWriter
+	ethdb.Iteratee
+}
+
+// PersistedKeyResolver keeps a preimage table in a key-value database, so that it survives node restarts.
+type PersistedKeyResolver[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	db    PreimageDatabase
+	codec cacheKeys.LocalNodeCacheKeyCodec[KeyType]
+}
+
+var preimagePrefix = []byte("cuckoocache-preimage-")
+
+func NewPersistedKeyResolver[KeyType cacheKeys.LocalNodeCacheKey](
+	db PreimageDatabase,
+	codec cacheKeys.LocalNodeCacheKeyCodec[KeyType],
+) *PersistedKeyResolver[KeyType] {
+	return &PersistedKeyResolver[KeyType]{db: db, codec: codec}
+}
+
+func preimageDbKey(itemKey onChainIndex.CacheItemKey) []byte {
+	return append(append([]byte{}, preimagePrefix...), itemKey[:]...)
+}
+
+func (r *PersistedKeyResolver[KeyType]) Record(key KeyType) error {
+	return r.db.Put(preimageDbKey(key.ToCacheKey()), r.codec.EncodeKey(key))
+}
+
+func (r *PersistedKeyResolver[KeyType]) Resolve(itemKey onChainIndex.CacheItemKey) (KeyType, bool, error) {
+	var key KeyType
+	dbKey := preimageDbKey(itemKey)
+	exists, err := r.db.Has(dbKey)
+	if err != nil || !exists {
+		return key, false, err
+	}
+	buf, err := r.db.Get(dbKey)
+	if err != nil {
+		return key, false, err
+	}
+	key, err = r.codec.DecodeKey(buf)
+	if err != nil {
+		return key, false, err
+	}
+	return key, true, nil
+}
+
+// Delete the preimages of the keys for which keep returns false. A preimage that can't be decoded is an error, as
+// it is for Resolve, and nothing is deleted.
+func (r *PersistedKeyResolver[KeyType]) Prune(keep func(key KeyType) bool) (uint64, error) {
+	toDelete := [][]byte{}
+	iterator := r.db.NewIterator(preimagePrefix, nil)
+	for iterator.Next() {
+		key, err := r.codec.DecodeKey(iterator.Value())
+		if err != nil {
+			iterator.Release()
+			return 0, err
+		}
+		if !keep(key) {
+			toDelete = append(toDelete, bytes.Clone(iterator.Key()))
+		}
+	}
+	err := iterator.Error()
+	iterator.Release()
+	if err != nil {
+		return 0, err
+	}
+	// delete once the iterator is released, since not every database lets an iterated range be modified
+	for i, dbKey := range toDelete {
+		if err := r.db.Delete(dbKey); err != nil {
+			return uint64(i), err
+		}
+	}
+	return uint64(len(toDelete)), nil
+}
+
+// CallbackKeyResolver resolves keys by calling a function, for key types whose item keys are invertible
+// (such as cacheKeys.AddressLocalCacheKeyFromCacheKey) or that are resolved by some external index.
+type CallbackKeyResolver[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	resolve func(itemKey onChainIndex.CacheItemKey) (KeyType, bool, error)
+	record  func(key KeyType) error
+}
+
+// record can be nil, in which case recorded keys are ignored.
+func NewCallbackKeyResolver[KeyType cacheKeys.LocalNodeCacheKey](
+	resolve func(itemKey onChainIndex.CacheItemKey) (KeyType, bool, error),
+	record func(key KeyType) error,
+) *CallbackKeyResolver[KeyType] {
+	return &CallbackKeyResolver[KeyType]{resolve: resolve, record: record}
+}
+
+func (r *CallbackKeyResolver[KeyType]) Record(key KeyType) error {
+	if r.record == nil {
+		return nil
+	}
+	return r.record(key)
+}
+
+func (r *CallbackKeyResolver[KeyType]) Resolve(itemKey onChainIndex.CacheItemKey) (KeyType, bool, error) {
+	return r.resolve(itemKey)
+}
@@ -0,0 +1,108 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package keyResolver
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestInMemoryKeyResolver(t *testing.T) {
+	resolver := NewInMemoryKeyResolver[cacheKeys.Uint64LocalCacheKey]()
+	verifyResolver(t, resolver)
+	verifyPrune(t, resolver)
+}
+
+func TestPersistedKeyResolver(t *testing.T) {
+	db := memorydb.New()
+	resolver := NewPersistedKeyResolver[cacheKeys.Uint64LocalCacheKey](db, cacheKeys.Uint64KeyCodec{})
+	verifyResolver(t, resolver)
+
+	// a new resolver on the same database should still know every recorded key
+	reopened := NewPersistedKeyResolver[cacheKeys.Uint64LocalCacheKey](db, cacheKeys.Uint64KeyCodec{})
+	for i := uint64(0); i < 100; i++ {
+		key := cacheKeys.NewUint64LocalCacheKey(i)
+		resolved, found, err := reopened.Resolve(key.ToCacheKey())
+		assert.Nil(t, err)
+		assert.Equal(t, found, true)
+		assert.Equal(t, resolved, key)
+	}
+
+	// a corrupt preimage is an error, not a silently wrong key
+	key := cacheKeys.NewUint64LocalCacheKey(7)
+	itemKey := key.ToCacheKey()
+	assert.Nil(t, db.Put(preimageDbKey(itemKey), []byte{1, 2, 3}))
+	_, _, err := reopened.Resolve(itemKey)
+	assert.ErrorIs(t, err, cacheKeys.ErrBadEncodedKey)
+	_, err = reopened.Prune(func(cacheKeys.Uint64LocalCacheKey) bool { return false })
+	assert.ErrorIs(t, err, cacheKeys.ErrBadEncodedKey)
+	assert.Nil(t, reopened.Record(key))
+	verifyPrune(t, reopened)
+
+	// pruned keys stay pruned across a restart
+	reopened = NewPersistedKeyResolver[cacheKeys.Uint64LocalCacheKey](db, cacheKeys.Uint64KeyCodec{})
+	_, found, err := reopened.Resolve(cacheKeys.NewUint64LocalCacheKey(1).ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, false)
+}
+
+func TestCallbackKeyResolver(t *testing.T) {
+	resolver := NewCallbackKeyResolver[cacheKeys.AddressLocalCacheKey](
+		func(itemKey onChainIndex.CacheItemKey) (cacheKeys.AddressLocalCacheKey, bool, error) {
+			key, ok := cacheKeys.AddressLocalCacheKeyFromCacheKey(itemKey)
+			return key, ok, nil
+		},
+		nil,
+	)
+	key := cacheKeys.NewAddressLocalCacheKey(common.HexToAddress("0x5E1497dD1f08C87b2d8FE23e9AAB6c1De833D927"))
+	assert.Nil(t, resolver.Record(key))
+	resolved, found, err := resolver.Resolve(key.ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, true)
+	assert.Equal(t, resolved, key)
+	_, found, err = resolver.Resolve(cacheKeys.NewUint64LocalCacheKey(3).ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, false)
+}
+
+func verifyResolver(t *testing.T, resolver KeyResolver[cacheKeys.Uint64LocalCacheKey]) {
+	t.Helper()
+	_, found, err := resolver.Resolve(cacheKeys.NewUint64LocalCacheKey(0).ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, false)
+	for i := uint64(0); i < 100; i++ {
+		assert.Nil(t, resolver.Record(cacheKeys.NewUint64LocalCacheKey(i)))
+	}
+	for i := uint64(0); i < 100; i++ {
+		key := cacheKeys.NewUint64LocalCacheKey(i)
+		resolved, found, err := resolver.Resolve(key.ToCacheKey())
+		assert.Nil(t, err)
+		assert.Equal(t, found, true)
+		assert.Equal(t, resolved, key)
+	}
+	_, found, err = resolver.Resolve(cacheKeys.NewUint64LocalCacheKey(100).ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, false)
+}
+
+// Prune the odd keys of those recorded by verifyResolver.
+func verifyPrune(t *testing.T, resolver PrunableKeyResolver[cacheKeys.Uint64LocalCacheKey]) {
+	t.Helper()
+	even := map[cacheKeys.Uint64LocalCacheKey]bool{}
+	for i := uint64(0); i < 100; i += 2 {
+		even[cacheKeys.NewUint64LocalCacheKey(i)] = true
+	}
+	pruned, err := resolver.Prune(func(key cacheKeys.Uint64LocalCacheKey) bool { return even[key] })
+	assert.Nil(t, err)
+	assert.Equal(t, pruned, uint64(50))
+	for i := uint64(0); i < 100; i++ {
+		_, found, err := resolver.Resolve(cacheKeys.NewUint64LocalCacheKey(i).ToCacheKey())
+		assert.Nil(t, err)
+		assert.Equal(t, found, i%2 == 0)
+	}
+}
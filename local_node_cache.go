@@ -4,21 +4,33 @@
 package cuckoocache
 
 import (
+	"context"
+	"errors"
 	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
 	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/cacheMetrics"
+	"github.com/offchainlabs/cuckoocache/keyResolver"
 	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/replacementPolicy"
 )
 
 type CacheItemValue []byte
 
 type LocalNodeCache[KeyType cacheKeys.LocalNodeCacheKey] struct {
-	onChain       *onChainIndex.OnChainCuckooTable
-	localCapacity uint64
-	numInCache    uint64
-	index         map[KeyType]*LruNode[KeyType]
-	lru           *LruNode[KeyType]
-	mru           *LruNode[KeyType]
-	backingStore  cacheBackingStore.CacheBackingStore[KeyType]
+	onChain           *onChainIndex.OnChainCuckooTable
+	localCapacity     uint64
+	numInCache        uint64
+	maxBytes          uint64 // zero means the cache isn't bounded by size
+	numBytes          uint64
+	index             map[KeyType]*LruNode[KeyType]
+	lru               *LruNode[KeyType]
+	mru               *LruNode[KeyType]
+	backingStore      cacheBackingStore.CacheBackingStore[KeyType]
+	keyResolver       keyResolver.KeyResolver[KeyType]
+	currentGeneration uint64 // the on-chain cache's generation, as of our latest access to it
+	liveGenerations   uint64 // how many of the on-chain cache's latest generations are live
+	metrics           cacheMetrics.Sink
+	policy            replacementPolicy.ReplacementPolicy[KeyType] // nil means evicting the LRU item
 }
 
 type LruNode[KeyType cacheKeys.LocalNodeCacheKey] struct {
@@ -29,14 +41,18 @@ type LruNode[KeyType cacheKeys.LocalNodeCacheKey] struct {
 	generation uint64
 }
 
-// Create a new local node cache. If syncFromOnChain is true, the cache is warmed up by loading all items
-// in the on-chain cache.
-//
-// Otherwise, this cold-starts the local cache. If the on-chain cache is not empty, then this
+// Create a new local node cache. This cold-starts the local cache. If the on-chain cache is not empty, then this
 // local cache might eventually have up to <localCapacity> cache misses on items that are currently in the
-// on-chain cache. Within two generation-shifts of the on-chain cache, this local cache will have established the
-// subset property, i.e. that every object in the on-chain cache is in this cache.
+// on-chain cache. Within two generation-shifts of the on-chain cache, or as many as it has live generations, this
+// local cache will have established the subset property, i.e. that every object in the on-chain cache is in this
+// cache.
 // Once established, that property will persist forever.
+//
+// The cache never evicts an item that might still be in the on-chain cache, so localCapacity can be smaller than
+// the on-chain cache's capacity; the cache will then grow beyond localCapacity when it needs to, but never beyond
+// the number of items in the on-chain cache plus one.
+//
+// Use NewLocalNodeCacheFromOnChain instead to warm up the cache so that the subset property holds immediately.
 func NewLocalNodeCache[KeyType cacheKeys.LocalNodeCacheKey](
 	localCapacity uint64,
 	onChain *onChainIndex.OnChainCuckooTable,
@@ -46,63 +62,199 @@ func NewLocalNodeCache[KeyType cacheKeys.LocalNodeCacheKey](
 	if err != nil {
 		return nil, err
 	}
-	if localCapacity < header.Capacity {
-		// local node cache must be at least as big as the on-chain table's capacity
-		// otherwise there might be repeated hits in the on-chain table that miss in this node cache
-		localCapacity = header.Capacity
-	}
 	cache := &LocalNodeCache[KeyType]{
-		onChain:       onChain,
-		localCapacity: localCapacity,
-		numInCache:    0,
-		index:         make(map[KeyType]*LruNode[KeyType]),
-		lru:           nil,
-		mru:           nil,
-		backingStore:  backingStore,
+		onChain:           onChain,
+		localCapacity:     localCapacity,
+		numInCache:        0,
+		index:             make(map[KeyType]*LruNode[KeyType]),
+		lru:               nil,
+		mru:               nil,
+		backingStore:      backingStore,
+		currentGeneration: header.CurrentGeneration,
+		liveGenerations:   header.NumLiveGenerations(),
+		metrics:           cacheMetrics.NoopSink{},
+	}
+	return cache, nil
+}
+
+// Create a new local node cache, warmed up by loading every item that is currently in the on-chain cache,
+// so that the subset property holds immediately rather than after two generation-shifts.
+//
+// Items are loaded with items from older generations as less recently used than items from later generations.
+// The resolver maps on-chain item keys back to local keys; any on-chain item
+// that it cannot resolve, or that the backing store reports as not found, is skipped, and the subset property will
+// not hold for that item until it ages out. The resolver is also attached to the new cache, as if by SetLocalNodeCacheKeyResolver.
+func NewLocalNodeCacheFromOnChain[KeyType cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	localCapacity uint64,
+	onChain *onChainIndex.OnChainCuckooTable,
+	backingStore cacheBackingStore.CacheBackingStore[KeyType],
+	resolver keyResolver.KeyResolver[KeyType],
+) (*LocalNodeCache[KeyType], error) {
+	cache, err := NewLocalNodeCache[KeyType](localCapacity, onChain, backingStore)
+	if err != nil {
+		return nil, err
+	}
+	header, err := onChain.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	// the live items' keys, by age
+	items, err := onChainIndex.ForAllOnChainCachedItemsWithAge(
+		onChain,
+		func(itemKey onChainIndex.CacheItemKey, age uint64, soFar [][]KeyType) ([][]KeyType, error) {
+			key, found, err := resolver.Resolve(itemKey)
+			if err != nil || !found {
+				return soFar, err
+			}
+			soFar[age] = append(soFar[age], key)
+			return soFar, nil
+		},
+		make([][]KeyType, header.NumLiveGenerations()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	loadItems := func(keys []KeyType, generation uint64) error {
+		for _, key := range keys {
+			if cache.index[key] != nil {
+				continue
+			}
+			value, err := backingStore.Read(ctx, key)
+			if errors.Is(err, cacheBackingStore.ErrNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			insertAsMru(cache, key, value, generation)
+		}
+		return nil
+	}
+	for age := len(items) - 1; age >= 0; age-- {
+		if err := loadItems(items[age], header.CurrentGeneration-uint64(age)); err != nil {
+			return nil, err
+		}
 	}
+	cache.keyResolver = resolver
 	return cache, nil
 }
 
+// Attach a resolver to the cache. Every item brought into the cache is recorded with the resolver first,
+// so that the resolver can later map that item's on-chain key back to its local key.
+func SetLocalNodeCacheKeyResolver[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	resolver keyResolver.KeyResolver[CacheKey],
+) {
+	cache.keyResolver = resolver
+}
+
+// Make the cache's key resolver, if it is a keyResolver.PrunableKeyResolver, forget the keys of the items that
+// aren't in the local cache. Those items can't be in the on-chain cache, so VerifyInclusion doesn't need to resolve
+// them, unless a reorg takes the on-chain cache back to before they were evicted; ReconcileLocalNodeCache can't bring
+// such items back once they are pruned, so prune no more often than reorgs that deep can happen.
+func PruneLocalNodeCacheKeyResolver[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey]) (uint64, error) {
+	resolver, ok := cache.keyResolver.(keyResolver.PrunableKeyResolver[CacheKey])
+	if !ok {
+		return 0, nil
+	}
+	return resolver.Prune(func(key CacheKey) bool { return IsInLocalNodeCache(cache, key) })
+}
+
+// Report the local cache's metrics to sink. The on-chain cache's metrics are reported separately, see
+// OnChainCuckooTable.SetMetricsSink.
+func SetLocalNodeCacheMetricsSink[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	sink cacheMetrics.Sink,
+) {
+	cache.metrics = sink
+}
+
+// Choose the items to evict with policy, rather than evicting the least recently used item. Items that might still
+// be in the on-chain cache are never evicted, whatever the policy, so a policy other than LRU only makes a
+// difference to the items that a cache with a localCapacity larger than the on-chain cache's capacity keeps beyond
+// those. The policy is told about the items already in the cache, from the least recently used.
+func SetLocalNodeCacheReplacementPolicy[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	policy replacementPolicy.ReplacementPolicy[CacheKey],
+) {
+	cache.policy = policy
+	if policy != nil {
+		policy.Clear()
+		for node := cache.lru; node != nil; node = node.moreRecent {
+			policy.Inserted(node.itemKey)
+		}
+	}
+	evictIfNeeded(cache)
+}
+
 func IsInLocalNodeCache[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey], key CacheKey) bool {
 	return cache.index[key] != nil
 }
 
+// Find out whether reading an item would be a hit in the on-chain cache, without modifying either cache.
+func IsHitOnChain[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	key CacheKey,
+) (onChainIndex.QueryResult, error) {
+	return cache.onChain.Query(key.ToCacheKey())
+}
+
+// Read an item, bringing it into the local cache and accessing it in the on-chain cache.
+// If the item can't be read from the backing store, the error is returned and neither cache is modified.
 func ReadItemFromLocalCache[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
 	cache *LocalNodeCache[CacheKey],
 	key CacheKey,
 ) ([]byte, bool, error) { // (data, wasHitInCache)
+	var value []byte
+	if !IsInLocalNodeCache(cache, key) {
+		var err error
+		value, err = cache.backingStore.Read(ctx, key)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return readItem(cache, key, value)
+}
+
+// value must be the item's value from the backing store, unless the item is already in the local cache
+func readItem[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	key CacheKey,
+	value []byte,
+) ([]byte, bool, error) {
+	if cache.index[key] == nil && cache.keyResolver != nil {
+		// record before accessing on-chain, so a failure can't leave an unresolvable item in the on-chain cache
+		if err := cache.keyResolver.Record(key); err != nil {
+			return nil, false, err
+		}
+	}
 	hitOnChain, generationAfterAccess, err := cache.onChain.AccessItem(key.ToCacheKey())
 	if err != nil {
 		return nil, false, err
 	}
+	return cacheAccessedItem(cache, key, value, generationAfterAccess), hitOnChain, nil
+}
 
+// Bring an item that has just been accessed on-chain into the local cache as the MRU, and return its value.
+// value must be the item's value, unless the item is already in the local cache.
+func cacheAccessedItem[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	key CacheKey,
+	value []byte,
+	generationAfterAccess uint64,
+) []byte {
+	cache.currentGeneration = generationAfterAccess
 	node := cache.index[key]
 	if node == nil {
+		cache.metrics.IncCounter(cacheMetrics.LocalMisses, 1)
 		// item is not in cache, so bring it in as the MRU
-		if cache.numInCache == cache.localCapacity {
-			// cache is already full, so evict the least recently used item
-			delete(cache.index, cache.lru.itemKey)
-			cache.lru = cache.lru.moreRecent
-			cache.lru.lessRecent = nil
-			cache.numInCache -= 1
-		}
-		node = &LruNode[CacheKey]{
-			itemKey:    key,
-			itemValue:  cache.backingStore.Read(key),
-			moreRecent: nil,
-			lessRecent: cache.mru,
-			generation: generationAfterAccess,
-		}
-		if node.lessRecent != nil {
-			node.lessRecent.moreRecent = node
-		}
-		cache.mru = node
-		if cache.lru == nil {
-			cache.lru = node
-		}
-		cache.index[key] = node
-		cache.numInCache += 1
+		node = insertAsMru(cache, key, value, generationAfterAccess)
 	} else {
+		cache.metrics.IncCounter(cacheMetrics.LocalHits, 1)
+		if cache.policy != nil {
+			cache.policy.Accessed(key)
+		}
 		// item is already in the cache, so make it the MRU
 		node.generation = generationAfterAccess
 		if cache.mru != node {
@@ -123,7 +275,158 @@ func ReadItemFromLocalCache[CacheKey cacheKeys.LocalNodeCacheKey](
 			cache.mru = node
 		}
 	}
-	return node.itemValue, hitOnChain, nil
+	return node.itemValue
+}
+
+// Read several items, such as all the items touched by a transaction, in order. The results are the same as
+// reading them one at a time with ReadItemFromLocalCache, but the on-chain cache is accessed by a single call
+// to AccessItems.
+// If any item can't be read from the backing store, the error is returned and neither cache is modified.
+func ReadItemsFromLocalCache[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	cache *LocalNodeCache[CacheKey],
+	keys []CacheKey,
+) ([][]byte, []bool, error) { // (data, wasHitInCache)
+	// get every item's value up front, since an item in the local cache now might be evicted by the time
+	// it is reached
+	values := make(map[CacheKey][]byte, len(keys))
+	misses := []CacheKey{}
+	for _, key := range keys {
+		if _, seen := values[key]; seen {
+			continue
+		}
+		if node := cache.index[key]; node != nil {
+			values[key] = node.itemValue
+			continue
+		}
+		value, err := cache.backingStore.Read(ctx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[key] = value
+		misses = append(misses, key)
+	}
+	if cache.keyResolver != nil {
+		for _, key := range misses {
+			if err := cache.keyResolver.Record(key); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	itemKeys := make([]onChainIndex.CacheItemKey, len(keys))
+	for i, key := range keys {
+		itemKeys[i] = key.ToCacheKey()
+	}
+	results, err := cache.onChain.AccessItems(itemKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := make([][]byte, len(keys))
+	hits := make([]bool, len(keys))
+	for i, key := range keys {
+		data[i] = cacheAccessedItem(cache, key, values[key], results[i].Generation)
+		hits[i] = results[i].Hit
+	}
+	return data, hits, nil
+}
+
+func insertAsMru[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	key CacheKey,
+	value []byte,
+	generation uint64,
+) *LruNode[CacheKey] {
+	node := &LruNode[CacheKey]{
+		itemKey:    key,
+		itemValue:  value,
+		moreRecent: nil,
+		lessRecent: cache.mru,
+		generation: generation,
+	}
+	if node.lessRecent != nil {
+		node.lessRecent.moreRecent = node
+	}
+	cache.mru = node
+	if cache.lru == nil {
+		cache.lru = node
+	}
+	cache.index[key] = node
+	cache.numInCache += 1
+	cache.numBytes += uint64(len(value))
+	if cache.policy != nil {
+		cache.policy.Inserted(key)
+	}
+	evictIfNeeded(cache)
+	return node
+}
+
+func removeNode[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey], node *LruNode[CacheKey]) {
+	unlinkNode(cache, node)
+	if cache.policy != nil {
+		cache.policy.Removed(node.itemKey)
+	}
+}
+
+// Take a node out of the cache without telling the policy, as for an item that the policy chose to evict.
+func unlinkNode[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey], node *LruNode[CacheKey]) {
+	if cache.lru == node {
+		cache.lru = node.moreRecent
+	}
+	if cache.mru == node {
+		cache.mru = node.lessRecent
+	}
+	if node.moreRecent != nil {
+		node.moreRecent.lessRecent = node.lessRecent
+	}
+	if node.lessRecent != nil {
+		node.lessRecent.moreRecent = node.moreRecent
+	}
+	delete(cache.index, node.itemKey)
+	cache.numInCache -= 1
+	cache.numBytes -= uint64(len(node.itemValue))
+}
+
+// Bound the total size of the item values in the cache to maxBytes, evicting items if necessary.
+// A maxBytes of zero removes the bound.
+//
+// Like the item capacity, the bound is a soft one. Items that might still be in the on-chain cache are never
+// evicted to satisfy it, because that would break the subset property, so the cache can grow beyond maxBytes
+// if the on-chain cache's items are large.
+func LimitLocalNodeCacheBytes[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey], maxBytes uint64) {
+	cache.maxBytes = maxBytes
+	evictIfNeeded(cache)
+}
+
+func isOverLimit[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey]) bool {
+	return cache.numInCache > cache.localCapacity || (cache.maxBytes != 0 && cache.numBytes > cache.maxBytes)
+}
+
+// An item might still be in the on-chain cache if it was accessed in one of its live generations, which are the
+// latest generation and, by default, the one before it. The node's generation is never older than the on-chain
+// item's generation, so this errs on the side of caution.
+func mightBeInOnChainCache[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey], node *LruNode[CacheKey]) bool {
+	return node.generation+cache.liveGenerations > cache.currentGeneration
+}
+
+func evictIfNeeded[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey]) {
+	// generations never decrease along the LRU list, so once the LRU item might be in the on-chain cache,
+	// every other item might be as well
+	for isOverLimit(cache) && cache.lru != nil && !mightBeInOnChainCache(cache, cache.lru) {
+		victim := cache.lru
+		if cache.policy != nil {
+			key, found := cache.policy.Victim(func(key CacheKey) bool {
+				return !mightBeInOnChainCache(cache, cache.index[key])
+			})
+			if !found {
+				return
+			}
+			victim = cache.index[key]
+		}
+		unlinkNode(cache, victim)
+		cache.metrics.IncCounter(cacheMetrics.LocalEvictions, 1)
+	}
 }
 
 func FlushLocalNodeCache[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey], flushOnChain bool) error {
@@ -131,36 +434,30 @@ func FlushLocalNodeCache[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeC
 	cache.lru = nil
 	cache.mru = nil
 	cache.numInCache = 0
+	cache.numBytes = 0
+	if cache.policy != nil {
+		cache.policy.Clear()
+	}
 	if flushOnChain {
 		if err := cache.onChain.FlushAll(); err != nil {
 			return err
 		}
 	}
+	cache.metrics.IncCounter(cacheMetrics.LocalFlushes, 1)
 	return nil
 }
 
 func FlushOneItemFromLocalNodeCache[CacheKey cacheKeys.LocalNodeCacheKey](cache *LocalNodeCache[CacheKey], key CacheKey, flushOnChain bool) error {
 	node := cache.index[key]
 	if node != nil {
-		if cache.lru == node {
-			cache.lru = node.moreRecent
-		}
-		if cache.mru == node {
-			cache.mru = node.lessRecent
-		}
-		if node.moreRecent != nil {
-			node.moreRecent.lessRecent = node.lessRecent
-		}
-		if node.lessRecent != nil {
-			node.lessRecent.moreRecent = node.moreRecent
-		}
-		delete(cache.index, key)
+		removeNode(cache, node)
 	}
 	if flushOnChain {
 		if err := cache.onChain.FlushOneItem(key.ToCacheKey()); err != nil {
 			return err
 		}
 	}
+	cache.metrics.IncCounter(cacheMetrics.LocalItemFlushes, 1)
 	return nil
 }
 
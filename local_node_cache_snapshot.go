@@ -0,0 +1,281 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"io"
+	"os"
+)
+
+var (
+	ErrCorruptSnapshot  = errors.New("local node cache snapshot is corrupt")
+	ErrSnapshotMismatch = errors.New("local node cache snapshot doesn't match the on-chain cache")
+)
+
+// A snapshot is a header, then the items in MRU to LRU order, then a keccak256 checksum of everything before it.
+// The header is the magic, the format version, the flags, the on-chain generation and capacity when the snapshot
+// was taken, and the number of items. Each item is its encoded key and its generation, then its value if the
+// snapshot has values.
+var snapshotMagic = []byte("CKLS")
+
+const snapshotVersion = 1
+const snapshotHasValues = 1
+const snapshotHeaderSize = 4 + 1 + 1 + 8 + 8 + 8
+const snapshotChecksumSize = 32
+
+// Write a snapshot of the local cache to w, from which NewLocalNodeCacheFromSnapshot can recreate it after a restart.
+// If withValues is false, only the keys are written, and the values are read from the backing store on restore.
+func WriteLocalNodeCacheSnapshot[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	w io.Writer,
+	codec cacheKeys.LocalNodeCacheKeyCodec[CacheKey],
+	withValues bool,
+) error {
+	onChainHeader, err := cache.onChain.ReadHeader()
+	if err != nil {
+		return err
+	}
+	hasher := crypto.NewKeccakState()
+	buffered := bufio.NewWriter(io.MultiWriter(w, hasher))
+	flags := byte(0)
+	if withValues {
+		flags |= snapshotHasValues
+	}
+	header := append(append([]byte{}, snapshotMagic...), snapshotVersion, flags)
+	header = binary.LittleEndian.AppendUint64(header, cache.currentGeneration)
+	header = binary.LittleEndian.AppendUint64(header, onChainHeader.Capacity)
+	header = binary.LittleEndian.AppendUint64(header, cache.numInCache)
+	if _, err := buffered.Write(header); err != nil {
+		return err
+	}
+	for node := cache.mru; node != nil; node = node.lessRecent {
+		encodedKey := codec.EncodeKey(node.itemKey)
+		buf := binary.AppendUvarint([]byte{}, uint64(len(encodedKey)))
+		buf = append(buf, encodedKey...)
+		buf = binary.LittleEndian.AppendUint64(buf, node.generation)
+		if withValues {
+			buf = binary.AppendUvarint(buf, uint64(len(node.itemValue)))
+			buf = append(buf, node.itemValue...)
+		}
+		if _, err := buffered.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	_, err = w.Write(hasher.Sum(nil))
+	return err
+}
+
+// Write a snapshot of the local cache to the file at path, replacing it only once the snapshot is complete.
+func SaveLocalNodeCacheSnapshot[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	path string,
+	codec cacheKeys.LocalNodeCacheKeyCodec[CacheKey],
+	withValues bool,
+) error {
+	return writeSnapshotFile(path, func(w io.Writer) error {
+		return WriteLocalNodeCacheSnapshot(cache, w, codec, withValues)
+	})
+}
+
+func writeSnapshotFile(path string, write func(w io.Writer) error) error {
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Create a new local node cache from a snapshot written by WriteLocalNodeCacheSnapshot, keeping the items' LRU
+// order and generations. Values that are not in the snapshot are read from the backing store, and items that
+// the backing store reports as not found are skipped.
+//
+// A snapshot is rejected with ErrSnapshotMismatch if it can't have been taken of the on-chain cache: if it is from
+// a later generation than the on-chain cache's current generation, if it was taken when the on-chain cache had
+// another capacity, or if the on-chain cache has items from before the snapshot's generation that the snapshot
+// doesn't have. The last can also mean that the subset property didn't hold when the snapshot was taken, in
+// which case the snapshot is no better than a cold start. Otherwise, the subset property holds for the restored
+// cache if the on-chain cache hasn't been accessed since the snapshot was taken; if the on-chain cache has moved
+// on, it is established within two generation-shifts, as for a cold-started cache.
+func NewLocalNodeCacheFromSnapshot[KeyType cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	r io.Reader,
+	localCapacity uint64,
+	onChain *onChainIndex.OnChainCuckooTable,
+	backingStore cacheBackingStore.CacheBackingStore[KeyType],
+	codec cacheKeys.LocalNodeCacheKeyCodec[KeyType],
+) (*LocalNodeCache[KeyType], error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < snapshotHeaderSize+snapshotChecksumSize {
+		return nil, fmt.Errorf("%w: too short", ErrCorruptSnapshot)
+	}
+	body := buf[:len(buf)-snapshotChecksumSize]
+	if !bytes.Equal(crypto.Keccak256(body), buf[len(body):]) {
+		return nil, fmt.Errorf("%w: bad checksum", ErrCorruptSnapshot)
+	}
+	if !bytes.Equal(body[0:4], snapshotMagic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorruptSnapshot)
+	}
+	if body[4] != snapshotVersion {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrCorruptSnapshot, body[4])
+	}
+	withValues := body[5]&snapshotHasValues != 0
+	snapshotGeneration := binary.LittleEndian.Uint64(body[6:14])
+	snapshotCapacity := binary.LittleEndian.Uint64(body[14:22])
+	numItems := binary.LittleEndian.Uint64(body[22:30])
+
+	cache, err := NewLocalNodeCache[KeyType](localCapacity, onChain, backingStore)
+	if err != nil {
+		return nil, err
+	}
+	onChainHeader, err := onChain.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	if snapshotGeneration > onChainHeader.CurrentGeneration {
+		return nil, fmt.Errorf(
+			"%w: snapshot generation %d, on-chain generation %d",
+			ErrSnapshotMismatch, snapshotGeneration, onChainHeader.CurrentGeneration,
+		)
+	}
+	if snapshotCapacity != onChainHeader.Capacity {
+		return nil, fmt.Errorf(
+			"%w: snapshot capacity %d, on-chain capacity %d",
+			ErrSnapshotMismatch, snapshotCapacity, onChainHeader.Capacity,
+		)
+	}
+
+	type snapshotItem struct {
+		key        KeyType
+		value      []byte
+		generation uint64
+	}
+	reader := bytes.NewReader(body[snapshotHeaderSize:])
+	readBytes := func() ([]byte, error) {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil || length > uint64(reader.Len()) {
+			return nil, ErrCorruptSnapshot
+		}
+		out := make([]byte, length)
+		_, _ = reader.Read(out)
+		return out, nil
+	}
+	items := make([]snapshotItem, 0, min(numItems, uint64(len(body))))
+	seen := make(map[KeyType]bool)
+	for i := uint64(0); i < numItems; i++ {
+		encodedKey, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		key, err := codec.DecodeKey(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%w: duplicate key", ErrCorruptSnapshot)
+		}
+		seen[key] = true
+		item := snapshotItem{key: key}
+		if err := binary.Read(reader, binary.LittleEndian, &item.generation); err != nil {
+			return nil, ErrCorruptSnapshot
+		}
+		// generations never decrease along the LRU list, and never exceed the generation of the snapshot
+		if item.generation > snapshotGeneration || (i > 0 && item.generation > items[i-1].generation) {
+			return nil, fmt.Errorf("%w: generations out of order", ErrCorruptSnapshot)
+		}
+		if withValues {
+			if item.value, err = readBytes(); err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, item)
+	}
+	if reader.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrCorruptSnapshot)
+	}
+
+	// items accessed before the snapshot's generation can't have been brought into the on-chain cache since
+	snapshotItemKeys := make(map[onChainIndex.CacheItemKey]bool, len(items))
+	for _, item := range items {
+		snapshotItemKeys[item.key.ToCacheKey()] = true
+	}
+	numUnknown, err := onChainIndex.ForAllOnChainCachedItemsWithAge(
+		onChain,
+		func(itemKey onChainIndex.CacheItemKey, age uint64, soFar uint64) (uint64, error) {
+			if onChainHeader.CurrentGeneration-age < snapshotGeneration && !snapshotItemKeys[itemKey] {
+				soFar++
+			}
+			return soFar, nil
+		},
+		uint64(0),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if numUnknown > 0 {
+		return nil, fmt.Errorf(
+			"%w: %d on-chain items from before the snapshot aren't in it",
+			ErrSnapshotMismatch, numUnknown,
+		)
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		if !withValues {
+			item.value, err = backingStore.Read(ctx, item.key)
+			if errors.Is(err, cacheBackingStore.ErrNotFound) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		insertAsMru(cache, item.key, item.value, item.generation)
+	}
+	return cache, nil
+}
+
+// Create a new local node cache from a snapshot file written by SaveLocalNodeCacheSnapshot.
+// See NewLocalNodeCacheFromSnapshot.
+func LoadLocalNodeCacheSnapshot[KeyType cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	path string,
+	localCapacity uint64,
+	onChain *onChainIndex.OnChainCuckooTable,
+	backingStore cacheBackingStore.CacheBackingStore[KeyType],
+	codec cacheKeys.LocalNodeCacheKeyCodec[KeyType],
+) (*LocalNodeCache[KeyType], error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return NewLocalNodeCacheFromSnapshot(ctx, bufio.NewReader(file), localCapacity, onChain, backingStore, codec)
+}
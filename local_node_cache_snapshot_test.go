@@ -0,0 +1,150 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"bytes"
+	"context"
+	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalCacheSnapshot(t *testing.T) {
+	onChainCapacity := uint64(32)
+	nodeCapacity := 2*onChainCapacity + 17
+	onChainSto := onChainStorage.NewMockOnChainStorage().(*onChainStorage.MockOnChainStorage)
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainSto, onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	for i := uint64(0); i < 1000; i++ {
+		backing.Write(cacheKeys.NewUint64LocalCacheKey(i), make([]byte, (i*i)%13))
+	}
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+	assert.Nil(t, err)
+	for seed := uint64(0); seed < 3*nodeCapacity; seed += nodeCapacity / 3 {
+		sprayNodeCache(t, cache, seed)
+	}
+	assert.Equal(t, subsetPropertyHolds(t, cache), true)
+
+	path := filepath.Join(t.TempDir(), "local-cache")
+	for _, withValues := range []bool{true, false} {
+		assert.Nil(t, SaveLocalNodeCacheSnapshot(cache, path, cacheKeys.Uint64KeyCodec{}, withValues))
+		restored, err := LoadLocalNodeCacheSnapshot[cacheKeys.Uint64LocalCacheKey](
+			context.Background(), path, nodeCapacity, onChain, backing, cacheKeys.Uint64KeyCodec{},
+		)
+		assert.Nil(t, err)
+		verifySameLruList(t, restored, cache)
+		verifyCacheInvariants(t, restored)
+		assert.Equal(t, subsetPropertyHolds(t, restored), true)
+	}
+
+	// the restored cache behaves like the original, given its own copy of the on-chain cache
+	onChainCopySto := onChainStorage.NewMockOnChainStorageFromSnapshot(onChainSto.Snapshot())
+	onChainCopy := onChainIndex.OpenOnChainCuckooTable(onChainCopySto, onChainCapacity)
+	restored, err := LoadLocalNodeCacheSnapshot[cacheKeys.Uint64LocalCacheKey](
+		context.Background(), path, nodeCapacity, onChainCopy, backing, cacheKeys.Uint64KeyCodec{},
+	)
+	assert.Nil(t, err)
+	for i := uint64(0); i < 200; i++ {
+		key := cacheKeys.NewUint64LocalCacheKey((i * 7) % 300)
+		value, hit, err := ReadItemFromLocalCache(context.Background(), restored, key)
+		assert.Nil(t, err)
+		expectedValue, expectedHit, err := ReadItemFromLocalCache(context.Background(), cache, key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, expectedValue)
+		assert.Equal(t, hit, expectedHit)
+		verifySameLruList(t, restored, cache)
+	}
+	assert.Equal(t, subsetPropertyHolds(t, restored), true)
+
+	// a smaller cache keeps the most recently used items
+	var snapshot bytes.Buffer
+	assert.Nil(t, WriteLocalNodeCacheSnapshot(cache, &snapshot, cacheKeys.Uint64KeyCodec{}, false))
+	restored, err = NewLocalNodeCacheFromSnapshot[cacheKeys.Uint64LocalCacheKey](
+		context.Background(), bytes.NewReader(snapshot.Bytes()), 1, onChain, backing, cacheKeys.Uint64KeyCodec{},
+	)
+	assert.Nil(t, err)
+	assert.Less(t, restored.numInCache, cache.numInCache)
+	assert.Equal(t, restored.mru.itemKey, cache.mru.itemKey)
+	assert.Equal(t, subsetPropertyHolds(t, restored), true)
+	verifyCacheInvariants(t, restored)
+
+	// items that have gone from the backing store are skipped
+	backing.Delete(cache.mru.itemKey)
+	restored, err = NewLocalNodeCacheFromSnapshot[cacheKeys.Uint64LocalCacheKey](
+		context.Background(), bytes.NewReader(snapshot.Bytes()), nodeCapacity, onChain, backing, cacheKeys.Uint64KeyCodec{},
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, restored.numInCache, cache.numInCache-1)
+	assert.Equal(t, IsInLocalNodeCache(restored, cache.mru.itemKey), false)
+	verifyCacheInvariants(t, restored)
+}
+
+func TestBadLocalCacheSnapshot(t *testing.T) {
+	onChainCapacity := uint64(32)
+	onChainSto := onChainStorage.NewMockOnChainStorage().(*onChainStorage.MockOnChainStorage)
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainSto, onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](onChainCapacity, onChain, backing)
+	assert.Nil(t, err)
+	for seed := uint64(0); seed < 200; seed += 20 {
+		sprayNodeCache(t, cache, seed)
+	}
+	var snapshot bytes.Buffer
+	assert.Nil(t, WriteLocalNodeCacheSnapshot(cache, &snapshot, cacheKeys.Uint64KeyCodec{}, true))
+	restore := func(buf []byte, onChain *onChainIndex.OnChainCuckooTable) error {
+		_, err := NewLocalNodeCacheFromSnapshot[cacheKeys.Uint64LocalCacheKey](
+			context.Background(), bytes.NewReader(buf), onChainCapacity, onChain, backing, cacheKeys.Uint64KeyCodec{},
+		)
+		return err
+	}
+	assert.Nil(t, restore(snapshot.Bytes(), onChain))
+
+	for _, i := range []int{0, 4, 10, snapshotHeaderSize + 3, snapshot.Len() - 40, snapshot.Len() - 1} {
+		corrupted := bytes.Clone(snapshot.Bytes())
+		corrupted[i] ^= 1
+		assert.ErrorIs(t, restore(corrupted, onChain), ErrCorruptSnapshot)
+	}
+	assert.ErrorIs(t, restore(snapshot.Bytes()[:snapshot.Len()-1], onChain), ErrCorruptSnapshot)
+	assert.ErrorIs(t, restore([]byte{}, onChain), ErrCorruptSnapshot)
+
+	// a snapshot from later in the on-chain cache's history can't be restored
+	fresh := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, fresh.Initialize(onChainCapacity))
+	assert.ErrorIs(t, restore(snapshot.Bytes(), fresh), ErrSnapshotMismatch)
+
+	// nor can one taken of another table that has caught up with it
+	for item, generation := uint64(100000), uint64(0); generation < cache.currentGeneration; item++ {
+		_, generation, err = fresh.AccessItem(keyFromUint64(item))
+		assert.Nil(t, err)
+	}
+	assert.ErrorIs(t, restore(snapshot.Bytes(), fresh), ErrSnapshotMismatch)
+
+	// nor one taken before the table was resized
+	resizedSto := onChainStorage.NewMockOnChainStorageFromSnapshot(onChainSto.Snapshot())
+	resized := onChainIndex.OpenOnChainCuckooTable(resizedSto, onChainCapacity)
+	assert.Nil(t, resized.Resize(2*onChainCapacity))
+	assert.ErrorIs(t, restore(snapshot.Bytes(), resized), ErrSnapshotMismatch)
+}
+
+func verifySameLruList(t *testing.T, cache, expected *LocalNodeCache[cacheKeys.Uint64LocalCacheKey]) {
+	t.Helper()
+	assert.Equal(t, cache.numInCache, expected.numInCache)
+	assert.Equal(t, cache.numBytes, expected.numBytes)
+	assert.Equal(t, cache.currentGeneration, expected.currentGeneration)
+	node, expectedNode := cache.mru, expected.mru
+	for ; node != nil && expectedNode != nil; node, expectedNode = node.lessRecent, expectedNode.lessRecent {
+		assert.Equal(t, node.itemKey, expectedNode.itemKey)
+		assert.Equal(t, node.itemValue, expectedNode.itemValue)
+		assert.Equal(t, node.generation, expectedNode.generation)
+	}
+	assert.Nil(t, node)
+	assert.Nil(t, expectedNode)
+}
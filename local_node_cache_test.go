@@ -5,13 +5,20 @@ package cuckoocache
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
 	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/cacheMetrics"
+	"github.com/offchainlabs/cuckoocache/keyResolver"
 	"github.com/offchainlabs/cuckoocache/onChainIndex"
 	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/offchainlabs/cuckoocache/replacementPolicy"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
 	"testing"
 )
 
@@ -24,17 +31,17 @@ func TestNodeCacheLRUProperties(t *testing.T) {
 	assert.Nil(t, err)
 
 	for key := uint64(0); key < capacity; key++ {
-		_, hit, err := ReadItemFromLocalCache(cache, cacheKeys.NewUint64LocalCacheKey(key))
+		_, hit, err := ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(key))
 		assert.Nil(t, err)
 		assert.Equal(t, hit, false)
 		verifyCacheInvariants(t, cache)
 	}
 	verifyItemsAreInCache(t, cache, 0, capacity-1)
 
-	_, hit, err := ReadItemFromLocalCache(cache, cacheKeys.NewUint64LocalCacheKey(capacity))
+	_, hit, err := ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(capacity))
 	assert.Nil(t, err)
 	assert.Equal(t, hit, false)
-	_, hit, err = ReadItemFromLocalCache(cache, cacheKeys.NewUint64LocalCacheKey(capacity+1))
+	_, hit, err = ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(capacity+1))
 	assert.Nil(t, err)
 	assert.Equal(t, hit, false)
 	assert.Equal(t, IsInLocalNodeCache(cache, cacheKeys.NewUint64LocalCacheKey(0)), false)
@@ -42,7 +49,7 @@ func TestNodeCacheLRUProperties(t *testing.T) {
 	verifyItemsAreInCache(t, cache, 2, capacity+1)
 	verifyCacheInvariants(t, cache)
 
-	_, hit, err = ReadItemFromLocalCache(cache, cacheKeys.NewUint64LocalCacheKey(0))
+	_, hit, err = ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(0))
 	assert.Nil(t, err)
 	assert.Equal(t, hit, false)
 	assert.Equal(t, IsInLocalNodeCache(cache, cacheKeys.NewUint64LocalCacheKey(0)), true)
@@ -53,7 +60,7 @@ func TestNodeCacheLRUProperties(t *testing.T) {
 
 	sprayNodeCache(t, cache, 129581247)
 	for i := uint64(0); i < capacity; i++ {
-		_, _, err = ReadItemFromLocalCache(cache, cacheKeys.NewUint64LocalCacheKey(10000+i))
+		_, _, err = ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(10000+i))
 		assert.Nil(t, err)
 		verifyItemsAreInCache(t, cache, 10000, 10000+i)
 		verifyCacheInvariants(t, cache)
@@ -94,13 +101,439 @@ func TestCacheSubsetProperty(t *testing.T) {
 
 	// if we exercise the cache, subset property should continue to hold
 	for i := uint64(0); i < 2000; i++ {
-		_, _, err = ReadItemFromLocalCache(cache, cacheKeys.NewUint64LocalCacheKey(1000000+i))
+		_, _, err = ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(1000000+i))
 		assert.Nil(t, err)
 		assert.Equal(t, subsetPropertyHolds(t, cache), true)
 		verifyCacheInvariants(t, cache)
 	}
 }
 
+func TestWarmStartFromOnChain(t *testing.T) {
+	onChainCapacity := uint64(32)
+	nodeCapacity := 2*onChainCapacity + 17
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+	assert.Nil(t, err)
+
+	resolver := keyResolver.NewInMemoryKeyResolver[cacheKeys.Uint64LocalCacheKey]()
+	SetLocalNodeCacheKeyResolver(cache, resolver)
+	for seed := uint64(0); seed < 3*nodeCapacity; seed += nodeCapacity {
+		sprayNodeCache(t, cache, seed)
+	}
+
+	warm, err := NewLocalNodeCacheFromOnChain[cacheKeys.Uint64LocalCacheKey](context.Background(), 0, onChain, backing, resolver)
+	assert.Nil(t, err)
+	assert.Greater(t, warm.numInCache, uint64(0))
+	assert.Equal(t, subsetPropertyHolds(t, warm), true)
+	verifyCacheInvariants(t, warm)
+
+	// items from the current generation must be more recently used than items from the previous generation
+	header := readHeader(t, onChain)
+	seenPreviousGen := false
+	for node := warm.mru; node != nil; node = node.lessRecent {
+		if node.generation != header.CurrentGeneration {
+			assert.Equal(t, node.generation, header.CurrentGeneration-1)
+			seenPreviousGen = true
+		} else {
+			assert.Equal(t, seenPreviousGen, false)
+		}
+	}
+
+	// the warm cache should keep the subset property as the on-chain cache is exercised
+	for i := uint64(0); i < 200; i++ {
+		_, _, err = ReadItemFromLocalCache(context.Background(), warm, cacheKeys.NewUint64LocalCacheKey(1000000+i))
+		assert.Nil(t, err)
+		assert.Equal(t, subsetPropertyHolds(t, warm), true)
+	}
+}
+
+func TestPruneKeyResolver(t *testing.T) {
+	onChainCapacity := uint64(32)
+	nodeCapacity := 2*onChainCapacity + 17
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+	assert.Nil(t, err)
+
+	resolver := keyResolver.NewPersistedKeyResolver[cacheKeys.Uint64LocalCacheKey](memorydb.New(), cacheKeys.Uint64KeyCodec{})
+	SetLocalNodeCacheKeyResolver(cache, resolver)
+	recorded := map[cacheKeys.Uint64LocalCacheKey]bool{}
+	for i := uint64(0); i < 10*nodeCapacity; i++ {
+		key := cacheKeys.NewUint64LocalCacheKey(i)
+		_, _, err := ReadItemFromLocalCache(context.Background(), cache, key)
+		assert.Nil(t, err)
+		recorded[key] = true
+	}
+	pruned, err := PruneLocalNodeCacheKeyResolver(cache)
+	assert.Nil(t, err)
+	assert.Equal(t, pruned, uint64(len(recorded))-cache.numInCache)
+	for key := range recorded {
+		_, found, err := resolver.Resolve(key.ToCacheKey())
+		assert.Nil(t, err)
+		assert.Equal(t, found, IsInLocalNodeCache(cache, key))
+	}
+
+	// every item in the on-chain cache can still be resolved
+	warm, err := NewLocalNodeCacheFromOnChain[cacheKeys.Uint64LocalCacheKey](context.Background(), 0, onChain, backing, resolver)
+	assert.Nil(t, err)
+	report, err := VerifyInclusion(context.Background(), warm, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), true)
+	assert.Empty(t, report.Missing)
+}
+
+func TestBackingStoreErrors(t *testing.T) {
+	capacity := uint64(32)
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, onChain.Initialize(capacity))
+	mock := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	errBroken := errors.New("database is broken")
+	brokenKey := cacheKeys.NewUint64LocalCacheKey(13)
+	backing := cacheBackingStore.CacheBackingStoreFunc[cacheKeys.Uint64LocalCacheKey](
+		func(ctx context.Context, key cacheKeys.Uint64LocalCacheKey) ([]byte, error) {
+			if key == brokenKey {
+				return nil, errBroken
+			}
+			return mock.Read(ctx, key)
+		},
+	)
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](capacity, onChain, backing)
+	assert.Nil(t, err)
+	for key := uint64(0); key < capacity/2; key++ {
+		if key != 13 {
+			_, _, err = ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(key))
+			assert.Nil(t, err)
+		}
+	}
+	header := readHeader(t, onChain)
+
+	// a failed read must not be cached, and must not touch the LRU list or the on-chain cache
+	_, _, err = ReadItemFromLocalCache(context.Background(), cache, brokenKey)
+	assert.ErrorIs(t, err, errBroken)
+	assert.Equal(t, IsInLocalNodeCache(cache, brokenKey), false)
+	assert.Equal(t, readHeader(t, onChain), header)
+	verifyCacheInvariants(t, cache)
+
+	// not found is distinct from empty data
+	missingKey := cacheKeys.NewUint64LocalCacheKey(14)
+	mock.Delete(missingKey)
+	_, _, err = ReadItemFromLocalCache(context.Background(), cache, missingKey)
+	assert.Nil(t, err) // it was already cached before being deleted
+	assert.Nil(t, FlushOneItemFromLocalNodeCache(cache, missingKey, false))
+	_, _, err = ReadItemFromLocalCache(context.Background(), cache, missingKey)
+	assert.ErrorIs(t, err, cacheBackingStore.ErrNotFound)
+	emptyKey := cacheKeys.NewUint64LocalCacheKey(15)
+	mock.Write(emptyKey, []byte{})
+	assert.Nil(t, FlushOneItemFromLocalNodeCache(cache, emptyKey, false))
+	value, _, err := ReadItemFromLocalCache(context.Background(), cache, emptyKey)
+	assert.Nil(t, err)
+	assert.Equal(t, len(value), 0)
+	assert.Equal(t, IsInLocalNodeCache(cache, emptyKey), true)
+
+	// cancellation is reported as an error too
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = ReadItemFromLocalCache(ctx, cache, cacheKeys.NewUint64LocalCacheKey(1000))
+	assert.ErrorIs(t, err, context.Canceled)
+	verifyCacheInvariants(t, cache)
+}
+
+func TestByteBoundedCache(t *testing.T) {
+	onChainCapacity := uint64(32)
+	nodeCapacity := 4 * onChainCapacity
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	for i := uint64(0); i < 1000; i++ {
+		backing.Write(cacheKeys.NewUint64LocalCacheKey(i), make([]byte, 1+(i*i)%97))
+	}
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+	assert.Nil(t, err)
+	sprayNodeCache(t, cache, 0)
+	verifyCacheInvariants(t, cache)
+
+	maxBytes := uint64(40 * 50)
+	LimitLocalNodeCacheBytes(cache, maxBytes)
+	verifyCacheInvariants(t, cache)
+	verifyWithinByteLimit(t, cache, maxBytes)
+	for i := uint64(0); i < 1000; i++ {
+		_, _, err = ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey((i*7)%1000))
+		assert.Nil(t, err)
+		verifyCacheInvariants(t, cache)
+		verifyWithinByteLimit(t, cache, maxBytes)
+		assert.LessOrEqual(t, cache.numInCache, nodeCapacity)
+	}
+	assert.Equal(t, subsetPropertyHolds(t, cache), true)
+
+	// a limit too small for the on-chain cache's items can't evict them
+	LimitLocalNodeCacheBytes(cache, 1)
+	assert.Greater(t, cache.numBytes, uint64(1))
+	assert.Equal(t, subsetPropertyHolds(t, cache), true)
+	verifyCacheInvariants(t, cache)
+
+	LimitLocalNodeCacheBytes(cache, 0)
+	sprayNodeCache(t, cache, 0)
+	assert.Greater(t, cache.numBytes, maxBytes)
+}
+
+// the cache may only exceed its byte limit if its least recently used item might be in the on-chain cache
+func verifyWithinByteLimit(t *testing.T, cache *LocalNodeCache[cacheKeys.Uint64LocalCacheKey], maxBytes uint64) {
+	t.Helper()
+	if cache.numBytes > maxBytes {
+		assert.Equal(t, mightBeInOnChainCache(cache, cache.lru), true)
+	}
+}
+
+func TestSmallLocalCapacity(t *testing.T) {
+	onChainCapacity := uint64(32)
+	localCapacity := uint64(5)
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](localCapacity, onChain, backing)
+	assert.Nil(t, err)
+
+	maxInCache := uint64(0)
+	for i := uint64(0); i < 2000; i++ {
+		key := (i * i) % 97
+		if i%3 == 0 {
+			key = i % 7
+		}
+		_, _, err = ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(key))
+		assert.Nil(t, err)
+		assert.Equal(t, subsetPropertyHolds(t, cache), true)
+		verifyCacheInvariants(t, cache)
+		if cache.numInCache > localCapacity {
+			// the cache only grows beyond its capacity to hold items that might be in the on-chain cache
+			assert.Equal(t, mightBeInOnChainCache(cache, cache.lru), true)
+		}
+		if cache.numInCache > maxInCache {
+			maxInCache = cache.numInCache
+		}
+	}
+	assert.Greater(t, maxInCache, localCapacity)
+	assert.LessOrEqual(t, maxInCache, onChainCapacity+1)
+}
+
+func TestReplacementPolicies(t *testing.T) {
+	onChainCapacity := uint64(32)
+	localCapacity := 3 * onChainCapacity
+	policies := map[string]func() replacementPolicy.ReplacementPolicy[cacheKeys.Uint64LocalCacheKey]{
+		"none": func() replacementPolicy.ReplacementPolicy[cacheKeys.Uint64LocalCacheKey] { return nil },
+		"lru": func() replacementPolicy.ReplacementPolicy[cacheKeys.Uint64LocalCacheKey] {
+			return replacementPolicy.NewLruPolicy[cacheKeys.Uint64LocalCacheKey]()
+		},
+		"arc": func() replacementPolicy.ReplacementPolicy[cacheKeys.Uint64LocalCacheKey] {
+			return replacementPolicy.NewArcPolicy[cacheKeys.Uint64LocalCacheKey](localCapacity)
+		},
+		"2q": func() replacementPolicy.ReplacementPolicy[cacheKeys.Uint64LocalCacheKey] {
+			return replacementPolicy.NewTwoQueuePolicy[cacheKeys.Uint64LocalCacheKey](localCapacity)
+		},
+		"s3-fifo": func() replacementPolicy.ReplacementPolicy[cacheKeys.Uint64LocalCacheKey] {
+			return replacementPolicy.NewS3FifoPolicy[cacheKeys.Uint64LocalCacheKey](localCapacity)
+		},
+	}
+	caches := map[string]*LocalNodeCache[cacheKeys.Uint64LocalCacheKey]{}
+	localHits := map[string]int64{}
+	for name, newPolicy := range policies {
+		onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+		assert.Nil(t, onChain.Initialize(onChainCapacity))
+		backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+		cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](localCapacity, onChain, backing)
+		assert.Nil(t, err)
+		sink := cacheMetrics.NewInMemorySink()
+		SetLocalNodeCacheMetricsSink(cache, sink)
+		sprayNodeCache(t, cache, 5000)
+		if policy := newPolicy(); policy != nil {
+			SetLocalNodeCacheReplacementPolicy(cache, &contractCheckingPolicy{policy, t, map[cacheKeys.Uint64LocalCacheKey]bool{}})
+		}
+
+		// a hot set of items that are each read twice, between scans of items that are read once
+		scanned := uint64(1000)
+		for round := 0; round < 20; round++ {
+			for i := uint64(0); i < 40; i++ {
+				for j := 0; j < 2; j++ {
+					_, _, err := ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(i))
+					assert.Nil(t, err)
+				}
+			}
+			for i := 0; i < 80; i++ {
+				_, _, err := ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(scanned))
+				assert.Nil(t, err)
+				scanned++
+				if cache.numInCache > localCapacity {
+					assert.Equal(t, mightBeInOnChainCache(cache, cache.lru), true)
+				}
+			}
+			assert.Equal(t, subsetPropertyHolds(t, cache), true, name)
+			verifyCacheInvariants(t, cache)
+			verifyGenerationsInLruOrder(t, cache)
+		}
+		caches[name] = cache
+		localHits[name] = sink.Counter(cacheMetrics.LocalHits)
+
+		assert.Nil(t, FlushLocalNodeCache(cache, false))
+		sprayNodeCache(t, cache, 9000)
+		verifyCacheInvariants(t, cache)
+	}
+
+	// the LRU policy makes the same choices as no policy, and the others keep more of the hot set
+	verifySameLruList(t, caches["lru"], caches["none"])
+	for _, name := range []string{"arc", "2q", "s3-fifo"} {
+		assert.Greater(t, localHits[name], localHits["lru"]+20*40/2, name)
+	}
+}
+
+// The subset property relies on two properties of the on-chain cache, which must hold whatever its generation
+// thresholds: an item is only live if it was accessed in the current generation or the one before it, which is
+// what mightBeInOnChainCache assumes, and the live items are among the Capacity most recently accessed ones, so
+// the on-chain cache never holds an item that an LRU cache of the same capacity wouldn't.
+func TestWarmStartWithMoreLiveGenerations(t *testing.T) {
+	onChainCapacity := uint64(32)
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	params := onChainIndex.GenerationParameters{CurrentGenThreshold: 200, LiveGenerations: 5}
+	assert.Nil(t, onChain.InitializeWithParameters(onChainCapacity, params))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](onChainCapacity, onChain, backing)
+	assert.Nil(t, err)
+	resolver := keyResolver.NewInMemoryKeyResolver[cacheKeys.Uint64LocalCacheKey]()
+	SetLocalNodeCacheKeyResolver(cache, resolver)
+	for seed := uint64(0); seed < 3*onChainCapacity; seed += onChainCapacity {
+		sprayNodeCache(t, cache, seed)
+	}
+
+	warm, err := NewLocalNodeCacheFromOnChain[cacheKeys.Uint64LocalCacheKey](context.Background(), 0, onChain, backing, resolver)
+	assert.Nil(t, err)
+	assert.Equal(t, subsetPropertyHolds(t, warm), true)
+	verifyCacheInvariants(t, warm)
+	report, err := VerifyInclusion(context.Background(), warm, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), true)
+
+	// the items come from more than two generations, with older generations less recently used
+	header := readHeader(t, onChain)
+	generations := map[uint64]bool{}
+	for node := warm.mru; node != nil; node = node.lessRecent {
+		generations[node.generation] = true
+		assert.Greater(t, node.generation+uint64(params.LiveGenerations), header.CurrentGeneration)
+		if node.lessRecent != nil {
+			assert.LessOrEqual(t, node.lessRecent.generation, node.generation)
+		}
+	}
+	assert.Greater(t, len(generations), 2)
+
+	for i := uint64(0); i < 200; i++ {
+		_, _, err = ReadItemFromLocalCache(context.Background(), warm, cacheKeys.NewUint64LocalCacheKey(1000000+i%50))
+		assert.Nil(t, err)
+		assert.Equal(t, subsetPropertyHolds(t, warm), true)
+	}
+}
+
+func TestGenerationThresholds(t *testing.T) {
+	onChainCapacity := uint64(32)
+	localCapacity := uint64(16)
+	storages := map[onChainIndex.GenerationParameters]*onChainStorage.MockOnChainStorage{}
+	for _, params := range []onChainIndex.GenerationParameters{
+		{},
+		{CurrentGenThreshold: onChainIndex.DefaultCurrentGenThreshold, InCacheThreshold: onChainIndex.DefaultInCacheThreshold},
+		{CurrentGenThreshold: 32, InCacheThreshold: 32}, // the lowest that leaves room for an item in capacity 32
+		{CurrentGenThreshold: 100, InCacheThreshold: 300},
+		{CurrentGenThreshold: 250, InCacheThreshold: 500},
+		{CurrentGenThreshold: 500},
+		{CurrentGenThreshold: 1000, InCacheThreshold: 1000},
+		{LiveGenerations: 3},
+		{CurrentGenThreshold: 250, LiveGenerations: 4},
+		{CurrentGenThreshold: 100, InCacheThreshold: 800, LiveGenerations: onChainIndex.MaxLiveGenerations},
+	} {
+		storage := onChainStorage.NewMockOnChainStorage()
+		onChain := onChainIndex.OpenOnChainCuckooTable(storage, onChainCapacity)
+		assert.Nil(t, onChain.InitializeWithParameters(onChainCapacity, params))
+		backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+		cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](localCapacity, onChain, backing)
+		assert.Nil(t, err)
+
+		lru := []cacheKeys.Uint64LocalCacheKey{} // the LRU reference, from the most recently used
+		rng := rand.New(rand.NewSource(12))
+		for i := 0; i < 1000; i++ {
+			key := cacheKeys.NewUint64LocalCacheKey(uint64(rng.ExpFloat64() * 30))
+			_, _, err := ReadItemFromLocalCache(context.Background(), cache, key)
+			assert.Nil(t, err)
+			for j := range lru {
+				if lru[j] == key {
+					lru = append(lru[:j], lru[j+1:]...)
+					break
+				}
+			}
+			lru = append([]cacheKeys.Uint64LocalCacheKey{key}, lru...)
+
+			inLru := map[onChainIndex.CacheItemKey]bool{}
+			for _, key := range lru[:min(uint64(len(lru)), onChainCapacity)] {
+				inLru[key.ToCacheKey()] = true
+			}
+			allInLru, err := onChainIndex.ForAllOnChainCachedItems(
+				onChain,
+				func(itemKey onChainIndex.CacheItemKey, _ bool, soFar bool) (bool, error) {
+					return soFar && inLru[itemKey], nil
+				},
+				true,
+			)
+			assert.Nil(t, err)
+			assert.Equal(t, allInLru, true, params)
+			assert.Equal(t, subsetPropertyHolds(t, cache), true, params)
+
+			currentGen, inCache := params.CurrentGenThreshold, params.InCacheThreshold
+			if currentGen == 0 {
+				currentGen = onChainIndex.DefaultCurrentGenThreshold
+			}
+			if inCache == 0 {
+				inCache = onChainIndex.DefaultInCacheThreshold
+			}
+			header := readHeader(t, onChain)
+			assert.LessOrEqual(t, header.CurrentGenCount, onChainCapacity*uint64(currentGen)/1000)
+			assert.LessOrEqual(t, header.InCacheCount, onChainCapacity*uint64(inCache)/1000)
+		}
+		verifyCacheInvariants(t, cache)
+		check, err := onChain.Check()
+		assert.Nil(t, err)
+		assert.Equal(t, check.OK(), true)
+		storages[params] = storage.(*onChainStorage.MockOnChainStorage)
+	}
+
+	// explicit default thresholds behave like the defaults, other than in the header
+	defaults := onChainIndex.GenerationParameters{
+		CurrentGenThreshold: onChainIndex.DefaultCurrentGenThreshold,
+		InCacheThreshold:    onChainIndex.DefaultInCacheThreshold,
+	}
+	implicit, explicit := storages[onChainIndex.GenerationParameters{}].Snapshot(), storages[defaults].Snapshot()
+	headerLocation := onChainStorage.SlotLocation(0)
+	assert.NotEqual(t, implicit[headerLocation], explicit[headerLocation])
+	delete(implicit, headerLocation)
+	delete(explicit, headerLocation)
+	assert.Equal(t, implicit, explicit)
+
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	for _, params := range []onChainIndex.GenerationParameters{
+		{CurrentGenThreshold: 1200},
+		{LiveGenerations: 1},
+		{LiveGenerations: onChainIndex.MaxLiveGenerations + 1},
+		{CurrentGenThreshold: 1, InCacheThreshold: 1},
+		{CurrentGenThreshold: 31},
+	} {
+		err := onChain.InitializeWithParameters(onChainCapacity, params)
+		assert.ErrorIs(t, err, onChainIndex.ErrInvalidGenerationParameters)
+	}
+	assert.ErrorIs(t, onChain.Initialize(1), onChainIndex.ErrInvalidGenerationParameters)
+
+	// nor can a table be resized to a capacity that its thresholds leave no room in
+	params := onChainIndex.GenerationParameters{CurrentGenThreshold: 32, InCacheThreshold: 32}
+	assert.Nil(t, onChain.InitializeWithParameters(onChainCapacity, params))
+	assert.ErrorIs(t, onChain.Resize(onChainCapacity-1), onChainIndex.ErrInvalidGenerationParameters)
+	assert.Nil(t, onChain.Resize(2*onChainCapacity))
+}
+
 func readHeader(t *testing.T, onChain *onChainIndex.OnChainCuckooTable) onChainIndex.OnChainCuckooHeader {
 	t.Helper()
 	header, err := onChain.ReadHeader()
@@ -108,6 +541,159 @@ func readHeader(t *testing.T, onChain *onChainIndex.OnChainCuckooTable) onChainI
 	return header
 }
 
+func TestIsHitOnChain(t *testing.T) {
+	onChainCapacity := uint64(32)
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](2*onChainCapacity, onChain, backing)
+	assert.Nil(t, err)
+	sprayNodeCache(t, cache, 3000)
+
+	for i := uint64(3000); i < 3000+3*onChainCapacity; i++ {
+		key := cacheKeys.NewUint64LocalCacheKey(i)
+		wasLocal := IsInLocalNodeCache(cache, key)
+		headerBefore := readHeader(t, onChain)
+		result, err := IsHitOnChain(cache, key)
+		assert.Nil(t, err)
+		assert.Equal(t, IsInLocalNodeCache(cache, key), wasLocal)
+		assert.Equal(t, readHeader(t, onChain), headerBefore)
+
+		_, hit, err := ReadItemFromLocalCache(context.Background(), cache, key)
+		assert.Nil(t, err)
+		assert.Equal(t, hit, result.Hit)
+	}
+}
+
+func TestReadItemsMatchesSequential(t *testing.T) {
+	onChainCapacity := uint64(16)
+	newCache := func() *LocalNodeCache[cacheKeys.Uint64LocalCacheKey] {
+		onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+		assert.Nil(t, onChain.Initialize(onChainCapacity))
+		backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+		cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](onChainCapacity/2, onChain, backing)
+		assert.Nil(t, err)
+		return cache
+	}
+	batched, sequential := newCache(), newCache()
+	lruOrder := func(cache *LocalNodeCache[cacheKeys.Uint64LocalCacheKey]) []cacheKeys.Uint64LocalCacheKey {
+		return ForAllInLocalNodeCache(
+			cache,
+			func(key cacheKeys.Uint64LocalCacheKey, _ []byte, soFar []cacheKeys.Uint64LocalCacheKey) []cacheKeys.Uint64LocalCacheKey {
+				return append(soFar, key)
+			},
+			[]cacheKeys.Uint64LocalCacheKey{},
+		)
+	}
+
+	rng := rand.New(rand.NewSource(5521))
+	for batch := 0; batch < 300; batch++ {
+		keys := []cacheKeys.Uint64LocalCacheKey{}
+		for i := rng.Intn(10); i > 0; i-- {
+			keys = append(keys, cacheKeys.NewUint64LocalCacheKey(uint64(rng.Intn(int(3*onChainCapacity)))))
+		}
+		data, hits, err := ReadItemsFromLocalCache(context.Background(), batched, keys)
+		assert.Nil(t, err)
+		for i, key := range keys {
+			value, hit, err := ReadItemFromLocalCache(context.Background(), sequential, key)
+			assert.Nil(t, err)
+			assert.Equal(t, data[i], value)
+			assert.Equal(t, hits[i], hit)
+		}
+		assert.Equal(t, lruOrder(batched), lruOrder(sequential))
+		assert.Equal(t, readHeader(t, batched.onChain), readHeader(t, sequential.onChain))
+		verifyCacheInvariants(t, batched)
+		assert.Equal(t, subsetPropertyHolds(t, batched), subsetPropertyHolds(t, sequential))
+	}
+
+	// if any item can't be read, nothing is modified, not even the resolver
+	headerBefore, orderBefore := readHeader(t, batched.onChain), lruOrder(batched)
+	resolver := keyResolver.NewInMemoryKeyResolver[cacheKeys.Uint64LocalCacheKey]()
+	SetLocalNodeCacheKeyResolver[cacheKeys.Uint64LocalCacheKey](batched, resolver)
+	backing := batched.backingStore.(*cacheBackingStore.MockBackingStore[cacheKeys.Uint64LocalCacheKey])
+	backing.Delete(cacheKeys.NewUint64LocalCacheKey(1000))
+	keys := []cacheKeys.Uint64LocalCacheKey{cacheKeys.NewUint64LocalCacheKey(999), cacheKeys.NewUint64LocalCacheKey(1000)}
+	_, _, err := ReadItemsFromLocalCache(context.Background(), batched, keys)
+	assert.ErrorIs(t, err, cacheBackingStore.ErrNotFound)
+	assert.Equal(t, readHeader(t, batched.onChain), headerBefore)
+	assert.Equal(t, lruOrder(batched), orderBefore)
+	_, found, err := resolver.Resolve(keys[0].ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, false)
+}
+
+func TestLocalCacheMetrics(t *testing.T) {
+	onChainCapacity := uint64(32)
+	nodeCapacity := onChainCapacity + 7
+	storage := onChainStorage.NewFaultyOnChainStorage(onChainStorage.NewMockOnChainStorage(), nil)
+	onChain := onChainIndex.OpenOnChainCuckooTable(storage, onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](nodeCapacity, onChain, backing)
+	assert.Nil(t, err)
+	localSink, onChainSink := cacheMetrics.NewInMemorySink(), cacheMetrics.NewInMemorySink()
+	SetLocalNodeCacheMetricsSink(cache, localSink)
+	onChain.SetMetricsSink(onChainSink)
+
+	numReads := int64(0)
+	onChainHits := int64(0)
+	for i := uint64(0); i < 1000; i++ {
+		_, hit, err := ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey((i*i)%101))
+		assert.Nil(t, err)
+		numReads++
+		if hit {
+			onChainHits++
+		}
+	}
+	assert.Equal(t, localSink.Counter(cacheMetrics.LocalHits)+localSink.Counter(cacheMetrics.LocalMisses), numReads)
+	assert.Equal(t, localSink.Counter(cacheMetrics.LocalEvictions), localSink.Counter(cacheMetrics.LocalMisses)-int64(cache.numInCache))
+	assert.Equal(t, onChainSink.Counter(cacheMetrics.OnChainHits), onChainHits)
+	assert.Equal(t, onChainSink.Counter(cacheMetrics.OnChainHits)+onChainSink.Counter(cacheMetrics.OnChainMisses), numReads)
+	// every on-chain hit is a local hit, because of the inclusion property
+	assert.GreaterOrEqual(t, localSink.Counter(cacheMetrics.LocalHits), onChainHits)
+
+	// flushes that fail aren't counted
+	storage.SetFault(onChainStorage.FailNthAccess(0))
+	assert.ErrorIs(t, FlushOneItemFromLocalNodeCache(cache, cacheKeys.NewUint64LocalCacheKey(1), true), onChainStorage.ErrInjectedFault)
+	storage.SetFault(onChainStorage.FailNthAccess(0))
+	assert.ErrorIs(t, FlushLocalNodeCache(cache, true), onChainStorage.ErrInjectedFault)
+	assert.Equal(t, localSink.Counter(cacheMetrics.LocalItemFlushes), int64(0))
+	assert.Equal(t, localSink.Counter(cacheMetrics.LocalFlushes), int64(0))
+	storage.SetFault(nil)
+
+	assert.Nil(t, FlushOneItemFromLocalNodeCache(cache, cacheKeys.NewUint64LocalCacheKey(1), true))
+	assert.Nil(t, FlushLocalNodeCache(cache, true))
+	assert.Equal(t, localSink.Counter(cacheMetrics.LocalItemFlushes), int64(1))
+	assert.Equal(t, localSink.Counter(cacheMetrics.LocalFlushes), int64(1))
+	assert.Equal(t, onChainSink.Counter(cacheMetrics.OnChainItemFlushes), int64(1))
+	assert.Equal(t, onChainSink.Counter(cacheMetrics.OnChainFlushes), int64(1))
+}
+
+// A policy that checks that the cache doesn't tell it about items leaving the cache that it chose to evict.
+type contractCheckingPolicy struct {
+	replacementPolicy.ReplacementPolicy[cacheKeys.Uint64LocalCacheKey]
+	t       *testing.T
+	victims map[cacheKeys.Uint64LocalCacheKey]bool
+}
+
+func (p *contractCheckingPolicy) Inserted(key cacheKeys.Uint64LocalCacheKey) {
+	delete(p.victims, key)
+	p.ReplacementPolicy.Inserted(key)
+}
+
+func (p *contractCheckingPolicy) Removed(key cacheKeys.Uint64LocalCacheKey) {
+	assert.False(p.t, p.victims[key])
+	p.ReplacementPolicy.Removed(key)
+}
+
+func (p *contractCheckingPolicy) Victim(evictable func(key cacheKeys.Uint64LocalCacheKey) bool) (cacheKeys.Uint64LocalCacheKey, bool) {
+	key, found := p.ReplacementPolicy.Victim(evictable)
+	if found {
+		p.victims[key] = true
+	}
+	return key, found
+}
+
 func TestCacheFlush(t *testing.T) {
 	onChainCapacity := uint64(32)
 	nodeCapacity := 2*onChainCapacity + 17
@@ -121,12 +707,13 @@ func TestCacheFlush(t *testing.T) {
 	sprayNodeCache(t, cache, 0)
 	assert.Greater(t, cache.numInCache, uint64(0))
 	key42 := cacheKeys.NewUint64LocalCacheKey(42)
-	_, _, err = ReadItemFromLocalCache(cache, key42)
+	_, _, err = ReadItemFromLocalCache(context.Background(), cache, key42)
 	assert.Nil(t, err)
 	assert.Equal(t, IsInLocalNodeCache(cache, key42), true)
 
 	assert.Nil(t, FlushOneItemFromLocalNodeCache(cache, key42, false))
 	assert.Equal(t, IsInLocalNodeCache(cache, key42), false)
+	verifyCacheInvariants(t, cache)
 	header, err := cache.onChain.ReadHeader()
 	assert.Nil(t, err)
 	in, err := cache.onChain.IsInCache(&header, key42.ToCacheKey())
@@ -134,7 +721,7 @@ func TestCacheFlush(t *testing.T) {
 	assert.Equal(t, in, true)
 
 	sprayNodeCache(t, cache, 0)
-	_, _, err = ReadItemFromLocalCache(cache, key42)
+	_, _, err = ReadItemFromLocalCache(context.Background(), cache, key42)
 	assert.Nil(t, err)
 	assert.Nil(t, FlushOneItemFromLocalNodeCache(cache, key42, true))
 	assert.Equal(t, IsInLocalNodeCache(cache, key42), false)
@@ -196,7 +783,7 @@ func sprayNodeCache(t *testing.T, cache *LocalNodeCache[cacheKeys.Uint64LocalCac
 	modulus := 11 * cache.localCapacity / 7
 	for i := uint64(seed); i < seed+cache.localCapacity; i++ {
 		item := seed + (i % modulus)
-		_, _, err := ReadItemFromLocalCache(cache, cacheKeys.NewUint64LocalCacheKey(item))
+		_, _, err := ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(item))
 		assert.Nil(t, err)
 	}
 }
@@ -212,16 +799,28 @@ func verifyAllCachedValuesCorrect[KeyType cacheKeys.LocalNodeCacheKey](cache *Lo
 	return ForAllInLocalNodeCache[KeyType, bool](
 		cache,
 		func(key KeyType, value []byte, okSoFar bool) bool {
-			return okSoFar && bytes.Equal(value, cache.backingStore.Read(key))
+			expected, err := cache.backingStore.Read(context.Background(), key)
+			return okSoFar && err == nil && bytes.Equal(value, expected)
 		},
 		true,
 	)
 }
 
+func numBytesCorrect(cache *LocalNodeCache[cacheKeys.Uint64LocalCacheKey]) bool {
+	return ForAllInLocalNodeCache[cacheKeys.Uint64LocalCacheKey, uint64](
+		cache,
+		func(_ cacheKeys.Uint64LocalCacheKey, value []byte, numSoFar uint64) uint64 {
+			return numSoFar + uint64(len(value))
+		},
+		0,
+	) == cache.numBytes
+}
+
 func verifyCacheInvariants(t *testing.T, cache *LocalNodeCache[cacheKeys.Uint64LocalCacheKey]) {
 	t.Helper()
 	assert.Equal(t, verifyAllCachedValuesCorrect(cache), true)
 	assert.Equal(t, numInCacheCorrect(cache), true)
+	assert.Equal(t, numBytesCorrect(cache), true)
 }
 
 func sprayOnChainCache(t *testing.T, cache *onChainIndex.OnChainCuckooTable, seed uint64) {
@@ -0,0 +1,199 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/keyResolver"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+)
+
+var ErrViewOutdated = errors.New("local node cache was modified after the view was opened")
+
+// Open a view of the local cache for speculative reads, such as those of eth_call or eth_estimateGas. The view is
+// a local cache of its own, on a view of the on-chain cache that buffers its writes in an overlay of the on-chain
+// cache's storage (see OnChainCuckooTable.OpenOverlay), so reads from the view modify neither the on-chain cache
+// nor the local cache's LRU order. The view starts out empty, but takes the values of items that are in the local
+// cache from it rather than from the backing store. Keys that the view records with its key resolver are only
+// recorded with the local cache's resolver when the view is committed.
+//
+// The view reads through to the local cache and to the on-chain cache's storage, so neither may be modified while
+// the view is in use. To drop the view's reads, just drop the view. To make them real, either read the same items
+// from the local cache, or call CommitLocalNodeCacheView, which needs the local cache's key resolver.
+func OpenLocalNodeCacheView[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+) (*LocalNodeCache[CacheKey], *onChainStorage.OverlayOnChainStorage, error) {
+	backingStore := cacheBackingStore.CacheBackingStoreFunc[CacheKey](
+		func(ctx context.Context, key CacheKey) ([]byte, error) {
+			if node := cache.index[key]; node != nil {
+				return node.itemValue, nil
+			}
+			return cache.backingStore.Read(ctx, key)
+		},
+	)
+	return openView(cache, backingStore)
+}
+
+func openView[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *LocalNodeCache[CacheKey],
+	backingStore cacheBackingStore.CacheBackingStore[CacheKey],
+) (*LocalNodeCache[CacheKey], *onChainStorage.OverlayOnChainStorage, error) {
+	onChain, overlay := cache.onChain.OpenOverlay()
+	view, err := NewLocalNodeCache[CacheKey](cache.localCapacity, onChain, backingStore)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the view's transaction hasn't read the header that opening the view did
+	onChain.ResetAccessList()
+	view.maxBytes = cache.maxBytes
+	if cache.keyResolver != nil {
+		view.keyResolver = &viewKeyResolver[CacheKey]{
+			parent:   cache.keyResolver,
+			recorded: make(map[onChainIndex.CacheItemKey]CacheKey),
+		}
+	}
+	return view, overlay, nil
+}
+
+// Make the reads from a view of the local cache real: record the keys the view recorded with the local cache's key
+// resolver, commit the overlay to the on-chain cache's storage, and reconcile the local cache with the result, as
+// ReconcileLocalNodeCache does.
+func CommitLocalNodeCacheView[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	cache *LocalNodeCache[CacheKey],
+	view *LocalNodeCache[CacheKey],
+	overlay *onChainStorage.OverlayOnChainStorage,
+) (InclusionReport, error) {
+	// record before committing, so a failure can't leave an unresolvable item in the on-chain cache
+	if resolver, ok := view.keyResolver.(*viewKeyResolver[CacheKey]); ok {
+		if err := resolver.commit(); err != nil {
+			return InclusionReport{}, err
+		}
+	}
+	if err := overlay.Commit(); err != nil {
+		return InclusionReport{}, err
+	}
+	return ReconcileLocalNodeCache(ctx, cache)
+}
+
+// A view's key resolver keeps the keys recorded with it to itself until the view is committed.
+type viewKeyResolver[CacheKey cacheKeys.LocalNodeCacheKey] struct {
+	parent   keyResolver.KeyResolver[CacheKey]
+	recorded map[onChainIndex.CacheItemKey]CacheKey
+	order    []CacheKey // in the order they were first recorded, so committing is deterministic
+}
+
+func (r *viewKeyResolver[CacheKey]) Record(key CacheKey) error {
+	itemKey := key.ToCacheKey()
+	if _, seen := r.recorded[itemKey]; !seen {
+		r.order = append(r.order, key)
+	}
+	r.recorded[itemKey] = key
+	return nil
+}
+
+func (r *viewKeyResolver[CacheKey]) Resolve(itemKey onChainIndex.CacheItemKey) (CacheKey, bool, error) {
+	if key, found := r.recorded[itemKey]; found {
+		return key, true, nil
+	}
+	return r.parent.Resolve(itemKey)
+}
+
+func (r *viewKeyResolver[CacheKey]) commit() error {
+	for len(r.order) > 0 {
+		if err := r.parent.Record(r.order[0]); err != nil {
+			return err
+		}
+		delete(r.recorded, r.order[0].ToCacheKey())
+		r.order = r.order[1:]
+	}
+	return nil
+}
+
+// ConcurrentCacheView is a view of a ConcurrentLocalNodeCache, see OpenConcurrentCacheView.
+type ConcurrentCacheView[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	cache         *ConcurrentLocalNodeCache[KeyType]
+	view          *LocalNodeCache[KeyType]
+	overlay       *onChainStorage.OverlayOnChainStorage
+	modifications uint64 // the shared cache's modifications when the view was opened
+}
+
+// Open a view of a shared cache, as OpenLocalNodeCacheView does for a cache that isn't shared, except that the
+// shared cache can still be used while the view is. Each read from the view holds the shared cache's shared lock
+// while it accesses the on-chain cache, and values of items in the local cache are copied out under the shared
+// lock. Reads from the view can see modifications of the shared cache made since the view was opened, and once the
+// shared cache has been modified, the view can no longer be committed.
+//
+// A view must not be used by more than one goroutine at a time.
+func OpenConcurrentCacheView[CacheKey cacheKeys.LocalNodeCacheKey](
+	cache *ConcurrentLocalNodeCache[CacheKey],
+) (*ConcurrentCacheView[CacheKey], error) {
+	backingStore := cacheBackingStore.CacheBackingStoreFunc[CacheKey](
+		func(ctx context.Context, key CacheKey) ([]byte, error) {
+			cache.mutex.RLock()
+			node := cache.cache.index[key]
+			var value []byte
+			if node != nil {
+				value = bytes.Clone(node.itemValue)
+			}
+			cache.mutex.RUnlock()
+			if node != nil {
+				return value, nil
+			}
+			return cache.cache.backingStore.Read(ctx, key)
+		},
+	)
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	cache.onChainMutex.Lock()
+	defer cache.onChainMutex.Unlock()
+	view, overlay, err := openView(cache.cache, backingStore)
+	if err != nil {
+		return nil, err
+	}
+	return &ConcurrentCacheView[CacheKey]{cache: cache, view: view, overlay: overlay, modifications: cache.modifications}, nil
+}
+
+func ReadItemFromConcurrentCacheView[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	view *ConcurrentCacheView[CacheKey],
+	key CacheKey,
+) ([]byte, bool, error) { // (data, wasHitInCache)
+	var value []byte
+	if !IsInLocalNodeCache(view.view, key) {
+		var err error
+		value, err = view.view.backingStore.Read(ctx, key)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	view.cache.mutex.RLock()
+	defer view.cache.mutex.RUnlock()
+	// the view reads the shared cache's on-chain index, which hits in the shared cache write while holding the shared lock
+	view.cache.onChainMutex.Lock()
+	defer view.cache.onChainMutex.Unlock()
+	return readItem(view.view, key, value)
+}
+
+// Make the reads from a view real, as CommitLocalNodeCacheView does, holding the shared cache's exclusive lock.
+// This fails with ErrViewOutdated if the shared cache has been modified since the view was opened.
+func CommitConcurrentCacheView[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	view *ConcurrentCacheView[CacheKey],
+) (InclusionReport, error) {
+	cache := view.cache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	applyPendingAccesses(cache)
+	if cache.modifications != view.modifications {
+		return InclusionReport{}, ErrViewOutdated
+	}
+	cache.modifications++
+	return CommitLocalNodeCacheView(ctx, cache.cache, view.view, view.overlay)
+}
@@ -0,0 +1,152 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"context"
+	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/keyResolver"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLocalCacheView(t *testing.T) {
+	onChainCapacity := uint64(32)
+	storage := onChainStorage.NewMockOnChainStorage().(*onChainStorage.MockOnChainStorage)
+	onChain := onChainIndex.OpenOnChainCuckooTable(storage, onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	mock := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	backingReads := 0
+	backing := cacheBackingStore.CacheBackingStoreFunc[cacheKeys.Uint64LocalCacheKey](
+		func(ctx context.Context, key cacheKeys.Uint64LocalCacheKey) ([]byte, error) {
+			backingReads++
+			return mock.Read(ctx, key)
+		},
+	)
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](onChainCapacity, onChain, backing)
+	assert.Nil(t, err)
+	resolver := keyResolver.NewInMemoryKeyResolver[cacheKeys.Uint64LocalCacheKey]()
+	SetLocalNodeCacheKeyResolver(cache, resolver)
+	for i := uint64(0); i < 100; i++ {
+		_, _, err := ReadItemFromLocalCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey((i*i)%70))
+		assert.Nil(t, err)
+	}
+	storageBefore := storage.Snapshot()
+	lruBefore := []cacheKeys.Uint64LocalCacheKey{}
+	for node := cache.mru; node != nil; node = node.lessRecent {
+		lruBefore = append(lruBefore, node.itemKey)
+	}
+
+	// the view sees the same hits, at the same cost, as the on-chain cache would
+	view, overlay, err := OpenLocalNodeCacheView(cache)
+	assert.Nil(t, err)
+	referenceStorage := onChainStorage.NewMockOnChainStorageFromSnapshot(storage.Snapshot())
+	reference := onChainIndex.OpenOnChainCuckooTable(referenceStorage, onChainCapacity)
+	reference.ResetAccessList()
+	backingReads = 0
+	expectedBackingReads := 0
+	for i := uint64(0); i < 60; i++ {
+		key := cacheKeys.NewUint64LocalCacheKey(50 + i%40)
+		if !IsInLocalNodeCache(cache, key) && !IsInLocalNodeCache(view, key) {
+			expectedBackingReads++
+		}
+		value, hit, err := ReadItemFromLocalCache(context.Background(), view, key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, expectedValue(t, mock, key))
+		expectedHit, _, err := reference.AccessItem(key.ToCacheKey())
+		assert.Nil(t, err)
+		assert.Equal(t, hit, expectedHit)
+		assert.Equal(t, view.onChain.LastOperationCost(), reference.LastOperationCost())
+	}
+	assert.Equal(t, backingReads, expectedBackingReads)
+	assert.Greater(t, overlay.NumBufferedWrites(), 0)
+	verifyCacheInvariants(t, view)
+
+	// neither the on-chain cache nor the local cache has changed
+	assert.Equal(t, storage.Snapshot(), storageBefore)
+	lruAfter := []cacheKeys.Uint64LocalCacheKey{}
+	for node := cache.mru; node != nil; node = node.lessRecent {
+		lruAfter = append(lruAfter, node.itemKey)
+	}
+	assert.Equal(t, lruAfter, lruBefore)
+
+	// and the keys the view recorded aren't known to the local cache's resolver either
+	viewOnlyKey := cacheKeys.NewUint64LocalCacheKey(89)
+	_, found, err := resolver.Resolve(viewOnlyKey.ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, false)
+
+	// committing the view makes its reads real, and reconciles the local cache, restoring the subset property
+	report, err := CommitLocalNodeCacheView(context.Background(), cache, view, overlay)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.Snapshot(), referenceStorage.(*onChainStorage.MockOnChainStorage).Snapshot())
+	resolved, found, err := resolver.Resolve(viewOnlyKey.ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, true)
+	assert.Equal(t, resolved, viewOnlyKey)
+	assert.Equal(t, report.Holds(), true)
+	assert.Equal(t, subsetPropertyHolds(t, cache), true)
+	verifyCacheInvariants(t, cache)
+}
+
+func TestConcurrentCacheView(t *testing.T) {
+	onChainCapacity := uint64(32)
+	onChain := onChainIndex.OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	inner, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](onChainCapacity, onChain, backing)
+	assert.Nil(t, err)
+	resolver := keyResolver.NewInMemoryKeyResolver[cacheKeys.Uint64LocalCacheKey]()
+	SetLocalNodeCacheKeyResolver(inner, resolver)
+	cache := NewConcurrentLocalNodeCache(inner)
+	for i := uint64(0); i < 100; i++ {
+		_, _, err := ReadItemFromConcurrentCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey((i*i)%70))
+		assert.Nil(t, err)
+	}
+
+	// the shared cache can be read while the view is
+	view, err := OpenConcurrentCacheView(cache)
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(0); i < 500; i++ {
+			key := cacheKeys.NewUint64LocalCacheKey(i % 70)
+			if value, inCache := PeekItemInConcurrentCache(cache, key); inCache {
+				assert.Equal(t, value, expectedValue(t, backing, key))
+			}
+		}
+	}()
+	for i := uint64(0); i < 60; i++ {
+		key := cacheKeys.NewUint64LocalCacheKey(50 + i%40)
+		value, _, err := ReadItemFromConcurrentCacheView(context.Background(), view, key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, expectedValue(t, backing, key))
+	}
+	<-done
+	_, found, err := resolver.Resolve(cacheKeys.NewUint64LocalCacheKey(89).ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, false)
+	report, err := CommitConcurrentCacheView(context.Background(), view)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), true)
+	_, found, err = resolver.Resolve(cacheKeys.NewUint64LocalCacheKey(89).ToCacheKey())
+	assert.Nil(t, err)
+	assert.Equal(t, found, true)
+	assert.Equal(t, subsetPropertyHolds(t, inner), true)
+	verifyCacheInvariants(t, inner)
+
+	// a view of a cache that has been modified since can't be committed
+	view, err = OpenConcurrentCacheView(cache)
+	assert.Nil(t, err)
+	_, _, err = ReadItemFromConcurrentCacheView(context.Background(), view, cacheKeys.NewUint64LocalCacheKey(500))
+	assert.Nil(t, err)
+	_, _, err = ReadItemFromConcurrentCache(context.Background(), cache, cacheKeys.NewUint64LocalCacheKey(501))
+	assert.Nil(t, err)
+	_, err = CommitConcurrentCacheView(context.Background(), view)
+	assert.ErrorIs(t, err, ErrViewOutdated)
+}
@@ -0,0 +1,55 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+type AccessResult struct {
+	Hit        bool
+	Generation uint64 // current generation after the access
+}
+
+// Access several items, such as all the items touched by a transaction, in order. The results are the same as
+// accessing them one at a time with AccessItem, but the header is read and written only once, and an item that
+// was already accessed in the current generation isn't looked up again.
+//
+// Like AccessItem, this modifies storage only if it succeeds.
+func (oc *OnChainCuckooTable) AccessItems(itemKeys []CacheItemKey) ([]AccessResult, error) {
+	results := make([]AccessResult, len(itemKeys))
+	err := oc.atomically(func() error {
+		header, err := oc.readValidHeader()
+		if err != nil {
+			return err
+		}
+		headerBefore := header
+
+		// an item accessed in the current generation is still in it, unless it was discarded since; note that
+		// the generation can advance as part of an access, leaving the accessed item in the previous generation
+		accessedIn := make(map[CacheItemKey]uint64, len(itemKeys))
+		discarded := make(map[CacheItemKey]bool)
+		for i, itemKey := range itemKeys {
+			generation, accessed := accessedIn[itemKey]
+			if accessed && generation == header.CurrentGeneration && !discarded[itemKey] {
+				results[i] = AccessResult{Hit: true, Generation: generation}
+				oc.countAccess(true)
+				continue
+			}
+			delete(discarded, itemKey) // the item might even be discarded by its own access
+			accessedIn[itemKey] = header.CurrentGeneration
+			hit, err := oc.accessItemWithHeader(&header, itemKey, discarded)
+			if err != nil {
+				return err
+			}
+			results[i] = AccessResult{Hit: hit, Generation: header.CurrentGeneration}
+			oc.countAccess(hit)
+		}
+
+		if header != headerBefore {
+			return oc.WriteHeader(header)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestAccessItemsMatchesSequential(t *testing.T) {
+	for i, keys := range []func(i uint64) CacheItemKey{keyFromUint64, collidingKey, keyFromUint64} {
+		params := GenerationParameters{}
+		if i == 2 {
+			params = GenerationParameters{CurrentGenThreshold: 250, LiveGenerations: 4}
+		}
+		capacity := uint64(8)
+		batchedStorage := onChainStorage.NewMockOnChainStorage().(*onChainStorage.MockOnChainStorage)
+		recorder := onChainStorage.NewRecordingOnChainStorage(batchedStorage)
+		batched := OpenOnChainCuckooTable(recorder, capacity)
+		assert.Nil(t, batched.InitializeWithParameters(capacity, params))
+		sequentialStorage := onChainStorage.NewMockOnChainStorage().(*onChainStorage.MockOnChainStorage)
+		sequential := OpenOnChainCuckooTable(sequentialStorage, capacity)
+		assert.Nil(t, sequential.InitializeWithParameters(capacity, params))
+
+		rng := rand.New(rand.NewSource(9431))
+		for batch := 0; batch < 200; batch++ {
+			if batch == 100 {
+				// the rest of the batches are during a resize, and migrate items as they go
+				assert.Nil(t, batched.StartResize(3*capacity))
+				assert.Nil(t, sequential.StartResize(3*capacity))
+			}
+			itemKeys := []CacheItemKey{}
+			for i := rng.Intn(12); i > 0; i-- {
+				itemKeys = append(itemKeys, keys(uint64(rng.Intn(int(2*capacity)))))
+			}
+
+			recorder.ResetTrace()
+			results, err := batched.AccessItems(itemKeys)
+			assert.Nil(t, err)
+			headerReads, headerWrites := 0, 0
+			for _, access := range recorder.Trace() {
+				if access.IsSlot && access.Offset == headerOffset {
+					if access.IsWrite {
+						headerWrites++
+					} else {
+						headerReads++
+					}
+				}
+			}
+			assert.Equal(t, headerReads, 1)
+			assert.LessOrEqual(t, headerWrites, 1)
+
+			for i, itemKey := range itemKeys {
+				hit, generation, err := sequential.AccessItem(itemKey)
+				assert.Nil(t, err)
+				assert.Equal(t, results[i], AccessResult{Hit: hit, Generation: generation})
+			}
+			assert.Equal(t, batchedStorage.Snapshot(), sequentialStorage.Snapshot())
+		}
+		verifyAccurateGenerationCounts(t, batched)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import "fmt"
+
+type ViolationKind uint8
+
+const (
+	WrongInCacheCount    ViolationKind = iota // the header's InCacheCount isn't the number of live entries
+	WrongCurrentGenCount                      // the header's CurrentGenCount isn't the number of entries in the current generation
+	DuplicateKey                              // lookups of the entry's key find an entry of it that is no newer first
+	UnreachableEntry                          // the entry is live, but isn't in a slot that lookups of its key consult
+	FutureGeneration                          // the entry's generation is later than the current generation
+	BadResizeState                            // the state of the resize in progress doesn't describe an old table
+	WrongOlderGenCounts                       // the header's OlderGenCounts aren't the numbers of entries in the older generations
+)
+
+func (kind ViolationKind) String() string {
+	switch kind {
+	case WrongInCacheCount:
+		return "wrong in-cache count"
+	case WrongCurrentGenCount:
+		return "wrong current generation count"
+	case DuplicateKey:
+		return "duplicate key"
+	case UnreachableEntry:
+		return "unreachable entry"
+	case FutureGeneration:
+		return "future generation"
+	case BadResizeState:
+		return "bad resize state"
+	case WrongOlderGenCounts:
+		return "wrong older generation counts"
+	default:
+		return fmt.Sprintf("violation %d", kind)
+	}
+}
+
+// A Violation of one of the table's invariants. Violations of the header's counts have no entry, so only Kind is
+// set; other violations give the entry's location and contents.
+type Violation struct {
+	Kind   ViolationKind
+	Region uint8
+	Slot   uint64
+	Lane   uint64
+	Item   CuckooItem
+}
+
+type CheckReport struct {
+	Header          OnChainCuckooHeader
+	InCacheCount    uint64                         // number of live items in the table
+	CurrentGenCount uint64                         // number of items in the table in the current generation
+	OlderGenCounts  [MaxLiveGenerations - 2]uint64 // numbers of live items in the table in the generations before the previous one
+	Violations      []Violation
+}
+
+func (report CheckReport) OK() bool {
+	return len(report.Violations) == 0
+}
+
+// Check the table's invariants: the header's counts match the table's items, lookups of a key never find an
+// entry of it that is no newer than a later one, every live entry can be found by lookups of its key, and no entry
+// is from a later generation than the current one. Each item is counted once, for the entry that lookups find.
+// This reads every entry of the table, including the old table of a resize in progress, but never writes storage.
+//
+// Check only returns an error if the table can't be read at all, such as if its header is corrupt in a way other
+// than its counts; violations of the invariants are reported in the CheckReport.
+func (oc *OnChainCuckooTable) Check() (CheckReport, error) {
+	var report CheckReport
+	err := oc.readOnly(func() error {
+		var err error
+		report, err = oc.check()
+		return err
+	})
+	return report, err
+}
+
+// Repair the table so that it satisfies the invariants that Check checks, as far as it can. Unreachable entries
+// are cleared, entries from a later generation are moved to the current generation, and the header's counts are
+// recomputed from the table's entries. Duplicate keys are only reported, and a bad resize state can't be repaired;
+// both are left as they are. The report is of the violations found before the repair.
+func (oc *OnChainCuckooTable) Repair() (CheckReport, error) {
+	var report CheckReport
+	err := oc.atomically(func() error {
+		var err error
+		report, err = oc.check()
+		if err != nil {
+			return err
+		}
+		return oc.repair(report)
+	})
+	return report, err
+}
+
+func (oc *OnChainCuckooTable) check() (CheckReport, error) {
+	header, err := oc.ReadHeader()
+	if err != nil {
+		return CheckReport{}, err
+	}
+	if err := header.validateLayout(); err != nil {
+		return CheckReport{}, err
+	}
+	report := CheckReport{Header: header}
+	checkRegion := func(region uint8, capacity uint64) error {
+		for slot := uint64(0); slot < capacity; slot++ {
+			for lane := uint64(0); lane < NumLanes; lane++ {
+				item, err := oc.readEntryInRegion(region, capacity, slot, lane)
+				if err != nil {
+					return err
+				}
+				if !header.isLive(item.Generation) {
+					continue
+				}
+				violation := Violation{Region: region, Slot: slot, Lane: lane, Item: item}
+				if item.Generation > header.CurrentGeneration {
+					violation.Kind = FutureGeneration
+					report.Violations = append(report.Violations, violation)
+				}
+				if slotForLane(item.ItemKey, lane, capacity) != slot {
+					violation.Kind = UnreachableEntry
+					report.Violations = append(report.Violations, violation)
+					continue
+				}
+				hiding, hidden, err := oc.hidingEntry(&header, region, capacity, lane, item.ItemKey)
+				if err != nil {
+					return err
+				}
+				if hidden {
+					// an entry hidden behind a later access to its item is left to expire, but lookups should
+					// never find an older entry of an item first
+					if hiding.Generation <= item.Generation {
+						violation.Kind = DuplicateKey
+						report.Violations = append(report.Violations, violation)
+					}
+					continue
+				}
+				report.InCacheCount++
+				if item.Generation >= header.CurrentGeneration {
+					report.CurrentGenCount++
+				} else if age, _ := header.olderLiveAge(item.Generation); age >= 2 {
+					report.OlderGenCounts[age-2]++
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := checkRegion(header.TableRegion, header.Capacity); err != nil {
+		return CheckReport{}, err
+	}
+	if header.Resizing {
+		state, err := oc.readResizeState()
+		if err != nil {
+			return CheckReport{}, err
+		}
+		if state.OldCapacity == 0 || state.OldCapacity > MaxCacheSize || state.Cursor > state.OldCapacity*NumLanes {
+			report.Violations = append(report.Violations, Violation{Kind: BadResizeState})
+		} else if err := checkRegion(1-header.TableRegion, state.OldCapacity); err != nil {
+			return CheckReport{}, err
+		}
+	}
+
+	if report.InCacheCount != header.InCacheCount {
+		report.Violations = append(report.Violations, Violation{Kind: WrongInCacheCount})
+	}
+	if report.CurrentGenCount != header.CurrentGenCount {
+		report.Violations = append(report.Violations, Violation{Kind: WrongCurrentGenCount})
+	}
+	if report.OlderGenCounts != header.OlderGenCounts {
+		report.Violations = append(report.Violations, Violation{Kind: WrongOlderGenCounts})
+	}
+	return report, nil
+}
+
+func (oc *OnChainCuckooTable) repair(report CheckReport) error {
+	header := report.Header
+	for _, violation := range report.Violations {
+		capacity := header.Capacity
+		if violation.Region != header.TableRegion {
+			state, err := oc.readResizeState()
+			if err != nil {
+				return err
+			}
+			capacity = state.OldCapacity
+		}
+		switch violation.Kind {
+		case UnreachableEntry:
+			if err := oc.writeEntryInRegion(violation.Region, capacity, violation.Slot, violation.Lane, CuckooItem{}); err != nil {
+				return err
+			}
+			// it wasn't counted
+		case FutureGeneration:
+			item := violation.Item
+			item.Generation = header.CurrentGeneration
+			if err := oc.writeEntryInRegion(violation.Region, capacity, violation.Slot, violation.Lane, item); err != nil {
+				return err
+			}
+		}
+	}
+	header.InCacheCount = report.InCacheCount
+	header.CurrentGenCount = report.CurrentGenCount
+	header.OlderGenCounts = report.OlderGenCounts
+	_ = oc.advanceGenerationIfNeeded(&header)
+	if header == report.Header {
+		return nil
+	}
+	return oc.WriteHeader(header)
+}
@@ -0,0 +1,172 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestCheckHealthyTable(t *testing.T) {
+	capacity := uint64(32)
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	_, err := cache.Check()
+	assert.ErrorIs(t, err, ErrUninitialized)
+	assert.Nil(t, cache.Initialize(capacity))
+	verifyCheckOK(t, cache)
+
+	for i := uint64(0); i < 20; i++ {
+		assert.Nil(t, sprayOnChainCache(cache, 1000*i))
+		assert.Nil(t, cache.FlushOneItem(keyFromUint64(1000*i+3)))
+		verifyCheckOK(t, cache)
+	}
+	assert.Nil(t, cache.StartResize(48))
+	for done := false; !done; {
+		verifyCheckOK(t, cache)
+		done, err = cache.ContinueResize(50)
+		assert.Nil(t, err)
+		assert.Nil(t, sprayOnChainCache(cache, 77))
+	}
+	verifyCheckOK(t, cache)
+}
+
+// A long run of accesses to hashed keys, with some keys much more popular than others, so that items are often
+// accessed again while still in the cache, and no access ever leaves a violation behind.
+func TestCheckLongWorkload(t *testing.T) {
+	capacity := uint64(64)
+	for _, params := range []GenerationParameters{{}, {LiveGenerations: 4}} {
+		cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+		assert.Nil(t, cache.InitializeWithParameters(capacity, params))
+		rng := rand.New(rand.NewSource(19))
+		for i := 0; i < 5000; i++ {
+			itemKey := keyFromUint64(uint64(rng.ExpFloat64() * 80))
+			header, err := cache.ReadHeader()
+			assert.Nil(t, err)
+			in, err := cache.IsInCache(&header, itemKey)
+			assert.Nil(t, err)
+			hit, _, err := cache.AccessItem(itemKey)
+			assert.Nil(t, err)
+			assert.Equal(t, hit, in)
+			if i%50 == 0 {
+				verifyCheckOK(t, cache)
+			}
+		}
+		verifyCheckOK(t, cache)
+		verifyAccurateGenerationCounts(t, cache)
+	}
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	capacity := uint64(32)
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	assert.Nil(t, sprayOnChainCache(cache, 98113084))
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+
+	// find two live entries to damage
+	type entry struct {
+		slot, lane uint64
+		item       CuckooItem
+	}
+	live := []entry{}
+	for slot := uint64(0); slot < capacity && len(live) < 2; slot++ {
+		for lane := uint64(0); lane < NumLanes && len(live) < 2; lane++ {
+			item, err := cache.ReadTableEntry(&header, slot, lane)
+			assert.Nil(t, err)
+			if item.Generation == header.CurrentGeneration {
+				live = append(live, entry{slot, lane, item})
+			}
+		}
+	}
+	assert.Equal(t, len(live), 2)
+
+	// a second copy of the first item, where lookups would find it, and a copy of the second where they wouldn't
+	duplicateLane := (live[0].lane + 1) % NumLanes
+	duplicateSlot := header.getSlotForLane(live[0].item.ItemKey, duplicateLane)
+	assert.Nil(t, cache.WriteTableEntry(&header, duplicateSlot, duplicateLane, live[0].item))
+	unreachableSlot := (header.getSlotForLane(live[1].item.ItemKey, 0) + 1) % capacity
+	assert.Nil(t, cache.WriteTableEntry(&header, unreachableSlot, 0, live[1].item))
+	// and an entry from the future, in place of the second item
+	future := CuckooItem{ItemKey: live[1].item.ItemKey, Generation: header.CurrentGeneration + 5}
+	assert.Nil(t, cache.WriteTableEntry(&header, live[1].slot, live[1].lane, future))
+
+	report, err := cache.Check()
+	assert.Nil(t, err)
+	assert.Equal(t, report.OK(), false)
+	kinds := violationKinds(report)
+	// whether the counts are still right depends on what the copies overwrote
+	delete(kinds, WrongInCacheCount)
+	delete(kinds, WrongCurrentGenCount)
+	assert.Equal(t, kinds, map[ViolationKind]int{DuplicateKey: 1, UnreachableEntry: 1, FutureGeneration: 1})
+	for _, violation := range report.Violations {
+		switch violation.Kind {
+		case UnreachableEntry:
+			assert.Equal(t, violation.Slot, unreachableSlot)
+		case FutureGeneration:
+			assert.Equal(t, violation.Item, future)
+		}
+	}
+
+	repairReport, err := cache.Repair()
+	assert.Nil(t, err)
+	assert.Equal(t, repairReport, report)
+	// duplicates are only reported
+	report, err = cache.Check()
+	assert.Nil(t, err)
+	assert.Equal(t, violationKinds(report), map[ViolationKind]int{DuplicateKey: 1})
+	assert.Nil(t, cache.WriteTableEntry(&header, duplicateSlot, duplicateLane, CuckooItem{}))
+	verifyCheckOK(t, cache)
+	verifyAccurateGenerationCounts(t, cache)
+	items := liveItems(t, cache)
+	assert.Equal(t, items[live[0].item.ItemKey], true)
+	assert.Equal(t, items[live[1].item.ItemKey], true)
+
+	// counts that don't fit the capacity are repaired too, even though no other operation will accept them
+	header, err = cache.ReadHeader()
+	assert.Nil(t, err)
+	wrongHeader := header
+	wrongHeader.InCacheCount = 5 * capacity
+	wrongHeader.CurrentGenCount = 4 * capacity
+	assert.Nil(t, cache.WriteHeader(wrongHeader))
+	_, _, err = cache.AccessItem(keyFromUint64(1))
+	assert.ErrorIs(t, err, ErrCorruptHeader)
+	report, err = cache.Repair()
+	assert.Nil(t, err)
+	assert.Equal(t, violationKinds(report), map[ViolationKind]int{WrongInCacheCount: 1, WrongCurrentGenCount: 1})
+	repaired, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, repaired, header)
+
+	// a resize in progress without a resize state can't be repaired
+	wrongHeader = header
+	wrongHeader.Resizing = true
+	assert.Nil(t, cache.WriteHeader(wrongHeader))
+	for i := 0; i < 2; i++ {
+		report, err = cache.Repair()
+		assert.Nil(t, err)
+		assert.Equal(t, violationKinds(report), map[ViolationKind]int{BadResizeState: 1})
+	}
+}
+
+func violationKinds(report CheckReport) map[ViolationKind]int {
+	kinds := map[ViolationKind]int{}
+	for _, violation := range report.Violations {
+		kinds[violation.Kind]++
+	}
+	return kinds
+}
+
+func verifyCheckOK(t *testing.T, cache *OnChainCuckooTable) {
+	t.Helper()
+	report, err := cache.Check()
+	assert.Nil(t, err)
+	assert.Equal(t, report.Violations, []Violation(nil))
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, report.Header, header)
+	assert.Equal(t, report.InCacheCount, header.InCacheCount)
+}
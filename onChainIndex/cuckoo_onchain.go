@@ -3,18 +3,204 @@
 
 package onChainIndex
 
-const LogMaxCacheSize = 16
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/offchainlabs/cuckoocache/cacheMetrics"
+)
+
+const LogMaxCacheSize = 28
 const MaxCacheSize = 1 << LogMaxCacheSize
 
+var ErrInvalidCapacity = errors.New("invalid on-chain cache capacity")
+
 type CacheItemKey = [24]byte
 
 const NumLanes = 8
 
 type OnChainCuckooHeader struct {
+	Version           uint8 // format of the header in storage; see CurrentHeaderVersion
 	Capacity          uint64
 	CurrentGeneration uint64
 	CurrentGenCount   uint64
 	InCacheCount      uint64
+	TableRegion       uint8 // which of the two table regions in storage holds the table
+	Resizing          bool  // whether entries are still being migrated from the other region, see StartResize
+	GenerationParameters
+	// The numbers of live items in generations CurrentGeneration-2, CurrentGeneration-3 and so on, back to the
+	// oldest live generation. These are only used with more than two live generations; the number of live items
+	// in the previous generation is whatever the other counts leave of InCacheCount.
+	OlderGenCounts [MaxLiveGenerations - 2]uint64
+}
+
+// GenerationParameters control when the current generation advances: once the current generation holds more than
+// CurrentGenThreshold thousandths of the capacity, or the live generations together hold more than
+// InCacheThreshold thousandths of it. Zero means the default threshold.
+//
+// A lower current generation threshold advances generations more often, so the live items are more recently
+// accessed ones, at the cost of more writes to refresh items; a lower in-cache threshold keeps fewer items live.
+// Either way, the live items are always the most recently accessed ones, so the subset property of local caches
+// doesn't depend on the thresholds.
+//
+// LiveGenerations is how many of the latest generations are live, from 2 up to MaxLiveGenerations; zero means
+// the default of two. With more live generations, each generation is a smaller slice of the cache, so a generation
+// advance expires fewer items at once, and the live items are a closer match for the most recently accessed ones.
+// This usually goes with a lower current generation threshold, and costs more writes to refresh items, as well as
+// a slot of storage for the counts of the older generations.
+type GenerationParameters struct {
+	CurrentGenThreshold uint16
+	InCacheThreshold    uint16
+	LiveGenerations     uint8
+}
+
+const (
+	DefaultCurrentGenThreshold = 750
+	DefaultInCacheThreshold    = 1000
+	maxThreshold               = 1000
+	DefaultLiveGenerations     = 2
+	MaxLiveGenerations         = 8
+)
+
+var ErrInvalidGenerationParameters = errors.New("invalid on-chain cache generation parameters")
+
+func (params GenerationParameters) thresholds() (uint64, uint64) { // (current generation, in cache)
+	currentGen, inCache := uint64(params.CurrentGenThreshold), uint64(params.InCacheThreshold)
+	if currentGen == 0 {
+		currentGen = DefaultCurrentGenThreshold
+	}
+	if inCache == 0 {
+		inCache = DefaultInCacheThreshold
+	}
+	return currentGen, inCache
+}
+
+func (params GenerationParameters) NumLiveGenerations() uint64 {
+	if params.LiveGenerations == 0 {
+		return DefaultLiveGenerations
+	}
+	return uint64(params.LiveGenerations)
+}
+
+func (params GenerationParameters) validate() error {
+	currentGen, inCache := params.thresholds()
+	if inCache > maxThreshold || currentGen > inCache {
+		return fmt.Errorf(
+			"%w: thresholds %d (current generation) and %d (in cache) must not exceed each other or %d",
+			ErrInvalidGenerationParameters,
+			currentGen,
+			inCache,
+			maxThreshold,
+		)
+	}
+	if liveGenerations := params.NumLiveGenerations(); liveGenerations < 2 || liveGenerations > MaxLiveGenerations {
+		return fmt.Errorf(
+			"%w: %d live generations, must be from 2 to %d",
+			ErrInvalidGenerationParameters,
+			liveGenerations,
+			MaxLiveGenerations,
+		)
+	}
+	return nil
+}
+
+// Check that a table of the given capacity can hold at least one item in its current generation, and in its live
+// generations, so that it doesn't advance its generation on every access.
+func (params GenerationParameters) validateForCapacity(capacity uint64) error {
+	currentGen, inCache := params.thresholds()
+	if capacity*currentGen/maxThreshold == 0 || capacity*inCache/maxThreshold == 0 {
+		return fmt.Errorf(
+			"%w: thresholds %d (current generation) and %d (in cache) leave no room in capacity %d",
+			ErrInvalidGenerationParameters,
+			currentGen,
+			inCache,
+			capacity,
+		)
+	}
+	return nil
+}
+
+// The generation that a table starts in, so that uninitialized CuckooItems look like they're double-expired.
+func (params GenerationParameters) initialGeneration() uint64 {
+	return params.lookupHorizon() + 1
+}
+
+// How many generations an entry can have been expired for while a live item is in a later lane than it. An item
+// is put in the first lane that is free at the time, so the entries before it were live then.
+//
+// With more than two live generations, an item that is refreshed behind a free lane is moved into that lane, and
+// the entry it leaves behind is expired at once, so an entry before a live item might have expired a generation
+// before the item did. With two live generations, that entry is left as it was, hidden behind the new one.
+func (params GenerationParameters) lookupHorizon() uint64 {
+	liveGenerations := params.NumLiveGenerations()
+	if liveGenerations == DefaultLiveGenerations {
+		return 2
+	}
+	return 2*liveGenerations - 1
+}
+
+// Whether an item last accessed in the given generation is in the cache.
+func (header *OnChainCuckooHeader) isLive(generation uint64) bool {
+	return generation+header.NumLiveGenerations() > header.CurrentGeneration
+}
+
+// How many generations before the current one an item was last accessed, if it is live and not from the current
+// generation or a later one.
+func (header *OnChainCuckooHeader) olderLiveAge(generation uint64) (uint64, bool) {
+	if generation >= header.CurrentGeneration || !header.isLive(generation) {
+		return 0, false
+	}
+	return header.CurrentGeneration - generation, true
+}
+
+// Whether an entry expired so long ago that no live item can be in a later lane than it, so that looking for an
+// item can stop there.
+func (header *OnChainCuckooHeader) isDoubleExpired(generation uint64) bool {
+	return generation+header.lookupHorizon() < header.CurrentGeneration
+}
+
+// The number of live items that were last accessed age generations before the current one.
+func (header *OnChainCuckooHeader) countOfAge(age uint64) uint64 {
+	switch age {
+	case 0:
+		return header.CurrentGenCount
+	case 1:
+		previous := header.InCacheCount - header.CurrentGenCount
+		for _, count := range header.OlderGenCounts {
+			previous -= count
+		}
+		return previous
+	default:
+		return header.OlderGenCounts[age-2]
+	}
+}
+
+// Count a live item of an older generation as accessed in the current generation.
+func (header *OnChainCuckooHeader) countRefresh(age uint64) {
+	header.CurrentGenCount += 1
+	if age >= 2 {
+		header.OlderGenCounts[age-2] -= 1
+	}
+}
+
+// Stop counting an item last accessed in the given generation, if it was counted.
+func (header *OnChainCuckooHeader) countRemoval(generation uint64) {
+	if generation == header.CurrentGeneration {
+		header.CurrentGenCount -= 1
+		header.InCacheCount -= 1
+	} else if age, live := header.olderLiveAge(generation); live {
+		header.InCacheCount -= 1
+		if age >= 2 {
+			header.OlderGenCounts[age-2] -= 1
+		}
+	}
+}
+
+// The most items that the current generation, and the live generations together, may hold.
+func (header *OnChainCuckooHeader) generationLimits() (uint64, uint64) { // (current generation, in cache)
+	currentGen, inCache := header.thresholds()
+	return header.Capacity * currentGen / maxThreshold, header.Capacity * inCache / maxThreshold
 }
 
 type CuckooItem struct {
@@ -23,236 +209,428 @@ type CuckooItem struct {
 }
 
 func (oc *OnChainCuckooTable) Initialize(capacity uint64) error {
+	return oc.InitializeWithParameters(capacity, GenerationParameters{})
+}
+
+func (oc *OnChainCuckooTable) InitializeWithParameters(capacity uint64, params GenerationParameters) error {
+	return oc.atomically(func() error { return oc.initialize(capacity, params) })
+}
+
+func (oc *OnChainCuckooTable) initialize(capacity uint64, params GenerationParameters) error {
+	if capacity == 0 || capacity > MaxCacheSize {
+		return ErrInvalidCapacity
+	}
+	if err := params.validate(); err != nil {
+		return err
+	}
+	if err := params.validateForCapacity(capacity); err != nil {
+		return err
+	}
 	header := OnChainCuckooHeader{
-		Capacity:          capacity,
-		CurrentGeneration: 3, // so that uninitialized CuckooItems look like they're double-expired
+		Version:              CurrentHeaderVersion,
+		Capacity:             capacity,
+		CurrentGeneration:    params.initialGeneration(),
+		GenerationParameters: params,
 	}
 	return oc.WriteHeader(header)
 }
 
 func (oc *OnChainCuckooTable) IsInCache(header *OnChainCuckooHeader, itemKey CacheItemKey) (bool, error) {
-	for lane := uint64(0); lane < NumLanes; lane++ {
-		slot := header.getSlotForLane(itemKey, lane)
-		cuckooItem, err := oc.ReadTableEntry(slot, lane)
-		if err != nil {
-			return false, err
-		}
-		if cuckooItem.ItemKey == itemKey && cuckooItem.Generation != 0 {
-			return cuckooItem.Generation+1 >= header.CurrentGeneration, nil
-		}
+	var in bool
+	err := oc.readOnly(func() error {
+		var err error
+		in, err = oc.isInCache(header, itemKey)
+		return err
+	})
+	if err != nil {
+		return false, err
 	}
-	return false, nil
+	return in, nil
+}
+
+func (oc *OnChainCuckooTable) isInCache(header *OnChainCuckooHeader, itemKey CacheItemKey) (bool, error) {
+	result, err := oc.query(header, itemKey)
+	return result.Hit, err
 }
 
 func (oc *OnChainCuckooTable) AccessItem(itemKey CacheItemKey) (bool, uint64, error) { // hit, current generation after access
-	hdr, err := oc.ReadHeader()
+	var hit bool
+	var generation uint64
+	err := oc.atomically(func() error {
+		var err error
+		hit, generation, err = oc.accessItem(itemKey)
+		return err
+	})
 	if err != nil {
 		return false, 0, err
 	}
-	header := &hdr
+	return hit, generation, nil
+}
+
+func (oc *OnChainCuckooTable) accessItem(itemKey CacheItemKey) (bool, uint64, error) {
+	header, err := oc.readValidHeader()
+	if err != nil {
+		return false, 0, err
+	}
+	headerBefore := header
+	hit, err := oc.accessItemWithHeader(&header, itemKey, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	oc.countAccess(hit)
+	// every access but a hit in the current generation writes the header, even if it ends up as it was
+	if !hit || header != headerBefore {
+		if err := oc.WriteHeader(header); err != nil {
+			return false, 0, err
+		}
+	}
+	return hit, header.CurrentGeneration, nil
+}
+
+// Access an item, updating the header but leaving it to the caller to write the header back. Items discarded to make
+// room for it are added to discarded, if it isn't nil.
+func (oc *OnChainCuckooTable) accessItemWithHeader(
+	header *OnChainCuckooHeader,
+	itemKey CacheItemKey,
+	discarded map[CacheItemKey]bool,
+) (bool, error) {
+	if header.Resizing {
+		if err := oc.migrateItem(header, itemKey); err != nil {
+			return false, err
+		}
+	}
 	for lane := uint64(0); lane < NumLanes; lane++ {
 		slot := header.getSlotForLane(itemKey, lane)
-		itemFromTable, err := oc.ReadTableEntry(slot, lane)
+		itemFromTable, err := oc.ReadTableEntry(header, slot, lane)
 		if err != nil {
-			return false, 0, err
+			return false, err
 		}
 		if itemFromTable.ItemKey == itemKey {
 			cachedGeneration := itemFromTable.Generation
 			if cachedGeneration == header.CurrentGeneration {
-				return true, header.CurrentGeneration, nil
-			} else if cachedGeneration+1 == header.CurrentGeneration {
+				return true, nil
+			} else if age, live := header.olderLiveAge(cachedGeneration); live {
 				itemFromTable.Generation = header.CurrentGeneration
-				if err := oc.WriteTableEntry(slot, lane, itemFromTable); err != nil {
-					return false, 0, err
+				if err := oc.WriteTableEntry(header, slot, lane, itemFromTable); err != nil {
+					return false, err
 				}
-				header.CurrentGenCount += 1
+				header.countRefresh(age)
 				_ = oc.advanceGenerationIfNeeded(header)
-				if err := oc.WriteHeader(*header); err != nil {
-					return false, 0, err
-				}
-				return true, header.CurrentGeneration, nil
+				return true, nil
 			} else {
 				// the item is in the table but is expired
 				itemFromTable.Generation = header.CurrentGeneration
-				if err := oc.WriteTableEntry(slot, lane, itemFromTable); err != nil {
-					return false, 0, err
+				if err := oc.WriteTableEntry(header, slot, lane, itemFromTable); err != nil {
+					return false, err
 				}
 				header.CurrentGenCount += 1
 				header.InCacheCount += 1
 				_ = oc.advanceGenerationIfNeeded(header)
-				if err := oc.WriteHeader(*header); err != nil {
-					return false, 0, err
+				return false, nil
+			}
+		} else if !header.isLive(itemFromTable.Generation) {
+			// this slot is free, so the item goes here, but it might still be alive in a later lane, in which
+			// case this refreshes it
+			oldLane, generation, wasAlive, err := oc.findLiveMatch(itemKey, lane+1, header)
+			if err != nil {
+				return false, err
+			}
+			if wasAlive && generation == header.CurrentGeneration {
+				return true, nil
+			}
+			wasInOldGeneration := wasAlive
+			// with two live generations, the old entry is left where it is: lookups find the new one first, and
+			// the old one expires a generation before the new one does
+			if wasInOldGeneration && header.NumLiveGenerations() > DefaultLiveGenerations {
+				// the item moves into the free lane, and its old entry stays behind, expired, so that lookups of
+				// items in later lanes still go past it
+				if err := oc.WriteTableEntry(
+					header,
+					header.getSlotForLane(itemKey, oldLane),
+					oldLane,
+					CuckooItem{ItemKey: itemKey, Generation: header.CurrentGeneration - header.NumLiveGenerations()},
+				); err != nil {
+					return false, err
 				}
-				return false, header.CurrentGeneration, nil
 			}
-		} else if itemFromTable.Generation+1 < header.CurrentGeneration {
 			if err := oc.WriteTableEntry(
+				header,
 				slot,
 				lane,
 				CuckooItem{ItemKey: itemKey, Generation: header.CurrentGeneration},
 			); err != nil {
-				return false, 0, err
-			}
-			header.CurrentGenCount += 1
-			wasInOldGeneration, err := oc.findExactMatch(itemKey, header.CurrentGeneration-1, lane+1, header)
-			if err != nil {
-				return false, 0, err
+				return false, err
 			}
-			if !wasInOldGeneration {
+			if wasInOldGeneration {
+				age, _ := header.olderLiveAge(generation)
+				header.countRefresh(age)
+			} else {
+				header.CurrentGenCount += 1
 				header.InCacheCount += 1
 			}
 			_ = oc.advanceGenerationIfNeeded(header)
-			if err := oc.WriteHeader(*header); err != nil {
-				return false, 0, err
-			}
-			return wasInOldGeneration, header.CurrentGeneration, nil
+			return wasInOldGeneration, nil
 		}
 	}
 
 	slot := header.getSlotForLane(itemKey, 0)
-	itemKeyToRelocate, err := oc.ReadTableEntry(slot, 0)
+	itemKeyToRelocate, err := oc.ReadTableEntry(header, slot, 0)
 	if err != nil {
-		return false, 0, err
+		return false, err
 	}
 	if err := oc.WriteTableEntry(
+		header,
 		slot,
 		0,
 		CuckooItem{ItemKey: itemKey, Generation: header.CurrentGeneration},
 	); err != nil {
-		return false, 0, err
+		return false, err
 	}
 	header.CurrentGenCount += 1
 	header.InCacheCount += 1
 
-	if err := oc.relocateItem(itemKeyToRelocate, 1, header); err != nil {
-		return false, 0, err
+	if err := oc.relocateItem(itemKeyToRelocate, 1, header, discarded); err != nil {
+		return false, err
 	}
 	_ = oc.advanceGenerationIfNeeded(header)
-	if err := oc.WriteHeader(*header); err != nil {
-		return false, 0, err
-	}
-	return false, header.CurrentGeneration, nil
+	return false, nil
 }
 
-func (oc *OnChainCuckooTable) findExactMatch(
+// find the item in a lane from startInLane on, if it is alive there
+func (oc *OnChainCuckooTable) findLiveMatch(
 	itemKey CacheItemKey,
-	generation uint64,
 	startInLane uint64,
 	header *OnChainCuckooHeader,
-) (bool, error) {
+) (uint64, uint64, bool, error) { // (lane, generation, found)
 	for lane := startInLane; lane < NumLanes; lane++ {
 		slot := header.getSlotForLane(itemKey, lane)
-		item, err := oc.ReadTableEntry(slot, lane)
+		item, err := oc.ReadTableEntry(header, slot, lane)
 		if err != nil {
-			return false, err
+			return 0, 0, false, err
 		}
 		if item.ItemKey == itemKey {
-			return item.Generation == generation, nil
-		} else if item.Generation < generation-1 {
-			return false, nil
+			return lane, item.Generation, header.isLive(item.Generation), nil
+		} else if header.isDoubleExpired(item.Generation) {
+			return 0, 0, false, nil
 		}
 	}
-	return false, nil
+	return 0, 0, false, nil
+}
+
+// The entry of the item that lookups find before they get to the given lane of a region, if there is one: an entry
+// in an earlier lane, or, in the old table of a resize, a live entry in the new table. Accessing an item that is
+// alive in a later lane than a free one puts the item in the free lane, and leaves the later entry hidden behind
+// it until it expires.
+func (oc *OnChainCuckooTable) hidingEntry(
+	header *OnChainCuckooHeader,
+	region uint8,
+	capacity uint64,
+	lane uint64,
+	itemKey CacheItemKey,
+) (CuckooItem, bool, error) {
+	item, found, err := oc.findFirstEntry(region, capacity, lane, itemKey)
+	if err != nil || found || region == header.TableRegion {
+		return item, found, err
+	}
+	item, found, err = oc.findFirstEntry(header.TableRegion, header.Capacity, NumLanes, itemKey)
+	if err != nil {
+		return CuckooItem{}, false, err
+	}
+	return item, found && header.isLive(item.Generation), nil
+}
+
+// find the first entry of the item in a region, in the lanes before endLane, whether or not it is alive
+func (oc *OnChainCuckooTable) findFirstEntry(
+	region uint8,
+	capacity uint64,
+	endLane uint64,
+	itemKey CacheItemKey,
+) (CuckooItem, bool, error) {
+	for lane := uint64(0); lane < endLane; lane++ {
+		item, err := oc.readEntryInRegion(region, capacity, slotForLane(itemKey, lane, capacity), lane)
+		if err != nil {
+			return CuckooItem{}, false, err
+		}
+		if item.ItemKey == itemKey && item.Generation != 0 {
+			return item, true, nil
+		}
+	}
+	return CuckooItem{}, false, nil
 }
 
 func (oc *OnChainCuckooTable) FlushAll() error {
-	header, err := oc.ReadHeader()
+	return oc.atomically(oc.flushAll)
+}
+
+func (oc *OnChainCuckooTable) flushAll() error {
+	oc.metrics().IncCounter(cacheMetrics.OnChainFlushes, 1)
+	header, err := oc.readValidHeader()
 	if err != nil {
 		return err
 	}
-	header.CurrentGeneration += 3
+	// leave every item that was live double-expired
+	header.CurrentGeneration += header.lookupHorizon() + 1
 	header.CurrentGenCount = 0
 	header.InCacheCount = 0
+	header.OlderGenCounts = [MaxLiveGenerations - 2]uint64{}
+	header.Resizing = false // nothing is left alive in the old table
 	return oc.WriteHeader(header)
 }
 
 func (oc *OnChainCuckooTable) FlushOneItem(itemKey CacheItemKey) error {
-	header, err := oc.ReadHeader()
+	return oc.atomically(func() error { return oc.flushOneItem(itemKey) })
+}
+
+func (oc *OnChainCuckooTable) flushOneItem(itemKey CacheItemKey) error {
+	oc.metrics().IncCounter(cacheMetrics.OnChainItemFlushes, 1)
+	header, err := oc.readValidHeader()
 	if err != nil {
 		return err
 	}
-	for lane := uint64(0); lane < NumLanes; lane++ {
-		slot := header.getSlotForLane(itemKey, lane)
-		cuckooItem, err := oc.ReadTableEntry(slot, lane)
+	headerBefore := header
+	wasAlive, err := oc.flushOneItemInRegion(&header, header.TableRegion, header.Capacity, itemKey, false)
+	if err != nil {
+		return err
+	}
+	if header.Resizing {
+		state, err := oc.readResizeState()
 		if err != nil {
 			return err
 		}
-		if cuckooItem.Generation+3 <= header.CurrentGeneration {
-			return nil
+		if _, err := oc.flushOneItemInRegion(&header, 1-header.TableRegion, state.OldCapacity, itemKey, wasAlive); err != nil {
+			return err
+		}
+	}
+	if header != headerBefore {
+		return oc.WriteHeader(header)
+	}
+	return nil
+}
+
+// Expire every entry of the item in a region. Only the first of them, the one that lookups find, is counted in the
+// header, unless the item is hidden, by a live entry of it in the new table of a resize. Entries of the old table
+// are cleared as they are migrated, so there, as in findInOldTable, every lane is looked at.
+func (oc *OnChainCuckooTable) flushOneItemInRegion(
+	header *OnChainCuckooHeader,
+	region uint8,
+	capacity uint64,
+	itemKey CacheItemKey,
+	hidden bool,
+) (bool, error) { // whether the item was counted
+	counted := false
+	for lane := uint64(0); lane < NumLanes; lane++ {
+		slot := slotForLane(itemKey, lane, capacity)
+		cuckooItem, err := oc.readEntryInRegion(region, capacity, slot, lane)
+		if err != nil {
+			return false, err
+		}
+		if region == header.TableRegion && header.isDoubleExpired(cuckooItem.Generation) {
+			break
 		} else if cuckooItem.ItemKey == itemKey && cuckooItem.Generation != 0 {
-			cuckooItem.Generation = header.CurrentGeneration - 2
-			if err := oc.WriteTableEntry(slot, lane, cuckooItem); err != nil {
-				return err
+			if !hidden {
+				counted = header.isLive(cuckooItem.Generation)
+				header.countRemoval(cuckooItem.Generation)
+				hidden = true
+			}
+			cuckooItem.Generation = header.CurrentGeneration - header.NumLiveGenerations()
+			if err := oc.writeEntryInRegion(region, capacity, slot, lane, cuckooItem); err != nil {
+				return false, err
 			}
 		}
 	}
-	return nil
+	return counted, nil
 }
 
 func (oc *OnChainCuckooTable) advanceGenerationIfNeeded(header *OnChainCuckooHeader) bool {
 	modifiedHeader := false
-	for header.InCacheCount > header.Capacity || header.CurrentGenCount > 3*header.Capacity/4 {
+	currentGenLimit, inCacheLimit := header.generationLimits()
+	liveGenerations := header.NumLiveGenerations()
+	for header.InCacheCount > inCacheLimit || header.CurrentGenCount > currentGenLimit {
+		// the oldest live generation expires, and every other one gets a generation older
+		previous, expiring := header.countOfAge(1), header.countOfAge(liveGenerations-1)
+		if liveGenerations > 2 {
+			copy(header.OlderGenCounts[1:liveGenerations-2], header.OlderGenCounts[:liveGenerations-3])
+			header.OlderGenCounts[0] = previous
+		}
 		header.CurrentGeneration += 1
-		header.InCacheCount = header.CurrentGenCount
+		header.InCacheCount -= expiring
 		header.CurrentGenCount = 0
 		modifiedHeader = true
+		oc.metrics().IncCounter(cacheMetrics.GenerationAdvances, 1)
 	}
 	return modifiedHeader
 }
 
-const SliceSizeBytes = (LogMaxCacheSize + 7) / 8
+// Tables of up to LegacyMaxCacheSize take each lane's slot from its own slice of the item key, as they always have.
+// The item key has only enough bytes for that, so larger tables hash the item key separately for each lane.
+const LegacyMaxCacheSize = 1 << 16
+const SliceSizeBytes = 2
 
 func (header *OnChainCuckooHeader) getSlotForLane(itemKey CacheItemKey, lane uint64) uint64 {
+	return slotForLane(itemKey, lane, header.Capacity)
+}
+
+func slotForLane(itemKey CacheItemKey, lane uint64, capacity uint64) uint64 {
+	if capacity > LegacyMaxCacheSize {
+		h := crypto.Keccak256(itemKey[:], []byte{byte(lane)})
+		return binary.LittleEndian.Uint64(h[0:8]) % capacity
+	}
 	ret := uint64(0)
 	for i := lane * SliceSizeBytes; i < (lane+1)*SliceSizeBytes; i++ {
 		ret = (ret << 8) + uint64(itemKey[i])
 	}
-	return ret % header.Capacity
+	return ret % capacity
 }
 
 func (oc *OnChainCuckooTable) relocateItem(
 	cuckooItem CuckooItem,
 	triesSoFar uint64,
 	header *OnChainCuckooHeader,
+	discarded map[CacheItemKey]bool,
 ) error {
 	if triesSoFar >= NumLanes {
 		// we failed to find a place, even after several relocations, so just discard the item
 		// this should happen with negligible probability
-		if cuckooItem.Generation == header.CurrentGeneration {
-			header.CurrentGenCount -= 1
-			header.InCacheCount -= 1
-		} else if cuckooItem.Generation+1 == header.CurrentGeneration {
-			header.InCacheCount -= 1
+		if discarded != nil {
+			discarded[cuckooItem.ItemKey] = true
 		}
+		oc.metrics().IncCounter(cacheMetrics.DiscardedItems, 1)
+		oc.metrics().ObserveHistogram(cacheMetrics.RelocationDepth, int64(triesSoFar))
+		header.countRemoval(cuckooItem.Generation)
 	} else {
 		for lane := uint64(0); lane < NumLanes; lane++ {
 			slot := header.getSlotForLane(cuckooItem.ItemKey, lane)
-			thisItem, err := oc.ReadTableEntry(slot, lane)
+			thisItem, err := oc.ReadTableEntry(header, slot, lane)
 			if err != nil {
 				return err
 			}
 			if thisItem.ItemKey == cuckooItem.ItemKey {
 				if thisItem.Generation < cuckooItem.Generation {
-					if err := oc.WriteTableEntry(slot, lane, cuckooItem); err != nil {
+					if err := oc.WriteTableEntry(header, slot, lane, cuckooItem); err != nil {
 						return err
 					}
 				}
+				oc.countRelocation(triesSoFar)
 				return nil
-			} else if thisItem.Generation+1 < header.CurrentGeneration {
-				return oc.WriteTableEntry(slot, lane, cuckooItem)
+			} else if !header.isLive(thisItem.Generation) {
+				oc.countRelocation(triesSoFar)
+				return oc.WriteTableEntry(header, slot, lane, cuckooItem)
 			}
 		}
 
 		// we failed to find a place for the item, so relocate another item, recursively
 		slot := header.getSlotForLane(cuckooItem.ItemKey, triesSoFar)
-		displacedItem, err := oc.ReadTableEntry(slot, triesSoFar)
+		displacedItem, err := oc.ReadTableEntry(header, slot, triesSoFar)
 		if err != nil {
 			return err
 		}
-		if err := oc.WriteTableEntry(slot, triesSoFar, cuckooItem); err != nil {
+		if err := oc.WriteTableEntry(header, slot, triesSoFar, cuckooItem); err != nil {
 			return err
 		}
-		return oc.relocateItem(displacedItem, triesSoFar+1, header)
+		if triesSoFar > 0 {
+			oc.metrics().IncCounter(cacheMetrics.Relocations, 1)
+		}
+		return oc.relocateItem(displacedItem, triesSoFar+1, header, discarded)
 	}
 	return nil
 }
@@ -261,24 +639,115 @@ func ForAllOnChainCachedItems[Accumulator any](
 	cache *OnChainCuckooTable,
 	f func(key CacheItemKey, inLatestGeneration bool, t Accumulator) (Accumulator, error),
 	t Accumulator,
+) (Accumulator, error) {
+	return ForAllOnChainCachedItemsWithAge(
+		cache,
+		func(key CacheItemKey, age uint64, t Accumulator) (Accumulator, error) { return f(key, age == 0, t) },
+		t,
+	)
+}
+
+// Call f with every entry of the table, live or not, and the region, slot and lane it is in. During a resize, the
+// entries of the old table are visited after those of the new one. The header's counts aren't relied on, so this
+// works on a table that Check finds fault with, as long as its layout is sound.
+func ForAllTableEntries[Accumulator any](
+	cache *OnChainCuckooTable,
+	f func(region uint8, slot, lane uint64, item CuckooItem, t Accumulator) (Accumulator, error),
+	t Accumulator,
 ) (Accumulator, error) {
 	tt := t
-	header, err := cache.ReadHeader()
-	if err != nil {
-		return tt, err
-	}
-	for slot := uint64(0); slot < header.Capacity; slot++ {
+	err := cache.readOnly(func() error {
+		header, err := cache.ReadHeader()
+		if err != nil {
+			return err
+		}
+		if err := header.validateLayout(); err != nil {
+			return err
+		}
+		visitRegion := func(region uint8, capacity uint64) error {
+			for slot := uint64(0); slot < capacity; slot++ {
+				for lane := uint64(0); lane < NumLanes; lane++ {
+					item, err := cache.readEntryInRegion(region, capacity, slot, lane)
+					if err != nil {
+						return err
+					}
+					tt, err = f(region, slot, lane, item, tt)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if err := visitRegion(header.TableRegion, header.Capacity); err != nil || !header.Resizing {
+			return err
+		}
+		state, err := cache.readResizeState()
+		if err != nil {
+			return err
+		}
+		if state.OldCapacity == 0 || state.OldCapacity > MaxCacheSize {
+			return fmt.Errorf("%w: old capacity %d of the resize in progress", ErrCorruptHeader, state.OldCapacity)
+		}
+		return visitRegion(1-header.TableRegion, state.OldCapacity)
+	})
+	return tt, err
+}
+
+// Like ForAllOnChainCachedItems, but tells f how many generations before the current one each item was last
+// accessed, which can be more than one if the table has more than two live generations. An item from a later
+// generation than the current one, which Check reports as a violation, is treated as one from the current one.
+// Each item is visited once, for the entry of it that lookups find.
+func ForAllOnChainCachedItemsWithAge[Accumulator any](
+	cache *OnChainCuckooTable,
+	f func(key CacheItemKey, age uint64, t Accumulator) (Accumulator, error),
+	t Accumulator,
+) (Accumulator, error) {
+	tt := t
+	err := cache.atomically(func() error {
+		header, err := cache.readValidHeader()
+		if err != nil {
+			return err
+		}
+		tt, err = forAllCachedItemsInRegion(cache, &header, header.TableRegion, header.Capacity, f, tt)
+		if err != nil || !header.Resizing {
+			return err
+		}
+		state, err := cache.readResizeState()
+		if err != nil {
+			return err
+		}
+		tt, err = forAllCachedItemsInRegion(cache, &header, 1-header.TableRegion, state.OldCapacity, f, tt)
+		return err
+	})
+	return tt, err
+}
+
+func forAllCachedItemsInRegion[Accumulator any](
+	cache *OnChainCuckooTable,
+	header *OnChainCuckooHeader,
+	region uint8,
+	capacity uint64,
+	f func(key CacheItemKey, age uint64, t Accumulator) (Accumulator, error),
+	t Accumulator,
+) (Accumulator, error) {
+	tt := t
+	for slot := uint64(0); slot < capacity; slot++ {
 		for lane := uint64(0); lane < NumLanes; lane++ {
-			thisItem, err := cache.ReadTableEntry(slot, lane)
+			thisItem, err := cache.readEntryInRegion(region, capacity, slot, lane)
 			if err != nil {
 				return tt, err
 			}
-			if thisItem.Generation+1 >= header.CurrentGeneration {
-				tt, err = f(
-					thisItem.ItemKey,
-					thisItem.Generation == header.CurrentGeneration,
-					tt,
-				)
+			if header.isLive(thisItem.Generation) {
+				_, hidden, err := cache.hidingEntry(header, region, capacity, lane, thisItem.ItemKey)
+				if err != nil {
+					return tt, err
+				}
+				if hidden {
+					continue
+				}
+				age, _ := header.olderLiveAge(thisItem.Generation)
+				tt, err = f(thisItem.ItemKey, age, tt)
 				if err != nil {
 					return tt, err
 				}
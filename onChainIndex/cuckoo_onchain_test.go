@@ -8,6 +8,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/offchainlabs/cuckoocache/onChainStorage"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
 	"testing"
 )
 
@@ -100,9 +101,12 @@ func TestOnChainFlush(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, in, true)
 	assert.Nil(t, cache.FlushOneItem(keyFromUint64(42)))
+	header, err = cache.ReadHeader()
+	assert.Nil(t, err)
 	in, err = cache.IsInCache(&header, keyFromUint64(42))
 	assert.Nil(t, err)
 	assert.Equal(t, in, false)
+	verifyAccurateGenerationCounts(t, cache)
 
 	_, _, err = cache.AccessItem(keyFromUint64(42))
 	assert.Nil(t, err)
@@ -115,6 +119,159 @@ func TestOnChainFlush(t *testing.T) {
 	header, err = cache.ReadHeader()
 	assert.Nil(t, err)
 	assert.Equal(t, header.InCacheCount, uint64(0))
+
+	// an item with an older entry hidden behind its newer one is counted once, so flushing it uncounts it once
+	itemKey := collidingKey(7)
+	newer := CuckooItem{ItemKey: itemKey, Generation: header.CurrentGeneration}
+	assert.Nil(t, cache.WriteTableEntry(&header, header.getSlotForLane(itemKey, 0), 0, newer))
+	older := CuckooItem{ItemKey: itemKey, Generation: header.CurrentGeneration - 1}
+	assert.Nil(t, cache.WriteTableEntry(&header, header.getSlotForLane(itemKey, 1), 1, older))
+	header.InCacheCount, header.CurrentGenCount = 1, 1
+	assert.Nil(t, cache.WriteHeader(header))
+	verifyAccurateGenerationCounts(t, cache)
+	assert.Nil(t, cache.FlushOneItem(itemKey))
+	verifyAccurateGenerationCounts(t, cache)
+	header, err = cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header.InCacheCount, uint64(0))
+
+	// flushing an item frees its lane, but an item in a later lane of the same slot is still there
+	for i := uint64(0); i < 2; i++ {
+		_, _, err = cache.AccessItem(collidingKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, cache.FlushOneItem(collidingKey(0)))
+	hit, _, err := cache.AccessItem(collidingKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, hit, true)
+	verifyAccurateGenerationCounts(t, cache)
+	report, err := cache.Check()
+	assert.Nil(t, err)
+	assert.Equal(t, report.Violations, []Violation(nil))
+}
+
+func TestMoreLiveGenerations(t *testing.T) {
+	capacity := uint64(64)
+	params := GenerationParameters{CurrentGenThreshold: 250, LiveGenerations: 4}
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, cache.InitializeWithParameters(capacity, params))
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header.CurrentGeneration, uint64(8))
+
+	rng := rand.New(rand.NewSource(77))
+	seenAges := map[uint64]bool{}
+	for i := 0; i < 2000; i++ {
+		if i == 1000 {
+			assert.Nil(t, cache.StartResize(capacity/2))
+		}
+		if i > 1000 && i%10 == 0 {
+			_, err := cache.ContinueResize(40)
+			assert.Nil(t, err)
+		}
+		key := keyFromUint64(uint64(rng.ExpFloat64() * 60))
+		header, err := cache.ReadHeader()
+		assert.Nil(t, err)
+		query, err := cache.Query(key)
+		assert.Nil(t, err)
+		hit, _, err := cache.AccessItem(key)
+		assert.Nil(t, err)
+		// lookups that stop early never miss a live item
+		assert.Equal(t, hit, query.Hit)
+		if hit {
+			seenAges[header.CurrentGeneration-query.Generation] = true
+		}
+		header, err = cache.ReadHeader()
+		assert.Nil(t, err)
+		in, err := cache.IsInCache(&header, key)
+		assert.Nil(t, err)
+		assert.Equal(t, in, true)
+
+		if rng.Intn(50) == 0 {
+			assert.Nil(t, cache.FlushOneItem(key))
+			in, err = cache.IsInCache(&header, key)
+			assert.Nil(t, err)
+			assert.Equal(t, in, false)
+		}
+		if i%100 == 0 {
+			verifyAccurateGenerationCounts(t, cache)
+			report, err := cache.Check()
+			assert.Nil(t, err)
+			assert.Equal(t, report.OK(), true)
+		}
+	}
+	// items are hits in every live generation, and no older one
+	assert.Equal(t, seenAges, map[uint64]bool{0: true, 1: true, 2: true, 3: true})
+
+	assert.Nil(t, cache.FlushAll())
+	count, err := countCachedItems(cache)
+	assert.Nil(t, err)
+	assert.Equal(t, count, uint64(0))
+	verifyAccurateGenerationCounts(t, cache)
+	report, err := cache.Check()
+	assert.Nil(t, err)
+	assert.Equal(t, report.OK(), true)
+}
+
+func TestLargeCapacity(t *testing.T) {
+	capacity := uint64(3_000_017)
+	storage := onChainStorage.NewMockOnChainStorage()
+	cache := OpenOnChainCuckooTable(storage, capacity)
+	assert.ErrorIs(t, cache.Initialize(0), ErrInvalidCapacity)
+	assert.ErrorIs(t, cache.Initialize(MaxCacheSize+1), ErrInvalidCapacity)
+	assert.Nil(t, cache.Initialize(capacity))
+
+	for i := uint64(0); i < 5000; i++ {
+		hit, _, err := cache.AccessItem(keyFromUint64(i))
+		assert.Nil(t, err)
+		assert.Equal(t, hit, false)
+	}
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header.Capacity, capacity)
+	assert.Equal(t, header.InCacheCount, uint64(5000))
+	for i := uint64(0); i < 5000; i++ {
+		in, err := cache.IsInCache(&header, keyFromUint64(i))
+		assert.Nil(t, err)
+		assert.Equal(t, in, true)
+		hit, _, err := cache.AccessItem(keyFromUint64(i))
+		assert.Nil(t, err)
+		assert.Equal(t, hit, true)
+	}
+}
+
+func TestLaneDistribution(t *testing.T) {
+	numKeys := uint64(20000)
+	numBins := uint64(16)
+	keys := make([]CacheItemKey, numKeys)
+	for i := range keys {
+		keys[i] = keyFromUint64(uint64(i))
+	}
+	for _, capacity := range []uint64{1000, LegacyMaxCacheSize, LegacyMaxCacheSize + 1, 3_000_017, MaxCacheSize} {
+		for lane := uint64(0); lane < NumLanes; lane++ {
+			bins := make([]uint64, numBins)
+			sameAsPreviousLane := uint64(0)
+			for _, key := range keys {
+				slot := slotForLane(key, lane, capacity)
+				assert.Less(t, slot, capacity)
+				bins[slot*numBins/capacity]++
+				if lane > 0 && slot == slotForLane(key, lane-1, capacity) {
+					sameAsPreviousLane++
+				}
+			}
+			// each bin should be within 15% of its expected count, which is about five standard deviations
+			expected := numKeys / numBins
+			for _, count := range bins {
+				assert.InDelta(t, expected, count, float64(expected)*0.15, "capacity %d lane %d", capacity, lane)
+			}
+			// lanes should be independent
+			assert.LessOrEqual(t, sameAsPreviousLane, 5+2*numKeys/capacity)
+		}
+	}
+
+	// small tables keep the slots they have always had
+	key := keyFromUint64(17)
+	assert.Equal(t, slotForLane(key, 3, 1000), (uint64(key[6])<<8+uint64(key[7]))%1000)
 }
 
 func keyFromUint64(key uint64) CacheItemKey {
@@ -176,4 +333,16 @@ func verifyAccurateGenerationCounts(t *testing.T, cache *OnChainCuckooTable) {
 	)
 	assert.Nil(t, err)
 	assert.Equal(t, manualBothGensCount, header.InCacheCount)
+	countsByAge, err := ForAllOnChainCachedItemsWithAge(
+		cache,
+		func(key CacheItemKey, age uint64, soFar []uint64) ([]uint64, error) {
+			soFar[age]++
+			return soFar, nil
+		},
+		make([]uint64, header.NumLiveGenerations()),
+	)
+	assert.Nil(t, err)
+	for age, count := range countsByAge {
+		assert.Equal(t, count, header.countOfAge(uint64(age)))
+	}
 }
@@ -0,0 +1,82 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrStorage wraps an error returned by the underlying OnChainStorage.
+	ErrStorage = errors.New("on-chain cache storage error")
+	// ErrUninitialized is returned by operations on a table whose header has never been written.
+	ErrUninitialized = errors.New("on-chain cache is not initialized")
+	// ErrCorruptHeader is returned when the header in storage can't be decoded or is inconsistent.
+	ErrCorruptHeader = errors.New("on-chain cache header is corrupt")
+)
+
+func storageError(err error) error {
+	return fmt.Errorf("%w: %w", ErrStorage, err)
+}
+
+// Read the header and check that it belongs to an initialized, consistent table. Every operation on the table
+// starts with this, so none of them divides by a zero capacity or trusts counts that can't be right.
+func (oc *OnChainCuckooTable) readValidHeader() (OnChainCuckooHeader, error) {
+	header, err := oc.ReadHeader()
+	if err != nil {
+		return header, err
+	}
+	return header, header.validate()
+}
+
+func (header *OnChainCuckooHeader) validate() error {
+	if err := header.validateLayout(); err != nil {
+		return err
+	}
+	if header.InCacheCount > header.Capacity || header.CurrentGenCount > header.InCacheCount {
+		return fmt.Errorf(
+			"%w: counts %d (current generation) and %d (in cache) don't fit capacity %d",
+			ErrCorruptHeader,
+			header.CurrentGenCount,
+			header.InCacheCount,
+			header.Capacity,
+		)
+	}
+	olderCount := uint64(0)
+	for _, count := range header.OlderGenCounts {
+		olderCount += count
+	}
+	if olderCount > header.InCacheCount-header.CurrentGenCount {
+		return fmt.Errorf(
+			"%w: counts %d (older generations) and %d (current generation) exceed %d (in cache)",
+			ErrCorruptHeader,
+			olderCount,
+			header.CurrentGenCount,
+			header.InCacheCount,
+		)
+	}
+	return nil
+}
+
+// Check the parts of the header that say where the table is and how it advances generations, leaving out the
+// counts, which Repair can recompute.
+func (header *OnChainCuckooHeader) validateLayout() error {
+	if header.Capacity == 0 {
+		if *header == (OnChainCuckooHeader{}) {
+			return ErrUninitialized
+		}
+		return fmt.Errorf("%w: zero capacity", ErrCorruptHeader)
+	}
+	if header.Capacity > MaxCacheSize {
+		return fmt.Errorf("%w: capacity %d is too large", ErrCorruptHeader, header.Capacity)
+	}
+	if err := header.GenerationParameters.validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrCorruptHeader, err)
+	}
+	if header.CurrentGeneration < header.initialGeneration() {
+		return fmt.Errorf("%w: generation %d is below the initial generation", ErrCorruptHeader, header.CurrentGeneration)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUninitializedTable(t *testing.T) {
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), 32)
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+
+	_, err = cache.IsInCache(&header, keyFromUint64(1))
+	assert.ErrorIs(t, err, ErrUninitialized)
+	_, _, err = cache.AccessItem(keyFromUint64(1))
+	assert.ErrorIs(t, err, ErrUninitialized)
+	assert.ErrorIs(t, cache.FlushAll(), ErrUninitialized)
+	assert.ErrorIs(t, cache.FlushOneItem(keyFromUint64(1)), ErrUninitialized)
+	assert.ErrorIs(t, cache.StartResize(64), ErrUninitialized)
+	_, err = cache.ContinueResize(10)
+	assert.ErrorIs(t, err, ErrUninitialized)
+	assert.ErrorIs(t, cache.Resize(64), ErrUninitialized)
+	assert.ErrorIs(t, cache.Migrate(), ErrUninitialized)
+	_, err = countCachedItems(cache)
+	assert.ErrorIs(t, err, ErrUninitialized)
+
+	// nothing was written by the failed operations
+	header, err = cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header, OnChainCuckooHeader{})
+}
+
+func TestCorruptHeader(t *testing.T) {
+	for _, badHeader := range []OnChainCuckooHeader{
+		{Version: CurrentHeaderVersion, CurrentGeneration: 3},
+		{Version: CurrentHeaderVersion, Capacity: 32, CurrentGeneration: 0},
+		{Version: CurrentHeaderVersion, Capacity: 32, CurrentGeneration: 3, InCacheCount: 33, CurrentGenCount: 10},
+		{Version: CurrentHeaderVersion, Capacity: 32, CurrentGeneration: 3, InCacheCount: 10, CurrentGenCount: 11},
+		{Version: LegacyHeaderVersion, Capacity: MaxCacheSize + 1, CurrentGeneration: 3},
+		{Version: CurrentHeaderVersion, Capacity: 32, CurrentGeneration: 3, GenerationParameters: GenerationParameters{InCacheThreshold: 1001}},
+		{Version: CurrentHeaderVersion, Capacity: 32, CurrentGeneration: 3, GenerationParameters: GenerationParameters{CurrentGenThreshold: 600, InCacheThreshold: 500}},
+		{Version: CurrentHeaderVersion, Capacity: 32, CurrentGeneration: 30, GenerationParameters: GenerationParameters{LiveGenerations: MaxLiveGenerations + 1}},
+		{Version: CurrentHeaderVersion, Capacity: 32, CurrentGeneration: 7, GenerationParameters: GenerationParameters{LiveGenerations: 4}},
+		{
+			Version:              CurrentHeaderVersion,
+			Capacity:             32,
+			CurrentGeneration:    10,
+			CurrentGenCount:      5,
+			InCacheCount:         10,
+			GenerationParameters: GenerationParameters{LiveGenerations: 3},
+			OlderGenCounts:       [MaxLiveGenerations - 2]uint64{6},
+		},
+	} {
+		cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), 32)
+		assert.Nil(t, cache.WriteHeader(badHeader))
+		_, _, err := cache.AccessItem(keyFromUint64(1))
+		assert.ErrorIs(t, err, ErrCorruptHeader)
+		assert.ErrorIs(t, cache.FlushAll(), ErrCorruptHeader)
+		_, err = cache.IsInCache(&badHeader, keyFromUint64(1))
+		assert.ErrorIs(t, err, ErrCorruptHeader)
+	}
+
+	storage := onChainStorage.NewMockOnChainStorage()
+	cache := OpenOnChainCuckooTable(storage, 32)
+	assert.Nil(t, cache.Initialize(32))
+	buf, err := storage.NewSlot(0).Get()
+	assert.Nil(t, err)
+	buf[4] = CurrentHeaderVersion + 1
+	assert.Nil(t, storage.NewSlot(0).Set(buf))
+	_, err = cache.ReadHeader()
+	assert.ErrorIs(t, err, ErrCorruptHeader)
+	assert.ErrorIs(t, err, ErrUnknownHeaderVersion)
+	_, _, err = cache.AccessItem(keyFromUint64(1))
+	assert.ErrorIs(t, err, ErrCorruptHeader)
+}
+
+func TestStorageFailures(t *testing.T) {
+	capacity := uint64(32)
+	storage := onChainStorage.NewFaultyOnChainStorage(onChainStorage.NewMockOnChainStorage(), nil)
+	cache := OpenOnChainCuckooTable(storage, capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	assert.Nil(t, sprayOnChainCache(cache, 43112))
+
+	// fail each storage access of an operation in turn, until the operation gets through without failing
+	operations := map[string]func() error{
+		"AccessItem": func() error {
+			_, _, err := cache.AccessItem(keyFromUint64(77))
+			return err
+		},
+		"FlushOneItem": func() error { return cache.FlushOneItem(keyFromUint64(5003)) },
+		"ForAll": func() error {
+			_, err := countCachedItems(cache)
+			return err
+		},
+		"Resize": func() error {
+			if err := cache.Resize(capacity); err != nil && !errors.Is(err, ErrResizeInProgress) {
+				return err
+			}
+			_, err := cache.ContinueResize(1000)
+			return err
+		},
+	}
+	for name, operation := range operations {
+		for n := uint64(0); ; n++ {
+			storage.SetFault(onChainStorage.FailNthAccess(n))
+			err := operation()
+			if err == nil {
+				break
+			}
+			assert.ErrorIs(t, err, ErrStorage, name)
+			assert.ErrorIs(t, err, onChainStorage.ErrInjectedFault, name)
+		}
+	}
+	// a failed operation can leave its writes half done, but never a header that can't be used
+	storage.SetFault(nil)
+	_, err := cache.readValidHeader()
+	assert.Nil(t, err)
+}
+
+func TestFailedOperationsLeaveStorageUnchanged(t *testing.T) {
+	capacity := uint64(8)
+	mock := onChainStorage.NewMockOnChainStorage().(*onChainStorage.MockOnChainStorage)
+	storage := onChainStorage.NewFaultyOnChainStorage(mock, nil)
+	cache := OpenOnChainCuckooTable(storage, capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	for i := uint64(0); i < capacity; i++ {
+		_, _, err := cache.AccessItem(collidingKey(i))
+		assert.Nil(t, err)
+	}
+
+	operations := map[string]func() error{
+		"AccessItem": func() error {
+			_, _, err := cache.AccessItem(keyFromUint64(77))
+			return err
+		},
+		"AccessItemWithRelocation": func() error {
+			_, _, err := cache.AccessItem(collidingKey(capacity))
+			return err
+		},
+		"FlushOneItem": func() error { return cache.FlushOneItem(collidingKey(3)) },
+		"FlushAll":     cache.FlushAll,
+		"Resize":       func() error { return cache.Resize(2 * capacity) },
+	}
+	for name, operation := range operations {
+		for n := uint64(0); ; n++ {
+			before := mock.Snapshot()
+			storage.SetFault(onChainStorage.FailNthAccess(n))
+			err := operation()
+			if err == nil {
+				break
+			}
+			assert.ErrorIs(t, err, onChainStorage.ErrInjectedFault, name)
+			// a failed operation leaves storage as it was, even if it failed while committing its writes
+			assert.Equal(t, mock.Snapshot(), before, name)
+		}
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	capacity := uint64(8)
+	recorder := onChainStorage.NewRecordingOnChainStorage(onChainStorage.NewMockOnChainStorage())
+	cache := OpenOnChainCuckooTable(recorder, capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+
+	// these keys have the same slot in every lane, so accessing more of them than fit makes the table relocate items
+	type operation struct {
+		key    CacheItemKey
+		access bool // otherwise flush
+	}
+	operations := []operation{}
+	for i := uint64(0); i < 3*capacity; i++ {
+		operations = append(operations, operation{collidingKey(i), true})
+		if i%5 == 4 {
+			operations = append(operations, operation{collidingKey(i - 2), false})
+		}
+	}
+	for _, op := range operations {
+		liveBefore := liveItems(t, cache)
+		start := len(recorder.Trace())
+		if op.access {
+			_, _, err := cache.AccessItem(op.key)
+			assert.Nil(t, err)
+		} else {
+			assert.Nil(t, cache.FlushOneItem(op.key))
+		}
+		trace := recorder.Trace()
+
+		// after a crash partway through the operation's writes, nothing that wasn't alive before is alive,
+		// except the item being accessed
+		for end := start; end < len(trace); end++ {
+			if !trace[end].IsWrite {
+				continue
+			}
+			crashed := onChainStorage.NewMockOnChainStorage()
+			assert.Nil(t, onChainStorage.ApplyTrace(crashed, trace[:end]))
+			crashedCache := OpenOnChainCuckooTable(crashed, capacity)
+			_, err := crashedCache.readValidHeader()
+			assert.Nil(t, err)
+			for key := range liveItems(t, crashedCache) {
+				_, wasLive := liveBefore[key]
+				assert.True(t, wasLive || (op.access && key == op.key))
+			}
+		}
+
+		// the operation makes the same accesses when it is repeated on the same state
+		replayer := onChainStorage.NewReplayingOnChainStorage(trace[start:])
+		replayCache := OpenOnChainCuckooTable(replayer, capacity)
+		if op.access {
+			_, _, err := replayCache.AccessItem(op.key)
+			assert.Nil(t, err)
+		} else {
+			assert.Nil(t, replayCache.FlushOneItem(op.key))
+		}
+		assert.True(t, replayer.Done())
+		verifyAccurateGenerationCounts(t, cache)
+	}
+}
+
+// keys that differ only beyond the bytes that legacy-sized tables use to pick slots
+func collidingKey(i uint64) CacheItemKey {
+	key := CacheItemKey{}
+	binary.LittleEndian.PutUint64(key[NumLanes*SliceSizeBytes:], i+1)
+	return key
+}
@@ -0,0 +1,100 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// The storage accesses made by one operation on the table, classified the way EIP-2929 and EIP-2200 price them,
+// and what they cost under the table's gas schedule.
+type OperationCost struct {
+	ColdReads    uint64 // reads of slots not yet in the access list
+	WarmReads    uint64 // reads of slots already in the access list
+	SetWrites    uint64 // writes that make a slot nonzero, when it was zero and unmodified in the transaction
+	ResetWrites  uint64 // other writes that change a slot that is unmodified in the transaction
+	WarmWrites   uint64 // writes that don't change a slot, or change a slot already modified in the transaction
+	ClearedSlots uint64 // writes that zero a slot that was nonzero and unmodified in the transaction
+	Gas          uint64
+	Refund       uint64
+}
+
+// A GasSchedule prices the storage accesses of an operation.
+type GasSchedule interface {
+	Gas(cost OperationCost) (gas uint64, refund uint64)
+}
+
+// EIP2929GasSchedule prices storage accesses as the EVM does since the Berlin and London upgrades.
+// Writes don't pay for cold access, because the table always reads a slot before writing it.
+type EIP2929GasSchedule struct{}
+
+func (EIP2929GasSchedule) Gas(cost OperationCost) (uint64, uint64) {
+	gas := cost.ColdReads*params.ColdSloadCostEIP2929 +
+		cost.WarmReads*params.WarmStorageReadCostEIP2929 +
+		cost.SetWrites*params.SstoreSetGasEIP2200 +
+		cost.ResetWrites*(params.SstoreResetGasEIP2200-params.ColdSloadCostEIP2929) +
+		cost.WarmWrites*params.WarmStorageReadCostEIP2929
+	return gas, cost.ClearedSlots * params.SstoreClearsScheduleRefundEIP3529
+}
+
+func (oc *OnChainCuckooTable) SetGasSchedule(schedule GasSchedule) {
+	oc.gasSchedule = schedule
+}
+
+// The cost of the latest operation on the table: AccessItem, IsInCache, FlushOneItem, FlushAll, a resize,
+// Migrate or ForAllOnChainCachedItems.
+func (oc *OnChainCuckooTable) LastOperationCost() OperationCost {
+	return oc.lastCost
+}
+
+// Start a new transaction, as far as the cost of accesses is concerned: every slot becomes cold and unmodified, and
+// stays warm for later operations once accessed, until the next call to ResetAccessList or EndTransaction. Until
+// this is called, each operation is priced as a transaction of its own.
+func (oc *OnChainCuckooTable) ResetAccessList() {
+	oc.accessList = newAccessList()
+	oc.transaction = true
+}
+
+// End the transaction started by ResetAccessList, so that each operation is priced as a transaction of its own
+// again, and the slots accessed in the transaction are forgotten.
+func (oc *OnChainCuckooTable) EndTransaction() {
+	oc.accessList = newAccessList()
+	oc.transaction = false
+}
+
+// The slots accessed in the current transaction, and their values when first accessed in it.
+type accessList struct {
+	originals map[uint64]common.Hash
+}
+
+func newAccessList() accessList {
+	return accessList{originals: make(map[uint64]common.Hash)}
+}
+
+// Note that a slot with the given value has been read, and report whether that was a cold access.
+func (al accessList) touch(offset uint64, value common.Hash) bool {
+	if _, warm := al.originals[offset]; warm {
+		return false
+	}
+	al.originals[offset] = value
+	return true
+}
+
+// Classify a write of a slot, which has been read already, from current to value.
+func (al accessList) accountForWrite(cost *OperationCost, offset uint64, current, value common.Hash) {
+	original := al.originals[offset]
+	if value == current || original != current {
+		cost.WarmWrites++
+		return
+	}
+	if original == (common.Hash{}) {
+		cost.SetWrites++
+	} else {
+		cost.ResetWrites++
+		if value == (common.Hash{}) {
+			cost.ClearedSlots++
+		}
+	}
+}
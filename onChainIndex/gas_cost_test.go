@@ -0,0 +1,152 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOperationCosts(t *testing.T) {
+	capacity := uint64(32)
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{
+		ColdReads: 1,
+		SetWrites: 1,
+		Gas:       params.ColdSloadCostEIP2929 + params.SstoreSetGasEIP2200,
+	})
+
+	// a miss reads the header and the first two lanes, and writes the first lane and the header
+	cache.ResetAccessList()
+	_, _, err := cache.AccessItem(collidingKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{
+		ColdReads:   3,
+		SetWrites:   1,
+		ResetWrites: 1,
+		Gas: 3*params.ColdSloadCostEIP2929 + params.SstoreSetGasEIP2200 +
+			params.SstoreResetGasEIP2200 - params.ColdSloadCostEIP2929,
+	})
+
+	// the slots read so far are warm for the rest of the transaction, and the header has been modified in it
+	_, _, err = cache.AccessItem(collidingKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{
+		ColdReads:  1,
+		WarmReads:  3,
+		SetWrites:  1,
+		WarmWrites: 1,
+		Gas: params.ColdSloadCostEIP2929 + 3*params.WarmStorageReadCostEIP2929 + params.SstoreSetGasEIP2200 +
+			params.WarmStorageReadCostEIP2929,
+	})
+
+	// a hit in the current generation writes nothing
+	cache.ResetAccessList()
+	hit, _, err := cache.AccessItem(collidingKey(0))
+	assert.Nil(t, err)
+	assert.True(t, hit)
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{ColdReads: 2, Gas: 2 * params.ColdSloadCostEIP2929})
+
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	in, err := cache.IsInCache(&header, collidingKey(1))
+	assert.Nil(t, err)
+	assert.True(t, in)
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{
+		ColdReads: 1,
+		WarmReads: 1,
+		Gas:       params.ColdSloadCostEIP2929 + params.WarmStorageReadCostEIP2929,
+	})
+
+	// flushing an item rewrites its entry in place, and the header's counts
+	cache.ResetAccessList()
+	assert.Nil(t, cache.FlushOneItem(collidingKey(0)))
+	assert.Equal(t, cache.LastOperationCost().ResetWrites, uint64(2))
+	assert.Nil(t, cache.FlushAll())
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{
+		WarmReads:  1,
+		WarmWrites: 1,
+		Gas:        2 * params.WarmStorageReadCostEIP2929,
+	})
+	cache.ResetAccessList()
+	assert.Nil(t, cache.FlushAll())
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{
+		ColdReads:   1,
+		ResetWrites: 1,
+		Gas:         params.SstoreResetGasEIP2200,
+	})
+
+	// a failed operation still costs what it read
+	cache.SetGasSchedule(flatGasSchedule{})
+	cache.ResetAccessList()
+	assert.ErrorIs(t, cache.StartResize(0), ErrInvalidCapacity)
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{ColdReads: 1, Gas: 1})
+}
+
+func TestClearedSlotRefund(t *testing.T) {
+	capacity := uint64(32)
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Nil(t, cache.WriteTableEntry(&header, 0, 0, CuckooItem{ItemKey: collidingKey(0), Generation: 1}))
+
+	cache.ResetAccessList()
+	assert.Nil(t, cache.atomically(func() error {
+		if _, err := cache.ReadTableEntry(&header, 0, 0); err != nil {
+			return err
+		}
+		return cache.WriteTableEntry(&header, 0, 0, CuckooItem{})
+	}))
+	assert.Equal(t, cache.LastOperationCost(), OperationCost{
+		ColdReads:    1,
+		ResetWrites:  1,
+		ClearedSlots: 1,
+		Gas:          params.ColdSloadCostEIP2929 + params.SstoreResetGasEIP2200 - params.ColdSloadCostEIP2929,
+		Refund:       params.SstoreClearsScheduleRefundEIP3529,
+	})
+}
+
+// charges one gas per storage access
+type flatGasSchedule struct{}
+
+func (flatGasSchedule) Gas(cost OperationCost) (uint64, uint64) {
+	return cost.ColdReads + cost.WarmReads + cost.SetWrites + cost.ResetWrites + cost.WarmWrites, 0
+}
+
+func TestAccessListScope(t *testing.T) {
+	capacity := uint64(32)
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	_, _, err := cache.AccessItem(collidingKey(0))
+	assert.Nil(t, err)
+
+	// outside a transaction, every operation starts with every slot cold
+	hitCost := func() OperationCost {
+		hit, _, err := cache.AccessItem(collidingKey(0))
+		assert.Nil(t, err)
+		assert.True(t, hit)
+		return cache.LastOperationCost()
+	}
+	cold := OperationCost{ColdReads: 2, Gas: 2 * params.ColdSloadCostEIP2929}
+	warm := OperationCost{WarmReads: 2, Gas: 2 * params.WarmStorageReadCostEIP2929}
+	assert.Equal(t, hitCost(), cold)
+	assert.Equal(t, hitCost(), cold)
+	cache.ResetAccessList()
+	assert.Equal(t, hitCost(), cold)
+	assert.Equal(t, hitCost(), warm)
+	cache.EndTransaction()
+	assert.Equal(t, hitCost(), cold)
+
+	// the second item reads the three lanes that the first one read, all warm, though one of them now holds the
+	// first item's staged write, and then one more lane
+	_, err = cache.AccessItems([]CacheItemKey{collidingKey(1), collidingKey(2)})
+	assert.Nil(t, err)
+	cost := cache.LastOperationCost()
+	assert.Equal(t, cost.ColdReads, uint64(5))
+	assert.Equal(t, cost.WarmReads, uint64(3))
+}
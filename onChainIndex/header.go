@@ -0,0 +1,188 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"math"
+)
+
+// Header format versions. The legacy format has no version field, so it is version zero.
+const (
+	LegacyHeaderVersion  = 0
+	HeaderVersion1       = 1
+	HeaderVersion2       = 2
+	CurrentHeaderVersion = HeaderVersion2
+)
+
+var ErrUnknownHeaderVersion = fmt.Errorf("%w: unknown version", ErrCorruptHeader)
+var ErrUnrepresentableHeader = errors.New("on-chain cache header can't be written in its version's format")
+
+// Versioned headers start with this magic number. A legacy header starts with its capacity as a little-endian
+// uint64, which is at most MaxCacheSize, so its fourth byte can't be the magic number's fourth byte.
+var headerMagic = [4]byte{'C', 'K', 'O', 'O'}
+
+// The legacy format is four little-endian uint64s: capacity, current generation, current generation count and
+// in-cache count. The capacity is at most MaxCacheSize, so the top byte of its word holds the flags.
+const legacyCapacityMask = (1 << 56) - 1
+
+// Version 1 format:
+//
+//	[0:4]   magic
+//	[4]     version
+//	[5]     flags
+//	[6:8]   reserved
+//	[8:12]  capacity, uint32
+//	[12:20] current generation, uint64
+//	[20:24] current generation count, uint32
+//	[24:28] in-cache count, uint32
+//	[28:32] reserved
+//
+// Version 2 format is the version 1 format, with the generation parameters in reserved bytes:
+//
+//	[6:8]   current generation threshold, uint16
+//	[28:30] in-cache threshold, uint16
+//	[30]    live generations
+//	[31]    reserved
+//
+// Earlier formats have no generation parameters, so they always use the defaults. With more than two live
+// generations, the counts of the older generations, OlderGenCounts, are in a slot of their own, as uint32s in
+// order from generation CurrentGeneration-2 back; only as many as there are older live generations are used.
+//
+// In every format, the flags are:
+const headerFlagTableRegion = 1
+const headerFlagResizing = 2
+
+func (header *OnChainCuckooHeader) flags() uint8 {
+	flags := header.TableRegion & headerFlagTableRegion
+	if header.Resizing {
+		flags |= headerFlagResizing
+	}
+	return flags
+}
+
+func (header *OnChainCuckooHeader) setFlags(flags uint8) {
+	header.TableRegion = flags & headerFlagTableRegion
+	header.Resizing = flags&headerFlagResizing != 0
+}
+
+func decodeHeader(buf common.Hash) (OnChainCuckooHeader, error) {
+	if [4]byte(buf[0:4]) != headerMagic {
+		capacityWord := binary.LittleEndian.Uint64(buf[0:8])
+		header := OnChainCuckooHeader{
+			Version:           LegacyHeaderVersion,
+			Capacity:          capacityWord & legacyCapacityMask,
+			CurrentGeneration: binary.LittleEndian.Uint64(buf[8:16]),
+			CurrentGenCount:   binary.LittleEndian.Uint64(buf[16:24]),
+			InCacheCount:      binary.LittleEndian.Uint64(buf[24:32]),
+		}
+		header.setFlags(uint8(capacityWord >> 56))
+		return header, nil
+	}
+	switch buf[4] {
+	case HeaderVersion1, HeaderVersion2:
+		header := OnChainCuckooHeader{
+			Version:           buf[4],
+			Capacity:          uint64(binary.LittleEndian.Uint32(buf[8:12])),
+			CurrentGeneration: binary.LittleEndian.Uint64(buf[12:20]),
+			CurrentGenCount:   uint64(binary.LittleEndian.Uint32(buf[20:24])),
+			InCacheCount:      uint64(binary.LittleEndian.Uint32(buf[24:28])),
+		}
+		header.setFlags(buf[5])
+		if header.Version >= HeaderVersion2 {
+			header.CurrentGenThreshold = binary.LittleEndian.Uint16(buf[6:8])
+			header.InCacheThreshold = binary.LittleEndian.Uint16(buf[28:30])
+			header.LiveGenerations = buf[30]
+		}
+		return header, nil
+	default:
+		return OnChainCuckooHeader{}, ErrUnknownHeaderVersion
+	}
+}
+
+func encodeHeader(header OnChainCuckooHeader) (common.Hash, error) {
+	if header.Version < HeaderVersion2 && header.GenerationParameters != (GenerationParameters{}) {
+		return common.Hash{}, fmt.Errorf("%w: version %d has no generation parameters", ErrUnrepresentableHeader, header.Version)
+	}
+	switch header.Version {
+	case LegacyHeaderVersion:
+		return common.BytesToHash(
+			binary.LittleEndian.AppendUint64(
+				binary.LittleEndian.AppendUint64(
+					binary.LittleEndian.AppendUint64(
+						binary.LittleEndian.AppendUint64(
+							[]byte{},
+							(header.Capacity&legacyCapacityMask)|(uint64(header.flags())<<56),
+						),
+						header.CurrentGeneration,
+					),
+					header.CurrentGenCount,
+				),
+				header.InCacheCount,
+			),
+		), nil
+	case HeaderVersion1, HeaderVersion2:
+		if header.Capacity > math.MaxUint32 || header.CurrentGenCount > math.MaxUint32 || header.InCacheCount > math.MaxUint32 {
+			return common.Hash{}, ErrInvalidCapacity
+		}
+		buf := append(headerMagic[:], header.Version, header.flags())
+		buf = binary.LittleEndian.AppendUint16(buf, header.CurrentGenThreshold)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(header.Capacity))
+		buf = binary.LittleEndian.AppendUint64(buf, header.CurrentGeneration)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(header.CurrentGenCount))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(header.InCacheCount))
+		buf = binary.LittleEndian.AppendUint16(buf, header.InCacheThreshold)
+		buf = append(buf, header.LiveGenerations, 0)
+		return common.BytesToHash(buf), nil
+	default:
+		return common.Hash{}, ErrUnknownHeaderVersion
+	}
+}
+
+// The number of older generation counts that are stored, which is zero unless there are more than two live
+// generations. A corrupt header might have too many live generations; validating it will reject it.
+func (header *OnChainCuckooHeader) numOlderGenCounts() uint64 {
+	return min(header.NumLiveGenerations(), MaxLiveGenerations) - min(header.NumLiveGenerations(), 2)
+}
+
+func decodeOlderGenCounts(header *OnChainCuckooHeader, buf common.Hash) {
+	for i := uint64(0); i < header.numOlderGenCounts(); i++ {
+		header.OlderGenCounts[i] = uint64(binary.LittleEndian.Uint32(buf[4*i : 4*i+4]))
+	}
+}
+
+func encodeOlderGenCounts(header OnChainCuckooHeader) (common.Hash, error) {
+	buf := []byte{}
+	for i := uint64(0); i < header.numOlderGenCounts(); i++ {
+		if header.OlderGenCounts[i] > math.MaxUint32 {
+			return common.Hash{}, ErrInvalidCapacity
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(header.OlderGenCounts[i]))
+	}
+	return common.BytesToHash(append(buf, make([]byte, 32-len(buf))...)), nil
+}
+
+// Rewrite the header in the current format, if it isn't in that format already.
+//
+// Operations on the table preserve the format of its header, so a table whose header is in an older format keeps
+// working unchanged until this is called. Since the header is part of consensus state, the caller is responsible
+// for calling this at a point that all nodes agree on, such as a chain upgrade.
+func (oc *OnChainCuckooTable) Migrate() error {
+	return oc.atomically(oc.migrate)
+}
+
+func (oc *OnChainCuckooTable) migrate() error {
+	header, err := oc.readValidHeader()
+	if err != nil {
+		return err
+	}
+	if header.Version == CurrentHeaderVersion {
+		return nil
+	}
+	header.Version = CurrentHeaderVersion
+	return oc.WriteHeader(header)
+}
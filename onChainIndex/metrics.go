@@ -0,0 +1,40 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"github.com/offchainlabs/cuckoocache/cacheMetrics"
+)
+
+// Report the table's metrics to sink. The metrics of an operation are reported only if it succeeds.
+func (oc *OnChainCuckooTable) SetMetricsSink(sink cacheMetrics.Sink) {
+	oc.metricsSink = sink
+}
+
+func (oc *OnChainCuckooTable) metrics() cacheMetrics.Sink {
+	if oc.batch != nil {
+		if oc.batch.metrics == nil {
+			return cacheMetrics.NoopSink{}
+		}
+		return oc.batch.metrics
+	}
+	return oc.metricsSink
+}
+
+func (oc *OnChainCuckooTable) countAccess(hit bool) {
+	if hit {
+		oc.metrics().IncCounter(cacheMetrics.OnChainHits, 1)
+	} else {
+		oc.metrics().IncCounter(cacheMetrics.OnChainMisses, 1)
+	}
+}
+
+// An item that was displaced from its lane (triesSoFar > 0) has found a new place, at the end of a chain of
+// triesSoFar relocations.
+func (oc *OnChainCuckooTable) countRelocation(triesSoFar uint64) {
+	if triesSoFar > 0 {
+		oc.metrics().IncCounter(cacheMetrics.Relocations, 1)
+		oc.metrics().ObserveHistogram(cacheMetrics.RelocationDepth, int64(triesSoFar))
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"github.com/offchainlabs/cuckoocache/cacheMetrics"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOnChainMetrics(t *testing.T) {
+	capacity := uint64(8)
+	storage := onChainStorage.NewFaultyOnChainStorage(onChainStorage.NewMockOnChainStorage(), nil)
+	cache := OpenOnChainCuckooTable(storage, capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	sink := cacheMetrics.NewInMemorySink()
+	cache.SetMetricsSink(sink)
+
+	// colliding keys fill all the lanes of their slot, so they get relocated, and eventually discarded
+	numHits := int64(0)
+	for i := uint64(0); i < 4*capacity; i++ {
+		hit, _, err := cache.AccessItem(collidingKey(i % (capacity + 3)))
+		assert.Nil(t, err)
+		if hit {
+			numHits++
+		}
+	}
+	results, err := cache.AccessItems([]CacheItemKey{collidingKey(0), collidingKey(0), keyFromUint64(1)})
+	assert.Nil(t, err)
+	for _, result := range results {
+		if result.Hit {
+			numHits++
+		}
+	}
+	assert.Equal(t, sink.Counter(cacheMetrics.OnChainHits), numHits)
+	assert.Equal(t, sink.Counter(cacheMetrics.OnChainHits)+sink.Counter(cacheMetrics.OnChainMisses), int64(4*capacity+3))
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, sink.Counter(cacheMetrics.GenerationAdvances), int64(header.CurrentGeneration-3))
+	assert.Greater(t, sink.Counter(cacheMetrics.Relocations), int64(0))
+	assert.Greater(t, sink.Counter(cacheMetrics.DiscardedItems), int64(0))
+	// every item in a chain is relocated, except the last one if it is discarded
+	totalDepth := int64(0)
+	for _, depth := range sink.Observations(cacheMetrics.RelocationDepth) {
+		assert.LessOrEqual(t, depth, int64(NumLanes))
+		totalDepth += depth
+	}
+	assert.Equal(t, totalDepth, sink.Counter(cacheMetrics.Relocations)+sink.Counter(cacheMetrics.DiscardedItems))
+
+	assert.Nil(t, cache.FlushOneItem(collidingKey(1)))
+	assert.Nil(t, cache.FlushAll())
+	assert.Equal(t, sink.Counter(cacheMetrics.OnChainItemFlushes), int64(1))
+	assert.Equal(t, sink.Counter(cacheMetrics.OnChainFlushes), int64(1))
+
+	// a failed operation reports nothing
+	before := sink.Counter(cacheMetrics.OnChainMisses)
+	storage.SetFault(onChainStorage.FailNthWrite(0))
+	_, _, err = cache.AccessItem(keyFromUint64(2))
+	assert.ErrorIs(t, err, onChainStorage.ErrInjectedFault)
+	assert.Equal(t, sink.Counter(cacheMetrics.OnChainMisses), before)
+	assert.Equal(t, sink.Counter(cacheMetrics.OnChainFlushes), int64(1))
+}
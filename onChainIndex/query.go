@@ -0,0 +1,61 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+// What an access to an item would find, without accessing it.
+type QueryResult struct {
+	Hit        bool   // whether an access to the item would be a hit
+	Generation uint64 // generation of the item's latest access, if it is a hit
+	Lane       uint64 // lane that holds the item, if it is a hit
+	InOldTable bool   // whether the item is still in the old table of a resize in progress, if it is a hit
+}
+
+// Find out whether an access to an item would be a hit, without accessing it. This never writes storage, so it
+// can be used to price an access, such as when estimating gas, without modifying consensus state.
+func (oc *OnChainCuckooTable) Query(itemKey CacheItemKey) (QueryResult, error) {
+	var result QueryResult
+	err := oc.readOnly(func() error {
+		header, err := oc.readValidHeader()
+		if err != nil {
+			return err
+		}
+		result, err = oc.query(&header, itemKey)
+		return err
+	})
+	if err != nil {
+		return QueryResult{}, err
+	}
+	return result, nil
+}
+
+func (oc *OnChainCuckooTable) query(header *OnChainCuckooHeader, itemKey CacheItemKey) (QueryResult, error) {
+	if err := header.validate(); err != nil {
+		return QueryResult{}, err
+	}
+	for lane := uint64(0); lane < NumLanes; lane++ {
+		slot := header.getSlotForLane(itemKey, lane)
+		cuckooItem, err := oc.ReadTableEntry(header, slot, lane)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		if cuckooItem.ItemKey == itemKey && cuckooItem.Generation != 0 {
+			if header.isLive(cuckooItem.Generation) {
+				return QueryResult{Hit: true, Generation: cuckooItem.Generation, Lane: lane}, nil
+			}
+			break // an expired entry in the new table doesn't rule out a live one in the old table
+		}
+	}
+	if header.Resizing {
+		state, err := oc.readResizeState()
+		if err != nil {
+			return QueryResult{}, err
+		}
+		entry, found, err := oc.findInOldTable(header, state, itemKey)
+		if err != nil || !found {
+			return QueryResult{}, err
+		}
+		return QueryResult{Hit: true, Generation: entry.item.Generation, Lane: entry.lane, InOldTable: true}, nil
+	}
+	return QueryResult{}, nil
+}
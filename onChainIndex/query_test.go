@@ -0,0 +1,69 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	for _, resize := range []bool{false, true} {
+		capacity := uint64(32)
+		storage := onChainStorage.NewMockOnChainStorage().(*onChainStorage.MockOnChainStorage)
+		cache := OpenOnChainCuckooTable(storage, capacity)
+		assert.Nil(t, cache.Initialize(capacity))
+		assert.Nil(t, sprayOnChainCache(cache, 774411))
+		if resize {
+			assert.Nil(t, cache.StartResize(2*capacity))
+		}
+		sawOldTable := false
+
+		for i := uint64(774411); i < 774411+2*capacity; i++ {
+			key := keyFromUint64(i)
+			header, err := cache.ReadHeader()
+			assert.Nil(t, err)
+			_, writesBefore := storage.GetAccessCounts()
+			result, err := cache.Query(key)
+			assert.Nil(t, err)
+			_, writesAfter := storage.GetAccessCounts()
+			assert.Equal(t, writesAfter, writesBefore)
+
+			in, err := cache.IsInCache(&header, key)
+			assert.Nil(t, err)
+			assert.Equal(t, result.Hit, in)
+			if result.Hit {
+				assert.True(t, result.Generation+1 >= header.CurrentGeneration)
+				region, capacity := header.TableRegion, header.Capacity
+				if result.InOldTable {
+					sawOldTable = true
+					state, err := cache.readResizeState()
+					assert.Nil(t, err)
+					region, capacity = 1-region, state.OldCapacity
+				}
+				item, err := cache.readEntryInRegion(region, capacity, slotForLane(key, result.Lane, capacity), result.Lane)
+				assert.Nil(t, err)
+				assert.Equal(t, item, CuckooItem{ItemKey: key, Generation: result.Generation})
+			} else {
+				assert.Equal(t, result, QueryResult{})
+			}
+
+			hit, _, err := cache.AccessItem(key)
+			assert.Nil(t, err)
+			assert.Equal(t, hit, result.Hit)
+		}
+		assert.Equal(t, sawOldTable, resize)
+	}
+}
+
+func TestReadOnlyOperation(t *testing.T) {
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), 32)
+	assert.Nil(t, cache.Initialize(32))
+	err := cache.readOnly(func() error { return cache.FlushAll() })
+	assert.ErrorIs(t, err, errWriteInReadOnlyOperation)
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header.CurrentGeneration, uint64(3))
+}
@@ -0,0 +1,184 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrResizeInProgress = errors.New("on-chain cache is already being resized")
+
+// Start resizing the table to newCapacity. The header is updated at once, so the new capacity is in effect as soon
+// as this returns, but the live entries of the old table are migrated into a new table over subsequent calls to
+// ContinueResize. Until then, every operation also consults the old table, and an accessed item is migrated
+// as part of its access, so the contents of the cache are the same as if the table had been rehashed at once.
+//
+// If the capacity shrinks, the cache might advance generations, to get down to the new capacity.
+func (oc *OnChainCuckooTable) StartResize(newCapacity uint64) error {
+	return oc.atomically(func() error { return oc.startResize(newCapacity) })
+}
+
+func (oc *OnChainCuckooTable) startResize(newCapacity uint64) error {
+	header, err := oc.readValidHeader()
+	if err != nil {
+		return err
+	}
+	if header.Resizing {
+		return ErrResizeInProgress
+	}
+	if newCapacity == 0 || newCapacity > MaxCacheSize {
+		return ErrInvalidCapacity
+	}
+	if err := header.validateForCapacity(newCapacity); err != nil {
+		return err
+	}
+	if err := oc.writeResizeState(ResizeState{OldCapacity: header.Capacity, Cursor: 0}); err != nil {
+		return err
+	}
+	header.Capacity = newCapacity
+	header.TableRegion = 1 - header.TableRegion
+	header.Resizing = true
+	_ = oc.advanceGenerationIfNeeded(&header)
+	return oc.WriteHeader(header)
+}
+
+// Migrate up to maxEntries entries of the old table into the new one, and report whether the resize is done.
+// Each entry migrated costs a bounded number of storage accesses, so this can be called once per block with a
+// suitable maxEntries to spread the cost of a resize over several blocks.
+func (oc *OnChainCuckooTable) ContinueResize(maxEntries uint64) (bool, error) {
+	var done bool
+	err := oc.atomically(func() error {
+		var err error
+		done, err = oc.continueResize(maxEntries)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return done, nil
+}
+
+func (oc *OnChainCuckooTable) continueResize(maxEntries uint64) (bool, error) {
+	header, err := oc.readValidHeader()
+	if err != nil {
+		return false, err
+	}
+	if !header.Resizing {
+		return true, nil
+	}
+	state, err := oc.readResizeState()
+	if err != nil {
+		return false, err
+	}
+	oldRegion := 1 - header.TableRegion
+	numOldEntries := state.OldCapacity * NumLanes
+	for i := uint64(0); i < maxEntries && state.Cursor < numOldEntries; i++ {
+		slot, lane := state.Cursor/NumLanes, state.Cursor%NumLanes
+		item, err := oc.readEntryInRegion(oldRegion, state.OldCapacity, slot, lane)
+		if err != nil {
+			return false, err
+		}
+		if header.isLive(item.Generation) {
+			// an item refreshed into an earlier lane can have an older entry here, so the entry moved is the one
+			// that lookups find
+			if err := oc.migrateFromOldTable(&header, state, item.ItemKey); err != nil {
+				return false, err
+			}
+		}
+		state.Cursor++
+	}
+	if state.Cursor == numOldEntries {
+		// expired entries are left in the old region, but they stay expired, so the region can be reused
+		header.Resizing = false
+		state = ResizeState{}
+	}
+	if err := oc.writeResizeState(state); err != nil {
+		return false, err
+	}
+	if err := oc.WriteHeader(header); err != nil {
+		return false, err
+	}
+	return !header.Resizing, nil
+}
+
+// Resize the table to newCapacity all at once.
+func (oc *OnChainCuckooTable) Resize(newCapacity uint64) error {
+	return oc.atomically(func() error {
+		if err := oc.startResize(newCapacity); err != nil {
+			return err
+		}
+		_, err := oc.continueResize(math.MaxUint64)
+		return err
+	})
+}
+
+type oldTableEntry struct {
+	slot uint64
+	lane uint64
+	item CuckooItem
+}
+
+// find the item in the old table, if it is alive there
+func (oc *OnChainCuckooTable) findInOldTable(
+	header *OnChainCuckooHeader,
+	state ResizeState,
+	itemKey CacheItemKey,
+) (oldTableEntry, bool, error) {
+	for lane := uint64(0); lane < NumLanes; lane++ {
+		slot := slotForLane(itemKey, lane, state.OldCapacity)
+		item, err := oc.readEntryInRegion(1-header.TableRegion, state.OldCapacity, slot, lane)
+		if err != nil {
+			return oldTableEntry{}, false, err
+		}
+		if item.ItemKey == itemKey && item.Generation != 0 {
+			return oldTableEntry{slot, lane, item}, header.isLive(item.Generation), nil
+		}
+	}
+	return oldTableEntry{}, false, nil
+}
+
+// if the item is alive in the old table, move it into the new table, so it can be accessed there
+func (oc *OnChainCuckooTable) migrateItem(header *OnChainCuckooHeader, itemKey CacheItemKey) error {
+	state, err := oc.readResizeState()
+	if err != nil {
+		return err
+	}
+	return oc.migrateFromOldTable(header, state, itemKey)
+}
+
+func (oc *OnChainCuckooTable) migrateFromOldTable(
+	header *OnChainCuckooHeader,
+	state ResizeState,
+	itemKey CacheItemKey,
+) error {
+	entry, found, err := oc.findInOldTable(header, state, itemKey)
+	if err != nil || !found {
+		return err
+	}
+	return oc.moveFromOldTable(header, state, entry)
+}
+
+func (oc *OnChainCuckooTable) moveFromOldTable(
+	header *OnChainCuckooHeader,
+	state ResizeState,
+	entry oldTableEntry,
+) error {
+	// older entries of the item in later lanes are cleared too, so they can't be migrated after it
+	oldRegion := 1 - header.TableRegion
+	for lane := entry.lane; lane < NumLanes; lane++ {
+		slot := slotForLane(entry.item.ItemKey, lane, state.OldCapacity)
+		item, err := oc.readEntryInRegion(oldRegion, state.OldCapacity, slot, lane)
+		if err != nil {
+			return err
+		}
+		if item.ItemKey == entry.item.ItemKey {
+			if err := oc.writeEntryInRegion(oldRegion, state.OldCapacity, slot, lane, CuckooItem{}); err != nil {
+				return err
+			}
+		}
+	}
+	// the item is already counted, so this is just like relocating it within the new table
+	return oc.relocateItem(entry.item, 0, header, nil)
+}
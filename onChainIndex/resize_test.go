@@ -0,0 +1,198 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"encoding/binary"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIncrementalResize(t *testing.T) {
+	for _, newCapacity := range []uint64{64, 37, 32} {
+		capacity := uint64(32)
+		cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+		assert.Nil(t, cache.Initialize(capacity))
+		assert.Nil(t, sprayOnChainCache(cache, 98113084))
+		liveBefore := liveItems(t, cache)
+
+		assert.Nil(t, cache.StartResize(newCapacity))
+		assert.ErrorIs(t, cache.StartResize(newCapacity), ErrResizeInProgress)
+		header, err := cache.ReadHeader()
+		assert.Nil(t, err)
+		assert.Equal(t, header.Capacity, newCapacity)
+		assert.Equal(t, header.Resizing, true)
+		for {
+			assert.Equal(t, liveItems(t, cache), liveBefore)
+			verifyAccurateGenerationCounts(t, cache)
+			verifyIsInCacheMatches(t, cache, liveBefore)
+			done, err := cache.ContinueResize(11)
+			assert.Nil(t, err)
+			if done {
+				break
+			}
+		}
+		header, err = cache.ReadHeader()
+		assert.Nil(t, err)
+		assert.Equal(t, header.Resizing, false)
+		assert.Equal(t, liveItems(t, cache), liveBefore)
+		verifyAccurateGenerationCounts(t, cache)
+		verifyIsInCacheMatches(t, cache, liveBefore)
+
+		assert.Nil(t, sprayOnChainCache(cache, 5000))
+		verifyAccurateGenerationCounts(t, cache)
+		header, err = cache.ReadHeader()
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, header.InCacheCount, newCapacity)
+	}
+}
+
+func TestAccessDuringResize(t *testing.T) {
+	capacity := uint64(32)
+	newCapacity := uint64(48)
+	incremental := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	atOnce := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	for _, cache := range []*OnChainCuckooTable{incremental, atOnce} {
+		assert.Nil(t, cache.Initialize(capacity))
+		assert.Nil(t, sprayOnChainCache(cache, 98113084))
+	}
+	assert.Nil(t, incremental.StartResize(newCapacity))
+	assert.Nil(t, atOnce.Resize(newCapacity))
+
+	for i := uint64(0); i < 200; i++ {
+		key := keyFromUint64(98113084 + (i*7)%60)
+		hit1, gen1, err := incremental.AccessItem(key)
+		assert.Nil(t, err)
+		hit2, gen2, err := atOnce.AccessItem(key)
+		assert.Nil(t, err)
+		assert.Equal(t, hit1, hit2)
+		assert.Equal(t, gen1, gen2)
+		if i%10 == 0 {
+			_, err = incremental.ContinueResize(5)
+			assert.Nil(t, err)
+		}
+		if i%13 == 0 {
+			assert.Nil(t, incremental.FlushOneItem(key))
+			assert.Nil(t, atOnce.FlushOneItem(key))
+		}
+		assert.Equal(t, liveItems(t, incremental), liveItems(t, atOnce))
+	}
+}
+
+func TestResizeErrors(t *testing.T) {
+	capacity := uint64(32)
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	assert.ErrorIs(t, cache.StartResize(0), ErrInvalidCapacity)
+	assert.ErrorIs(t, cache.StartResize(MaxCacheSize+1), ErrInvalidCapacity)
+
+	// flushing everything finishes a resize, because there is nothing left to migrate
+	assert.Nil(t, sprayOnChainCache(cache, 98113084))
+	assert.Nil(t, cache.StartResize(16))
+	assert.Nil(t, cache.FlushAll())
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header.Resizing, false)
+	done, err := cache.ContinueResize(1)
+	assert.Nil(t, err)
+	assert.Equal(t, done, true)
+	assert.Equal(t, len(liveItems(t, cache)), 0)
+}
+
+func TestFlushDuringResize(t *testing.T) {
+	capacity := uint64(16)
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, cache.Initialize(capacity))
+	for i := uint64(0); i < NumLanes; i++ {
+		_, _, err := cache.AccessItem(collidingKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, cache.StartResize(2*capacity))
+
+	// migrating the item in the first lane leaves the lane cleared, and the flush must look past it
+	_, _, err := cache.AccessItem(collidingKey(0))
+	assert.Nil(t, err)
+	flushed := collidingKey(NumLanes - 1)
+	assert.Nil(t, cache.FlushOneItem(flushed))
+	result, err := cache.Query(flushed)
+	assert.Nil(t, err)
+	assert.Equal(t, result, QueryResult{})
+	verifyAccurateGenerationCounts(t, cache)
+	hit, _, err := cache.AccessItem(flushed)
+	assert.Nil(t, err)
+	assert.Equal(t, hit, false)
+}
+
+func TestResizeAfterRefreshes(t *testing.T) {
+	capacity := uint64(16)
+	cache := OpenOnChainCuckooTable(onChainStorage.NewMockOnChainStorage(), capacity)
+	assert.Nil(t, cache.InitializeWithParameters(capacity, GenerationParameters{CurrentGenThreshold: 125}))
+	access := func(keys ...CacheItemKey) {
+		for _, key := range keys {
+			_, _, err := cache.AccessItem(key)
+			assert.Nil(t, err)
+		}
+	}
+	// the refreshed item moves into the lane that the expired blocker frees, and leaves its older entry behind in
+	// a slot that a resize migrates first
+	refreshed, blocker := keyInSlots(5, 1), keyInSlots(5, 2)
+	access(blocker, keyInSlots(8), keyInSlots(9))
+	access(refreshed, keyInSlots(10), keyInSlots(11))
+	access(refreshed)
+	before, err := cache.Query(refreshed)
+	assert.Nil(t, err)
+	assert.Equal(t, before.Lane, uint64(0))
+
+	assert.Nil(t, cache.StartResize(2*capacity))
+	for done := false; !done; {
+		done, err = cache.ContinueResize(1)
+		assert.Nil(t, err)
+		report, err := cache.Check()
+		assert.Nil(t, err)
+		assert.Equal(t, report.Violations, []Violation(nil))
+		result, err := cache.Query(refreshed)
+		assert.Nil(t, err)
+		assert.Equal(t, result.Hit, true)
+		assert.Equal(t, result.Generation, before.Generation)
+	}
+}
+
+func liveItems(t *testing.T, cache *OnChainCuckooTable) map[CacheItemKey]bool {
+	t.Helper()
+	items, err := ForAllOnChainCachedItems(
+		cache,
+		func(key CacheItemKey, inLatestGeneration bool, soFar map[CacheItemKey]bool) (map[CacheItemKey]bool, error) {
+			_, seen := soFar[key]
+			assert.Equal(t, seen, false)
+			soFar[key] = inLatestGeneration
+			return soFar, nil
+		},
+		map[CacheItemKey]bool{},
+	)
+	assert.Nil(t, err)
+	return items
+}
+
+func verifyIsInCacheMatches(t *testing.T, cache *OnChainCuckooTable, live map[CacheItemKey]bool) {
+	t.Helper()
+	header, err := cache.ReadHeader()
+	assert.Nil(t, err)
+	for key := range live {
+		in, err := cache.IsInCache(&header, key)
+		assert.Nil(t, err)
+		assert.Equal(t, in, true)
+	}
+	in, err := cache.IsInCache(&header, keyFromUint64(1))
+	assert.Nil(t, err)
+	assert.Equal(t, in, false)
+}
+
+func keyInSlots(slots ...uint64) CacheItemKey {
+	key := CacheItemKey{}
+	for lane, slot := range slots {
+		binary.BigEndian.PutUint16(key[lane*SliceSizeBytes:], uint16(slot))
+	}
+	return key
+}
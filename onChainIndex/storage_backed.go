@@ -6,66 +6,183 @@ package onChainIndex
 import (
 	"encoding/binary"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/cuckoocache/cacheMetrics"
 	"github.com/offchainlabs/cuckoocache/onChainStorage"
 )
 
 type OnChainCuckooTable struct {
-	storage       onChainStorage.OnChainStorage
-	cacheCapacity uint64
-	header        onChainStorage.OnChainStorageSlot
-	slots         []onChainStorage.OnChainStorageSlot
+	storage     onChainStorage.OnChainStorage
+	batch       *writeBatch // writes staged by the operation in progress, if any
+	accessList  accessList
+	transaction bool // whether the access list spans operations, as it does after ResetAccessList
+	gasSchedule GasSchedule
+	lastCost    OperationCost
+	metricsSink cacheMetrics.Sink
 }
 
+// Storage layout: the header is at offset 0, and table region 0 starts at offset 1, so a table that has never
+// been resized is where it has always been. Each region holds the entries of each lane in turn, so where an entry
+// is depends on the capacity of the table in the region. After room for a table of MaxCacheSize in region 0 come
+// the other bookkeeping slots, and then region 1. The table lives in one region; a resize rehashes it into the
+// other region.
+const headerOffset = 0
+const regionSize = NumLanes * MaxCacheSize
+const resizeStateOffset = 1 + regionSize
+const olderGenCountsOffset = resizeStateOffset + 1 // only used with more than two live generations
+const region1Offset = resizeStateOffset + 16
+
+// The table's capacity is read from its header, so cacheCapacity is not used; it is kept so that callers needn't
+// change.
 func OpenOnChainCuckooTable(storage onChainStorage.OnChainStorage, cacheCapacity uint64) *OnChainCuckooTable {
 	return &OnChainCuckooTable{
-		storage:       storage,
-		cacheCapacity: cacheCapacity,
-		header:        storage.NewSlot(0),
-		slots:         make([]onChainStorage.OnChainStorageSlot, cacheCapacity*NumLanes),
+		storage:     storage,
+		accessList:  newAccessList(),
+		gasSchedule: EIP2929GasSchedule{},
+		metricsSink: cacheMetrics.NoopSink{},
+	}
+}
+
+// Open a view of the table on an overlay of its storage, so that operations on the view, such as those of
+// eth_call or eth_estimateGas, see the table as it is but don't modify it, until the overlay is committed. The
+// view is priced with the table's gas schedule, as a transaction of its own, and doesn't report metrics.
+func (sb *OnChainCuckooTable) OpenOverlay() (*OnChainCuckooTable, *onChainStorage.OverlayOnChainStorage) {
+	overlay := onChainStorage.NewOverlayOnChainStorage(sb.storage)
+	view := OpenOnChainCuckooTable(overlay, 0)
+	view.gasSchedule = sb.gasSchedule
+	view.transaction = true
+	return view, overlay
+}
+
+// Slots are cheap to make, and a table can touch every one of its slots, so they aren't kept.
+func (sb *OnChainCuckooTable) slotAt(offset uint64) onChainStorage.OnChainStorageSlot {
+	return sb.storage.NewSlot(offset)
+}
+
+// All reads and writes of storage go through read and write, so that an operation in progress reads its own
+// staged writes.
+func (sb *OnChainCuckooTable) read(offset uint64) (common.Hash, error) {
+	if sb.batch != nil {
+		if value, staged := sb.batch.writes[offset]; staged {
+			// the slot was read before it was written, so it is warm
+			sb.batch.cost.WarmReads++
+			return value, nil
+		}
+	}
+	return sb.load(offset)
+}
+
+// Read a slot from storage, and account for the read.
+func (sb *OnChainCuckooTable) load(offset uint64) (common.Hash, error) {
+	value, err := sb.slotAt(offset).Get()
+	if err != nil {
+		return common.Hash{}, storageError(err)
+	}
+	cold := sb.accessList.touch(offset, value)
+	if sb.batch != nil {
+		sb.batch.noteOriginal(offset, value)
+		if cold {
+			sb.batch.cost.ColdReads++
+		} else {
+			sb.batch.cost.WarmReads++
+		}
+	}
+	return value, nil
+}
+
+func (sb *OnChainCuckooTable) write(offset uint64, value common.Hash) error {
+	if sb.batch != nil {
+		return sb.batch.stage(sb, offset, value)
+	}
+	if err := sb.slotAt(offset).Set(value); err != nil {
+		return storageError(err)
 	}
+	return nil
 }
 
 func (sb *OnChainCuckooTable) ReadHeader() (OnChainCuckooHeader, error) {
-	buf, err := sb.header.Get()
+	buf, err := sb.read(headerOffset)
 	if err != nil {
-		return OnChainCuckooHeader{}, nil
+		return OnChainCuckooHeader{}, err
 	}
-	return OnChainCuckooHeader{
-		Capacity:          binary.LittleEndian.Uint64(buf[0:8]),
-		CurrentGeneration: binary.LittleEndian.Uint64(buf[8:16]),
-		CurrentGenCount:   binary.LittleEndian.Uint64(buf[16:24]),
-		InCacheCount:      binary.LittleEndian.Uint64(buf[24:32]),
-	}, nil
+	header, err := decodeHeader(buf)
+	if err != nil {
+		return OnChainCuckooHeader{}, err
+	}
+	if header.numOlderGenCounts() > 0 {
+		countsBuf, err := sb.read(olderGenCountsOffset)
+		if err != nil {
+			return OnChainCuckooHeader{}, err
+		}
+		decodeOlderGenCounts(&header, countsBuf)
+	}
+	return header, nil
 }
 
+// Write the header in the format given by header.Version.
 func (sb *OnChainCuckooTable) WriteHeader(header OnChainCuckooHeader) error {
-	buf := common.BytesToHash(
-		binary.LittleEndian.AppendUint64(
-			binary.LittleEndian.AppendUint64(
-				binary.LittleEndian.AppendUint64(
-					binary.LittleEndian.AppendUint64([]byte{}, header.Capacity),
-					header.CurrentGeneration,
-				),
-				header.CurrentGenCount,
-			),
-			header.InCacheCount,
-		),
-	)
-	return sb.header.Set(buf)
-}
-
-func (sb *OnChainCuckooTable) slotForTableEntry(slot, lane uint64) onChainStorage.OnChainStorageSlot {
-	slotNum := lane*sb.cacheCapacity + slot
-	theSlot := sb.slots[slotNum]
-	if theSlot == nil {
-		theSlot = sb.storage.NewSlot(slotNum + 1)
-		sb.slots[slotNum] = theSlot
+	buf, err := encodeHeader(header)
+	if err != nil {
+		return err
+	}
+	if header.numOlderGenCounts() > 0 {
+		countsBuf, err := encodeOlderGenCounts(header)
+		if err != nil {
+			return err
+		}
+		// most header writes leave the older generations' counts alone, so don't pay to write them again
+		stored, err := sb.read(olderGenCountsOffset)
+		if err != nil {
+			return err
+		}
+		if countsBuf != stored {
+			if err := sb.write(olderGenCountsOffset, countsBuf); err != nil {
+				return err
+			}
+		}
+	}
+	return sb.write(headerOffset, buf)
+}
+
+type ResizeState struct {
+	OldCapacity uint64
+	Cursor      uint64 // number of entries of the old table that have been migrated so far
+}
+
+func (sb *OnChainCuckooTable) readResizeState() (ResizeState, error) {
+	buf, err := sb.read(resizeStateOffset)
+	if err != nil {
+		return ResizeState{}, err
 	}
-	return theSlot
+	return ResizeState{
+		OldCapacity: binary.LittleEndian.Uint64(buf[0:8]),
+		Cursor:      binary.LittleEndian.Uint64(buf[8:16]),
+	}, nil
+}
+
+func (sb *OnChainCuckooTable) writeResizeState(state ResizeState) error {
+	buf := binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64([]byte{}, state.OldCapacity), state.Cursor)
+	return sb.write(resizeStateOffset, common.BytesToHash(append(buf, make([]byte, 16)...)))
+}
+
+func tableEntryOffset(region uint8, capacity, slot, lane uint64) uint64 {
+	if region == 0 {
+		return 1 + lane*capacity + slot
+	}
+	return region1Offset + lane*capacity + slot
+}
+
+// Read an entry of the table that the header describes.
+func (sb *OnChainCuckooTable) ReadTableEntry(header *OnChainCuckooHeader, slot, lane uint64) (CuckooItem, error) {
+	return sb.readEntryInRegion(header.TableRegion, header.Capacity, slot, lane)
+}
+
+// Write an entry of the table that the header describes.
+func (sb *OnChainCuckooTable) WriteTableEntry(header *OnChainCuckooHeader, slot, lane uint64, cuckooItem CuckooItem) error {
+	return sb.writeEntryInRegion(header.TableRegion, header.Capacity, slot, lane, cuckooItem)
 }
 
-func (sb *OnChainCuckooTable) ReadTableEntry(slot, lane uint64) (CuckooItem, error) {
-	buf, err := sb.slotForTableEntry(slot, lane).Get()
+func (sb *OnChainCuckooTable) readEntryInRegion(region uint8, capacity, slot, lane uint64) (CuckooItem, error) {
+	buf, err := sb.read(tableEntryOffset(region, capacity, slot, lane))
 	if err != nil {
 		return CuckooItem{}, err
 	}
@@ -77,7 +194,7 @@ func (sb *OnChainCuckooTable) ReadTableEntry(slot, lane uint64) (CuckooItem, err
 	}, nil
 }
 
-func (sb *OnChainCuckooTable) WriteTableEntry(slot, lane uint64, cuckooItem CuckooItem) error {
+func (sb *OnChainCuckooTable) writeEntryInRegion(region uint8, capacity, slot, lane uint64, cuckooItem CuckooItem) error {
 	buf := binary.LittleEndian.AppendUint64(cuckooItem.ItemKey[:], cuckooItem.Generation)
-	return sb.slotForTableEntry(slot, lane).Set(common.BytesToHash(buf))
+	return sb.write(tableEntryOffset(region, capacity, slot, lane), common.BytesToHash(buf))
 }
@@ -4,8 +4,12 @@
 package onChainIndex
 
 import (
+	"bufio"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/offchainlabs/cuckoocache/onChainStorage"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
 )
 
@@ -15,7 +19,7 @@ func TestStorageBacked(t *testing.T) {
 	sb := OpenOnChainCuckooTable(storage, capacity)
 
 	// everything should be empty to start
-	citem, err := sb.ReadTableEntry(17, 3)
+	citem, err := sb.ReadTableEntry(&OnChainCuckooHeader{Capacity: capacity}, 17, 3)
 	assert.Nil(t, err)
 	assert.Equal(t, citem.ItemKey, [24]byte{})
 	assert.Equal(t, citem.Generation, uint64(0))
@@ -41,11 +45,11 @@ func TestStorageBacked(t *testing.T) {
 		ItemKey:    keyFromUint64(13),
 		Generation: 13,
 	}
-	assert.Nil(t, sb.WriteTableEntry(0, 0, item00))
+	assert.Nil(t, sb.WriteTableEntry(&myHeader, 0, 0, item00))
 	header, err = sb.ReadHeader()
 	assert.Nil(t, err)
 	assert.Equal(t, header, myHeader)
-	entry, err := sb.ReadTableEntry(0, 0)
+	entry, err := sb.ReadTableEntry(&myHeader, 0, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, entry, item00)
 
@@ -53,14 +57,178 @@ func TestStorageBacked(t *testing.T) {
 		ItemKey:    keyFromUint64(39),
 		Generation: 39,
 	}
-	assert.Nil(t, sb.WriteTableEntry(9, 3, item39))
+	assert.Nil(t, sb.WriteTableEntry(&myHeader, 9, 3, item39))
 	header, err = sb.ReadHeader()
 	assert.Nil(t, err)
 	assert.Equal(t, header, myHeader)
-	entry, err = sb.ReadTableEntry(0, 0)
+	entry, err = sb.ReadTableEntry(&myHeader, 0, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, entry, item00)
-	entry, err = sb.ReadTableEntry(9, 3)
+	entry, err = sb.ReadTableEntry(&myHeader, 9, 3)
 	assert.Nil(t, err)
 	assert.Equal(t, entry, item39)
+
+	// region 0 is laid out as tables always have been, and region 1 doesn't overlap it
+	buf, err := storage.NewSlot(1 + 3*37 + 9).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, buf[0:24], item39.ItemKey[:])
+	otherRegion := myHeader
+	otherRegion.TableRegion = 1
+	otherRegion.Capacity = MaxCacheSize
+	entry, err = sb.ReadTableEntry(&otherRegion, MaxCacheSize-1, NumLanes-1)
+	assert.Nil(t, err)
+	assert.Equal(t, entry, CuckooItem{})
+	assert.Nil(t, sb.WriteTableEntry(&otherRegion, 9, 3, item00))
+	entry, err = sb.ReadTableEntry(&myHeader, 9, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, entry, item39)
+}
+
+func TestHeaderVersions(t *testing.T) {
+	capacity := uint64(64)
+	storage := onChainStorage.NewMockOnChainStorage()
+	sb := OpenOnChainCuckooTable(storage, capacity)
+
+	// a table initialized before headers were versioned
+	legacyHeader := OnChainCuckooHeader{
+		Version:           LegacyHeaderVersion,
+		Capacity:          capacity,
+		CurrentGeneration: 3,
+	}
+	assert.Nil(t, sb.WriteHeader(legacyHeader))
+	assert.Nil(t, sprayOnChainCache(sb, 5000))
+	header, err := sb.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header.Version, uint8(LegacyHeaderVersion))
+	liveBefore := liveItems(t, sb)
+	verifyAccurateGenerationCounts(t, sb)
+
+	// migrating changes only the format
+	assert.Nil(t, sb.Migrate())
+	migrated, err := sb.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, migrated.Version, uint8(CurrentHeaderVersion))
+	migrated.Version = header.Version
+	assert.Equal(t, migrated, header)
+	assert.Equal(t, liveItems(t, sb), liveBefore)
+	assert.Nil(t, sb.Migrate())
+	assert.Nil(t, sprayOnChainCache(sb, 6000))
+	verifyAccurateGenerationCounts(t, sb)
+	header, err = sb.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header.Version, uint8(CurrentHeaderVersion))
+
+	// flags round-trip in every format
+	for _, version := range []uint8{LegacyHeaderVersion, HeaderVersion1, HeaderVersion2} {
+		myHeader := OnChainCuckooHeader{
+			Version:           version,
+			Capacity:          MaxCacheSize,
+			CurrentGeneration: 1 << 40,
+			CurrentGenCount:   106,
+			InCacheCount:      MaxCacheSize - 1,
+			TableRegion:       1,
+			Resizing:          true,
+		}
+		assert.Nil(t, sb.WriteHeader(myHeader))
+		header, err = sb.ReadHeader()
+		assert.Nil(t, err)
+		assert.Equal(t, header, myHeader)
+	}
+
+	// only version 2 on has generation parameters
+	myHeader := OnChainCuckooHeader{
+		Version:              HeaderVersion2,
+		Capacity:             capacity,
+		CurrentGeneration:    9,
+		GenerationParameters: GenerationParameters{CurrentGenThreshold: 123, InCacheThreshold: 999},
+	}
+	assert.Nil(t, sb.WriteHeader(myHeader))
+	header, err = sb.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header, myHeader)
+	myHeader.Version = HeaderVersion1
+	assert.ErrorIs(t, sb.WriteHeader(myHeader), ErrUnrepresentableHeader)
+
+	// the counts of older generations are in a slot of their own, as far as there are older generations
+	myHeader = OnChainCuckooHeader{
+		Version:              HeaderVersion2,
+		Capacity:             capacity,
+		CurrentGeneration:    20,
+		CurrentGenCount:      5,
+		InCacheCount:         30,
+		GenerationParameters: GenerationParameters{LiveGenerations: 5},
+		OlderGenCounts:       [MaxLiveGenerations - 2]uint64{4, 3, 2},
+	}
+	assert.Nil(t, sb.WriteHeader(myHeader))
+	header, err = sb.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header, myHeader)
+	assert.Equal(t, header.countOfAge(1), uint64(16))
+	assert.Equal(t, header.countOfAge(4), uint64(2))
+	countsBuf, err := storage.NewSlot(olderGenCountsOffset).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, countsBuf[12:], make([]byte, 20))
+	myHeader.LiveGenerations = 0
+	myHeader.OlderGenCounts = [MaxLiveGenerations - 2]uint64{}
+	assert.Nil(t, sb.WriteHeader(myHeader))
+	header, err = sb.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header, myHeader)
+
+	assert.ErrorIs(t, sb.WriteHeader(OnChainCuckooHeader{Version: CurrentHeaderVersion + 1}), ErrUnknownHeaderVersion)
+	buf, err := encodeHeader(OnChainCuckooHeader{Version: CurrentHeaderVersion, Capacity: 7})
+	assert.Nil(t, err)
+	buf[4] = CurrentHeaderVersion + 1
+	_, err = decodeHeader(buf)
+	assert.ErrorIs(t, err, ErrUnknownHeaderVersion)
+}
+
+// testdata/baseline_table.txt holds the storage of a 32-entry table filled by the code from before tables were
+// versioned or resizable, followed by the keys that were in the cache.
+func TestBaselineSnapshot(t *testing.T) {
+	capacity := uint64(32)
+	storage := onChainStorage.NewMockOnChainStorage()
+	file, err := os.Open("testdata/baseline_table.txt")
+	assert.Nil(t, err)
+	defer file.Close()
+	hits := map[uint64]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var location, value []byte
+		var key uint64
+		if _, err := fmt.Sscanf(scanner.Text(), "slot %x %x", &location, &value); err == nil {
+			assert.Nil(t, storage.Set(common.BytesToHash(location), common.BytesToHash(value)))
+		} else if _, err := fmt.Sscanf(scanner.Text(), "hit %d", &key); err == nil {
+			hits[key] = true
+		}
+	}
+	assert.Nil(t, scanner.Err())
+	assert.NotEqual(t, len(hits), 0)
+
+	verifyHits := func(sb *OnChainCuckooTable) {
+		t.Helper()
+		header, err := sb.ReadHeader()
+		assert.Nil(t, err)
+		for key := uint64(0); key < 48; key++ {
+			in, err := sb.IsInCache(&header, keyFromUint64(key))
+			assert.Nil(t, err)
+			assert.Equal(t, in, hits[key], key)
+		}
+		report, err := sb.Check()
+		assert.Nil(t, err)
+		assert.Equal(t, report.OK(), true)
+	}
+	sb := OpenOnChainCuckooTable(storage, capacity)
+	header, err := sb.ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, header.Version, uint8(LegacyHeaderVersion))
+	verifyHits(sb)
+	assert.Nil(t, sb.Migrate())
+	verifyHits(sb)
+	for key := range hits {
+		hit, _, err := sb.AccessItem(keyFromUint64(key))
+		assert.Nil(t, err)
+		assert.Equal(t, hit, true, key)
+	}
+	verifyAccurateGenerationCounts(t, sb)
 }
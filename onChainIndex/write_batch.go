@@ -0,0 +1,102 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainIndex
+
+import (
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/offchainlabs/cuckoocache/cacheMetrics"
+)
+
+// The writes of one operation on the table. They are staged until the operation finishes, and then either all
+// written to storage, if the operation succeeded, or all discarded, so that a failure partway through an
+// operation can't leave the table with counts that don't match its contents.
+type writeBatch struct {
+	writes    map[uint64]common.Hash
+	order     []uint64 // offsets in the order they were first written, so committing is deterministic
+	originals map[uint64]common.Hash
+	cost      OperationCost
+	readOnly  bool
+	metrics   *cacheMetrics.InMemorySink // held back, like the writes, until the operation succeeds; nil if not reported
+}
+
+// The value of a slot before the operation, for rolling back a commit that fails partway through.
+func (b *writeBatch) noteOriginal(offset uint64, value common.Hash) {
+	if _, known := b.originals[offset]; !known {
+		b.originals[offset] = value
+	}
+}
+
+func (b *writeBatch) stage(sb *OnChainCuckooTable, offset uint64, value common.Hash) error {
+	if b.readOnly {
+		return errWriteInReadOnlyOperation
+	}
+	if _, staged := b.writes[offset]; !staged {
+		if _, known := b.originals[offset]; !known {
+			if _, err := sb.load(offset); err != nil {
+				return err
+			}
+		}
+		b.order = append(b.order, offset)
+	}
+	b.writes[offset] = value
+	return nil
+}
+
+// Run an operation with its writes staged, and commit them if it succeeds. An operation run inside another one
+// is part of the outer one. The cost of the operation is available from LastOperationCost afterwards, whether or
+// not it succeeded.
+func (oc *OnChainCuckooTable) atomically(operation func() error) error {
+	return oc.runOperation(operation, false)
+}
+
+// Run an operation that mustn't write storage. If it tries to, it fails, and nothing is written.
+func (oc *OnChainCuckooTable) readOnly(operation func() error) error {
+	return oc.runOperation(operation, true)
+}
+
+var errWriteInReadOnlyOperation = errors.New("read-only operation on the on-chain cache tried to write")
+
+func (oc *OnChainCuckooTable) runOperation(operation func() error, readOnly bool) error {
+	if oc.batch != nil {
+		return operation()
+	}
+	if !oc.transaction {
+		oc.accessList = newAccessList()
+	}
+	batch := &writeBatch{
+		writes:    make(map[uint64]common.Hash),
+		originals: make(map[uint64]common.Hash),
+		readOnly:  readOnly,
+	}
+	if _, isNoop := oc.metricsSink.(cacheMetrics.NoopSink); !isNoop {
+		batch.metrics = cacheMetrics.NewInMemorySink()
+	}
+	oc.batch = batch
+	err := operation()
+	oc.batch = nil
+	if err == nil {
+		err = oc.commit(batch)
+	}
+	if err == nil && batch.metrics != nil {
+		batch.metrics.ReplayTo(oc.metricsSink)
+	}
+	batch.cost.Gas, batch.cost.Refund = oc.gasSchedule.Gas(batch.cost)
+	oc.lastCost = batch.cost
+	return err
+}
+
+func (oc *OnChainCuckooTable) commit(batch *writeBatch) error {
+	for i, offset := range batch.order {
+		oc.accessList.accountForWrite(&batch.cost, offset, batch.originals[offset], batch.writes[offset])
+		if err := oc.slotAt(offset).Set(batch.writes[offset]); err != nil {
+			// put back what was already written, as far as storage lets us
+			for j := i - 1; j >= 0; j-- {
+				_ = oc.slotAt(batch.order[j]).Set(batch.originals[batch.order[j]])
+			}
+			return storageError(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainStorage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"sort"
+)
+
+var (
+	ErrBlockOutOfOrder = errors.New("on-chain storage block is out of order")
+	ErrRollbackTooFar  = errors.New("on-chain storage can't be rolled back past its finalized block")
+)
+
+// JournalingOnChainStorage passes accesses through to another storage, and keeps an undo journal of each block's
+// writes, so that the blocks after a given block can be rolled back, such as when the chain reorgs. The journal of
+// a block records the value that each location or slot it wrote had before the block; the journals of finalized
+// blocks, which can't be rolled back, are dropped.
+type JournalingOnChainStorage struct {
+	inner     OnChainStorage
+	block     uint64
+	finalized uint64
+	journals  map[uint64]*blockJournal
+}
+
+type blockJournal struct {
+	words     []word // in the order the block first wrote them
+	oldValues map[word]common.Hash
+}
+
+// Writes made before the first call to BeginBlock are in block 0, which is taken to be finalized.
+func NewJournalingOnChainStorage(inner OnChainStorage) *JournalingOnChainStorage {
+	return &JournalingOnChainStorage{inner: inner, journals: make(map[uint64]*blockJournal)}
+}
+
+// Start journaling the writes of a block, which must be after every block so far.
+func (j *JournalingOnChainStorage) BeginBlock(block uint64) error {
+	if block <= j.block {
+		return fmt.Errorf("%w: block %d is not after block %d", ErrBlockOutOfOrder, block, j.block)
+	}
+	j.block = block
+	return nil
+}
+
+func (j *JournalingOnChainStorage) CurrentBlock() uint64 {
+	return j.block
+}
+
+func (j *JournalingOnChainStorage) Get(location common.Hash) (common.Hash, error) {
+	return j.inner.Get(location)
+}
+
+func (j *JournalingOnChainStorage) Set(location, value common.Hash) error {
+	if err := j.journal(locationWord(location), func() (common.Hash, error) { return j.inner.Get(location) }); err != nil {
+		return err
+	}
+	return j.inner.Set(location, value)
+}
+
+// Record the value that a word had before the current block, if the block is to be journaled and hasn't written
+// the word yet.
+func (j *JournalingOnChainStorage) journal(w word, get func() (common.Hash, error)) error {
+	if j.block <= j.finalized {
+		return nil
+	}
+	journal := j.journals[j.block]
+	if journal == nil {
+		journal = &blockJournal{oldValues: make(map[word]common.Hash)}
+		j.journals[j.block] = journal
+	}
+	if _, journaled := journal.oldValues[w]; !journaled {
+		oldValue, err := get()
+		if err != nil {
+			return err
+		}
+		journal.words = append(journal.words, w)
+		journal.oldValues[w] = oldValue
+	}
+	return nil
+}
+
+func (j *JournalingOnChainStorage) NewSlot(offset uint64) OnChainStorageSlot {
+	return &journalingSlot{journal: j, offset: offset, inner: j.inner.NewSlot(offset)}
+}
+
+type journalingSlot struct {
+	journal *JournalingOnChainStorage
+	offset  uint64
+	inner   OnChainStorageSlot
+}
+
+func (s *journalingSlot) Get() (common.Hash, error) {
+	return s.inner.Get()
+}
+
+func (s *journalingSlot) Set(value common.Hash) error {
+	if err := s.journal.journal(slotWord(s.offset), s.inner.Get); err != nil {
+		return err
+	}
+	return s.inner.Set(value)
+}
+
+// The locations that a block wrote, in the order it first wrote them, or nil if the block is finalized. Writes
+// through slots are left out; TouchedSlots has them.
+func (j *JournalingOnChainStorage) TouchedLocations(block uint64) []common.Hash {
+	var locations []common.Hash
+	for _, w := range j.touched(block) {
+		if !w.isSlot {
+			locations = append(locations, w.location)
+		}
+	}
+	return locations
+}
+
+// The offsets of the slots that a block wrote, in the order it first wrote them, or nil if the block is finalized.
+func (j *JournalingOnChainStorage) TouchedSlots(block uint64) []uint64 {
+	var offsets []uint64
+	for _, w := range j.touched(block) {
+		if w.isSlot {
+			offsets = append(offsets, w.offset)
+		}
+	}
+	return offsets
+}
+
+func (j *JournalingOnChainStorage) touched(block uint64) []word {
+	journal := j.journals[block]
+	if journal == nil {
+		return nil
+	}
+	return journal.words
+}
+
+// Undo the writes of every block after toBlock, latest first, so that storage is as it was at the end of toBlock.
+// Writes after this are in toBlock, until the next call to BeginBlock.
+//
+// If the other storage fails, the blocks already undone stay undone, and Rollback can be called again.
+func (j *JournalingOnChainStorage) Rollback(toBlock uint64) error {
+	if toBlock < j.finalized {
+		return fmt.Errorf("%w: block %d is before finalized block %d", ErrRollbackTooFar, toBlock, j.finalized)
+	}
+	blocks := []uint64{}
+	for block := range j.journals {
+		if block > toBlock {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Slice(blocks, func(a, b int) bool { return blocks[a] > blocks[b] })
+	for _, block := range blocks {
+		journal := j.journals[block]
+		for i := len(journal.words) - 1; i >= 0; i-- {
+			w := journal.words[i]
+			if err := w.set(j.inner, journal.oldValues[w]); err != nil {
+				return err
+			}
+			journal.words = journal.words[:i]
+			delete(journal.oldValues, w)
+		}
+		delete(j.journals, block)
+	}
+	j.block = min(j.block, toBlock)
+	return nil
+}
+
+// Mark every block up to and including block as finalized, dropping their journals, so that storage can no
+// longer be rolled back to before block.
+func (j *JournalingOnChainStorage) Finalize(block uint64) {
+	block = min(block, j.block)
+	if block <= j.finalized {
+		return
+	}
+	for journaled := range j.journals {
+		if journaled <= block {
+			delete(j.journals, journaled)
+		}
+	}
+	j.finalized = block
+}
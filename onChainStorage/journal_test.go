@@ -0,0 +1,96 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainStorage
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestJournalingStorage(t *testing.T) {
+	mock := NewMockOnChainStorage().(*MockOnChainStorage)
+	journal := NewJournalingOnChainStorage(mock)
+	rng := rand.New(rand.NewSource(77))
+	writeBlock := func() {
+		for i := 0; i < 20; i++ {
+			value := common.Hash{}
+			if rng.Intn(4) != 0 {
+				value = common.BytesToHash([]byte{byte(1 + rng.Intn(255)), byte(rng.Intn(256))})
+			}
+			assert.Nil(t, journal.NewSlot(uint64(rng.Intn(30))).Set(value))
+		}
+	}
+
+	// writes before the first block are finalized
+	writeBlock()
+	assert.Nil(t, journal.TouchedSlots(0))
+	snapshots := []map[common.Hash]common.Hash{mock.Snapshot()}
+	for block := uint64(1); block <= 6; block++ {
+		assert.Nil(t, journal.BeginBlock(block))
+		writeBlock()
+		snapshots = append(snapshots, mock.Snapshot())
+	}
+	assert.Equal(t, journal.CurrentBlock(), uint64(6))
+	assert.Nil(t, journal.TouchedLocations(6))
+	touched := journal.TouchedSlots(6)
+	assert.Greater(t, len(touched), 0)
+	assert.LessOrEqual(t, len(touched), 20)
+
+	assert.Nil(t, journal.Rollback(4))
+	assert.Equal(t, mock.Snapshot(), snapshots[4])
+	assert.Equal(t, journal.CurrentBlock(), uint64(4))
+	assert.Nil(t, journal.TouchedSlots(5))
+	assert.ErrorIs(t, journal.BeginBlock(4), ErrBlockOutOfOrder)
+
+	// another branch, with a gap in the block numbers, rolls back just as well
+	assert.Nil(t, journal.BeginBlock(9))
+	writeBlock()
+	assert.Nil(t, journal.Rollback(3))
+	assert.Equal(t, mock.Snapshot(), snapshots[3])
+
+	// writes after a rollback are in the block rolled back to
+	writeBlock()
+	assert.Nil(t, journal.Rollback(2))
+	assert.Equal(t, mock.Snapshot(), snapshots[2])
+
+	journal.Finalize(1)
+	assert.ErrorIs(t, journal.Rollback(0), ErrRollbackTooFar)
+	assert.Nil(t, journal.Rollback(1))
+	assert.Equal(t, mock.Snapshot(), snapshots[1])
+	assert.Nil(t, journal.TouchedSlots(1))
+
+	// a failed rollback can be retried
+	faulty := NewFaultyOnChainStorage(mock, nil)
+	journal = NewJournalingOnChainStorage(faulty)
+	before := mock.Snapshot()
+	assert.Nil(t, journal.BeginBlock(1))
+	writeBlock()
+	assert.Nil(t, journal.BeginBlock(2))
+	writeBlock()
+	faulty.SetFault(FailNthWrite(3))
+	assert.ErrorIs(t, journal.Rollback(0), ErrInjectedFault)
+	assert.Nil(t, journal.Rollback(0))
+	assert.Equal(t, mock.Snapshot(), before)
+}
+
+func TestJournalOfStorageWithOwnSlotLayout(t *testing.T) {
+	inner := newHashedSlotStorage()
+	one, two := common.BytesToHash([]byte{1}), common.BytesToHash([]byte{2})
+	assert.Nil(t, inner.NewSlot(5).Set(one))
+	before := inner.Snapshot()
+
+	journal := NewJournalingOnChainStorage(inner)
+	assert.Nil(t, journal.BeginBlock(1))
+	assert.Nil(t, journal.NewSlot(5).Set(two))
+	assert.Nil(t, journal.NewSlot(6).Set(two))
+	value, err := inner.NewSlot(5).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, two)
+	assert.Equal(t, journal.TouchedSlots(1), []uint64{5, 6})
+
+	assert.Nil(t, journal.Rollback(0))
+	assert.Equal(t, inner.Snapshot(), before)
+}
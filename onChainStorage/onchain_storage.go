@@ -4,7 +4,6 @@
 package onChainStorage
 
 import (
-	"encoding/binary"
 	"github.com/ethereum/go-ethereum/common"
 )
 
@@ -42,6 +41,11 @@ func NewMockOnChainStorage() OnChainStorage {
 	return &MockOnChainStorage{contents: make(map[common.Hash]common.Hash)}
 }
 
+// A mock storage with the contents of a Snapshot, which it takes over.
+func NewMockOnChainStorageFromSnapshot(snapshot map[common.Hash]common.Hash) OnChainStorage {
+	return &MockOnChainStorage{contents: snapshot}
+}
+
 func (m *MockOnChainStorage) Get(location common.Hash) (common.Hash, error) {
 	m.readCount++
 	value, exists := m.contents[location]
@@ -63,13 +67,21 @@ func (m *MockOnChainStorage) Set(location, value common.Hash) error {
 }
 
 func (m *MockOnChainStorage) NewSlot(offset uint64) OnChainStorageSlot {
-	zeroes := [24]byte{}
 	return &MockOnChainStorageSlot{
 		sto:      m,
-		location: common.BytesToHash(binary.LittleEndian.AppendUint64(zeroes[:], offset)),
+		location: SlotLocation(offset),
 	}
 }
 
 func (m *MockOnChainStorage) GetAccessCounts() (uint64, uint64) {
 	return m.readCount, m.writeCount
 }
+
+// A copy of the contents of storage, for checking whether they have changed.
+func (m *MockOnChainStorage) Snapshot() map[common.Hash]common.Hash {
+	snapshot := make(map[common.Hash]common.Hash, len(m.contents))
+	for location, value := range m.contents {
+		snapshot[location] = value
+	}
+	return snapshot
+}
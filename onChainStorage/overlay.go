@@ -0,0 +1,119 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainStorage
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// OverlayOnChainStorage reads through to a base storage, but buffers every write instead of passing it through,
+// so that reads see the buffered writes and the base storage is untouched until Commit. This isolates speculative
+// execution, such as eth_call and eth_estimateGas, from the real storage.
+type OverlayOnChainStorage struct {
+	base   OnChainStorage
+	words  []word // in the order they were first written
+	writes map[word]common.Hash
+}
+
+// A word of storage, addressed either by its location or by the offset of a slot. Only the storage knows where its
+// slots are, so the two are kept apart, and a word should be accessed one way or the other.
+type word struct {
+	isSlot   bool
+	offset   uint64
+	location common.Hash
+}
+
+func locationWord(location common.Hash) word {
+	return word{location: location}
+}
+
+func slotWord(offset uint64) word {
+	return word{isSlot: true, offset: offset}
+}
+
+func (w word) get(storage OnChainStorage) (common.Hash, error) {
+	if w.isSlot {
+		return storage.NewSlot(w.offset).Get()
+	}
+	return storage.Get(w.location)
+}
+
+func (w word) set(storage OnChainStorage, value common.Hash) error {
+	if w.isSlot {
+		return storage.NewSlot(w.offset).Set(value)
+	}
+	return storage.Set(w.location, value)
+}
+
+func NewOverlayOnChainStorage(base OnChainStorage) *OverlayOnChainStorage {
+	return &OverlayOnChainStorage{base: base, writes: make(map[word]common.Hash)}
+}
+
+func (o *OverlayOnChainStorage) Get(location common.Hash) (common.Hash, error) {
+	if value, written := o.writes[locationWord(location)]; written {
+		return value, nil
+	}
+	return o.base.Get(location)
+}
+
+func (o *OverlayOnChainStorage) Set(location, value common.Hash) error {
+	o.buffer(locationWord(location), value)
+	return nil
+}
+
+func (o *OverlayOnChainStorage) buffer(w word, value common.Hash) {
+	if _, written := o.writes[w]; !written {
+		o.words = append(o.words, w)
+	}
+	o.writes[w] = value
+}
+
+func (o *OverlayOnChainStorage) NewSlot(offset uint64) OnChainStorageSlot {
+	return &overlaySlot{overlay: o, word: slotWord(offset), base: o.base.NewSlot(offset)}
+}
+
+type overlaySlot struct {
+	overlay *OverlayOnChainStorage
+	word    word
+	base    OnChainStorageSlot
+}
+
+func (s *overlaySlot) Get() (common.Hash, error) {
+	if value, written := s.overlay.writes[s.word]; written {
+		return value, nil
+	}
+	return s.base.Get()
+}
+
+func (s *overlaySlot) Set(value common.Hash) error {
+	s.overlay.buffer(s.word, value)
+	return nil
+}
+
+func (o *OverlayOnChainStorage) NumBufferedWrites() int {
+	return len(o.words)
+}
+
+// Write the buffered writes through to the base storage, in the order they were first written, with the latest
+// value of each location, and then discard them.
+//
+// If the base storage fails, the writes already made stay made, and the rest stay buffered, so Commit can be
+// called again.
+func (o *OverlayOnChainStorage) Commit() error {
+	for len(o.words) > 0 {
+		w := o.words[0]
+		if err := w.set(o.base, o.writes[w]); err != nil {
+			return err
+		}
+		o.words = o.words[1:]
+		delete(o.writes, w)
+	}
+	return nil
+}
+
+// Drop the buffered writes, so that reads see the base storage again.
+func (o *OverlayOnChainStorage) Discard() {
+	o.words = nil
+	o.writes = make(map[word]common.Hash)
+}
@@ -0,0 +1,101 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainStorage
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestOverlayStorage(t *testing.T) {
+	mock := NewMockOnChainStorage().(*MockOnChainStorage)
+	rng := rand.New(rand.NewSource(78))
+	writeAll := func(storage OnChainStorage) {
+		for i := 0; i < 40; i++ {
+			value := common.Hash{}
+			if rng.Intn(4) != 0 {
+				value = common.BytesToHash([]byte{byte(1 + rng.Intn(255)), byte(rng.Intn(256))})
+			}
+			assert.Nil(t, storage.NewSlot(uint64(rng.Intn(30))).Set(value))
+		}
+	}
+	writeAll(mock)
+	before := mock.Snapshot()
+
+	// reads see the buffered writes, but the base storage doesn't
+	overlay := NewOverlayOnChainStorage(mock)
+	expected := NewMockOnChainStorageFromSnapshot(mock.Snapshot()).(*MockOnChainStorage)
+	rngState := rng.Int63()
+	rng.Seed(rngState)
+	writeAll(overlay)
+	rng.Seed(rngState)
+	writeAll(expected)
+	assert.Equal(t, mock.Snapshot(), before)
+	assert.Greater(t, overlay.NumBufferedWrites(), 0)
+	assert.LessOrEqual(t, overlay.NumBufferedWrites(), 30)
+	for offset := uint64(0); offset < 30; offset++ {
+		value, err := overlay.NewSlot(offset).Get()
+		assert.Nil(t, err)
+		expectedValue, _ := expected.NewSlot(offset).Get()
+		assert.Equal(t, value, expectedValue)
+	}
+
+	overlay.Discard()
+	assert.Equal(t, overlay.NumBufferedWrites(), 0)
+	value, err := overlay.Get(SlotLocation(3))
+	assert.Nil(t, err)
+	baseValue, _ := mock.Get(SlotLocation(3))
+	assert.Equal(t, value, baseValue)
+
+	// a failed commit can be retried
+	rng.Seed(rngState)
+	writeAll(overlay)
+	faulty := NewFaultyOnChainStorage(mock, FailNthWrite(2))
+	overlay.base = faulty
+	assert.ErrorIs(t, overlay.Commit(), ErrInjectedFault)
+	faulty.SetFault(nil)
+	assert.Nil(t, overlay.Commit())
+	assert.Equal(t, overlay.NumBufferedWrites(), 0)
+	assert.Equal(t, mock.Snapshot(), expected.Snapshot())
+}
+
+func TestOverlayOfStorageWithOwnSlotLayout(t *testing.T) {
+	base := newHashedSlotStorage()
+	slot := base.NewSlot(5)
+	one, two := common.BytesToHash([]byte{1}), common.BytesToHash([]byte{2})
+	assert.Nil(t, slot.Set(one))
+
+	overlay := NewOverlayOnChainStorage(base)
+	value, err := overlay.NewSlot(5).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, one)
+	assert.Nil(t, overlay.NewSlot(5).Set(two))
+	value, err = slot.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, one)
+
+	assert.Nil(t, overlay.Commit())
+	value, err = slot.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, two)
+	value, err = base.Get(SlotLocation(5))
+	assert.Nil(t, err)
+	assert.Equal(t, value, common.Hash{})
+}
+
+// A storage that keeps its slots at hashes of their offsets, rather than where the mock storage keeps them.
+type hashedSlotStorage struct {
+	*MockOnChainStorage
+}
+
+func newHashedSlotStorage() hashedSlotStorage {
+	return hashedSlotStorage{NewMockOnChainStorage().(*MockOnChainStorage)}
+}
+
+func (h hashedSlotStorage) NewSlot(offset uint64) OnChainStorageSlot {
+	return &MockOnChainStorageSlot{sto: h.MockOnChainStorage, location: crypto.Keccak256Hash(SlotLocation(offset).Bytes())}
+}
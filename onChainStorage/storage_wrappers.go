@@ -0,0 +1,258 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainStorage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The location of the slot at the given offset, as used by the mock storage.
+func SlotLocation(offset uint64) common.Hash {
+	zeroes := [24]byte{}
+	return common.BytesToHash(binary.LittleEndian.AppendUint64(zeroes[:], offset))
+}
+
+// One access to storage, either by location or through the slot at an offset. For a read, OldValue and NewValue
+// are both the value read.
+type StorageAccess struct {
+	IsWrite  bool
+	IsSlot   bool
+	Offset   uint64      // of the slot accessed, if IsSlot
+	Location common.Hash // accessed, if not IsSlot
+	OldValue common.Hash
+	NewValue common.Hash
+}
+
+func (access StorageAccess) word() word {
+	if access.IsSlot {
+		return slotWord(access.Offset)
+	}
+	return locationWord(access.Location)
+}
+
+// A slot of a wrapper, which passes accesses through to the wrapped storage's slot at the same offset, so that the
+// wrapper doesn't change which words of storage are accessed. The wrapper's access function sees each access before
+// it is made, and makes it, or not, with the given function.
+type wrapperSlot struct {
+	offset uint64
+	inner  OnChainStorageSlot
+	access func(access StorageAccess, inner OnChainStorageSlot) (common.Hash, error)
+}
+
+func (s *wrapperSlot) Get() (common.Hash, error) {
+	return s.access(StorageAccess{IsSlot: true, Offset: s.offset}, s.inner)
+}
+
+func (s *wrapperSlot) Set(value common.Hash) error {
+	_, err := s.access(StorageAccess{IsWrite: true, IsSlot: true, Offset: s.offset, NewValue: value}, s.inner)
+	return err
+}
+
+var ErrInjectedFault = errors.New("injected on-chain storage fault")
+
+// FaultyOnChainStorage passes accesses through to another storage, except that it fails the ones its fault
+// predicate picks, without passing them through. The predicate sees the location or slot of every access, and the
+// new value of every write, but not old values.
+type FaultyOnChainStorage struct {
+	inner      OnChainStorage
+	shouldFail func(access StorageAccess) bool
+}
+
+func NewFaultyOnChainStorage(inner OnChainStorage, shouldFail func(access StorageAccess) bool) *FaultyOnChainStorage {
+	return &FaultyOnChainStorage{inner: inner, shouldFail: shouldFail}
+}
+
+// Replace the fault predicate; nil means that no access fails.
+func (f *FaultyOnChainStorage) SetFault(shouldFail func(access StorageAccess) bool) {
+	f.shouldFail = shouldFail
+}
+
+func (f *FaultyOnChainStorage) Get(location common.Hash) (common.Hash, error) {
+	if f.shouldFail != nil && f.shouldFail(StorageAccess{Location: location}) {
+		return common.Hash{}, ErrInjectedFault
+	}
+	return f.inner.Get(location)
+}
+
+func (f *FaultyOnChainStorage) Set(location, value common.Hash) error {
+	if f.shouldFail != nil && f.shouldFail(StorageAccess{IsWrite: true, Location: location, NewValue: value}) {
+		return ErrInjectedFault
+	}
+	return f.inner.Set(location, value)
+}
+
+func (f *FaultyOnChainStorage) NewSlot(offset uint64) OnChainStorageSlot {
+	return &wrapperSlot{offset: offset, inner: f.inner.NewSlot(offset), access: f.accessSlot}
+}
+
+func (f *FaultyOnChainStorage) accessSlot(access StorageAccess, inner OnChainStorageSlot) (common.Hash, error) {
+	if f.shouldFail != nil && f.shouldFail(access) {
+		return common.Hash{}, ErrInjectedFault
+	}
+	if access.IsWrite {
+		return common.Hash{}, inner.Set(access.NewValue)
+	}
+	return inner.Get()
+}
+
+// A fault predicate that fails the nth access (counting from zero) it is asked about, and no other.
+func FailNthAccess(n uint64) func(access StorageAccess) bool {
+	return failNth(n, func(StorageAccess) bool { return true })
+}
+
+// A fault predicate that fails the nth read (counting from zero) it is asked about, and no other.
+func FailNthRead(n uint64) func(access StorageAccess) bool {
+	return failNth(n, func(access StorageAccess) bool { return !access.IsWrite })
+}
+
+// A fault predicate that fails the nth write (counting from zero) it is asked about, and no other.
+func FailNthWrite(n uint64) func(access StorageAccess) bool {
+	return failNth(n, func(access StorageAccess) bool { return access.IsWrite })
+}
+
+func failNth(n uint64, counts func(access StorageAccess) bool) func(access StorageAccess) bool {
+	seen := uint64(0)
+	return func(access StorageAccess) bool {
+		if !counts(access) {
+			return false
+		}
+		seen++
+		return seen == n+1
+	}
+}
+
+// RecordingOnChainStorage passes accesses through to another storage, and records them in order. To record the
+// old value of a write, it reads the other storage first.
+type RecordingOnChainStorage struct {
+	inner OnChainStorage
+	trace []StorageAccess
+}
+
+func NewRecordingOnChainStorage(inner OnChainStorage) *RecordingOnChainStorage {
+	return &RecordingOnChainStorage{inner: inner}
+}
+
+func (r *RecordingOnChainStorage) Get(location common.Hash) (common.Hash, error) {
+	value, err := r.inner.Get(location)
+	if err != nil {
+		return value, err
+	}
+	r.trace = append(r.trace, StorageAccess{Location: location, OldValue: value, NewValue: value})
+	return value, nil
+}
+
+func (r *RecordingOnChainStorage) Set(location, value common.Hash) error {
+	oldValue, err := r.inner.Get(location)
+	if err != nil {
+		return err
+	}
+	if err := r.inner.Set(location, value); err != nil {
+		return err
+	}
+	r.trace = append(r.trace, StorageAccess{IsWrite: true, Location: location, OldValue: oldValue, NewValue: value})
+	return nil
+}
+
+func (r *RecordingOnChainStorage) NewSlot(offset uint64) OnChainStorageSlot {
+	return &wrapperSlot{offset: offset, inner: r.inner.NewSlot(offset), access: r.accessSlot}
+}
+
+func (r *RecordingOnChainStorage) accessSlot(access StorageAccess, inner OnChainStorageSlot) (common.Hash, error) {
+	oldValue, err := inner.Get()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	access.OldValue = oldValue
+	if access.IsWrite {
+		if err := inner.Set(access.NewValue); err != nil {
+			return common.Hash{}, err
+		}
+	} else {
+		access.NewValue = oldValue
+	}
+	r.trace = append(r.trace, access)
+	return oldValue, nil
+}
+
+// The successful accesses so far, in order. Failed accesses aren't recorded.
+func (r *RecordingOnChainStorage) Trace() []StorageAccess {
+	return append([]StorageAccess{}, r.trace...)
+}
+
+func (r *RecordingOnChainStorage) ResetTrace() {
+	r.trace = nil
+}
+
+// Apply the writes of a trace to storage, in order. Applying a prefix of a trace recreates the state of storage
+// after a crash partway through the accesses that were recorded.
+func ApplyTrace(storage OnChainStorage, trace []StorageAccess) error {
+	for _, access := range trace {
+		if access.IsWrite {
+			if err := access.word().set(storage, access.NewValue); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var ErrTraceMismatch = errors.New("on-chain storage access doesn't match the trace being replayed")
+
+// ReplayingOnChainStorage serves accesses from a recorded trace rather than from storage. Each access must be the
+// same as the next access in the trace, and reads return the recorded value, so replaying an operation against
+// the trace it recorded checks that the operation accesses storage deterministically.
+type ReplayingOnChainStorage struct {
+	trace []StorageAccess
+	next  int
+}
+
+func NewReplayingOnChainStorage(trace []StorageAccess) *ReplayingOnChainStorage {
+	return &ReplayingOnChainStorage{trace: trace}
+}
+
+func (r *ReplayingOnChainStorage) expect(access StorageAccess) (StorageAccess, error) {
+	if r.next >= len(r.trace) {
+		return StorageAccess{}, fmt.Errorf("%w: access %d is past the end of the trace", ErrTraceMismatch, r.next)
+	}
+	expected := r.trace[r.next]
+	if expected.IsWrite != access.IsWrite || expected.word() != access.word() ||
+		(access.IsWrite && expected.NewValue != access.NewValue) {
+		return StorageAccess{}, fmt.Errorf("%w: access %d", ErrTraceMismatch, r.next)
+	}
+	r.next++
+	return expected, nil
+}
+
+func (r *ReplayingOnChainStorage) Get(location common.Hash) (common.Hash, error) {
+	expected, err := r.expect(StorageAccess{Location: location})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return expected.NewValue, nil
+}
+
+func (r *ReplayingOnChainStorage) Set(location, value common.Hash) error {
+	_, err := r.expect(StorageAccess{IsWrite: true, Location: location, NewValue: value})
+	return err
+}
+
+func (r *ReplayingOnChainStorage) NewSlot(offset uint64) OnChainStorageSlot {
+	return &wrapperSlot{offset: offset, access: r.accessSlot}
+}
+
+func (r *ReplayingOnChainStorage) accessSlot(access StorageAccess, _ OnChainStorageSlot) (common.Hash, error) {
+	expected, err := r.expect(access)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return expected.NewValue, nil
+}
+
+// Whether every access in the trace has been replayed.
+func (r *ReplayingOnChainStorage) Done() bool {
+	return r.next == len(r.trace)
+}
@@ -0,0 +1,71 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package onChainStorage
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStorageWrappers(t *testing.T) {
+	recorder := NewRecordingOnChainStorage(NewMockOnChainStorage())
+	faulty := NewFaultyOnChainStorage(recorder, FailNthWrite(1))
+	slot0, slot1 := faulty.NewSlot(0), faulty.NewSlot(1)
+	one, two := common.BytesToHash([]byte{1}), common.BytesToHash([]byte{2})
+
+	assert.Nil(t, slot0.Set(one))
+	assert.ErrorIs(t, slot1.Set(two), ErrInjectedFault)
+	assert.Nil(t, slot1.Set(two))
+	assert.Nil(t, slot0.Set(two))
+	value, err := slot0.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, two)
+
+	// the failed write never reached the recorder
+	trace := recorder.Trace()
+	assert.Equal(t, trace, []StorageAccess{
+		{IsWrite: true, IsSlot: true, Offset: 0, OldValue: common.Hash{}, NewValue: one},
+		{IsWrite: true, IsSlot: true, Offset: 1, OldValue: common.Hash{}, NewValue: two},
+		{IsWrite: true, IsSlot: true, Offset: 0, OldValue: one, NewValue: two},
+		{IsWrite: false, IsSlot: true, Offset: 0, OldValue: two, NewValue: two},
+	})
+
+	// applying a prefix of the trace recreates an earlier state
+	earlier := NewMockOnChainStorage()
+	assert.Nil(t, ApplyTrace(earlier, trace[:2]))
+	value, err = earlier.NewSlot(0).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, one)
+
+	replayer := NewReplayingOnChainStorage(trace)
+	assert.Nil(t, replayer.NewSlot(0).Set(one))
+	assert.Nil(t, replayer.NewSlot(1).Set(two))
+	assert.ErrorIs(t, replayer.NewSlot(0).Set(one), ErrTraceMismatch)
+	assert.Nil(t, replayer.NewSlot(0).Set(two))
+	value, err = replayer.NewSlot(0).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, two)
+	assert.True(t, replayer.Done())
+	_, err = replayer.NewSlot(0).Get()
+	assert.ErrorIs(t, err, ErrTraceMismatch)
+}
+
+func TestWrappersOfStorageWithOwnSlotLayout(t *testing.T) {
+	inner := newHashedSlotStorage()
+	recorder := NewRecordingOnChainStorage(inner)
+	faulty := NewFaultyOnChainStorage(recorder, nil)
+	one := common.BytesToHash([]byte{1})
+	assert.Nil(t, faulty.NewSlot(5).Set(one))
+	value, err := inner.NewSlot(5).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, one)
+	value, err = inner.Get(SlotLocation(5))
+	assert.Nil(t, err)
+	assert.Equal(t, value, common.Hash{})
+
+	applied := newHashedSlotStorage()
+	assert.Nil(t, ApplyTrace(applied, recorder.Trace()))
+	assert.Equal(t, applied.Snapshot(), inner.Snapshot())
+}
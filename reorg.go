@@ -0,0 +1,33 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"context"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+)
+
+// Bring the local cache back in line with the on-chain cache after the on-chain cache's storage has been rolled
+// back, such as by onChainStorage.JournalingOnChainStorage when the chain reorgs.
+//
+// Items accessed in the abandoned blocks might have later generations than the rolled-back on-chain cache's
+// current generation, so their generations are brought back to it; they stay in the cache, and might be evicted
+// later than they could be, but never earlier. Items that the abandoned blocks evicted from the local cache might
+// be back in the on-chain cache, so this then repairs the subset property as VerifyInclusion does, which reads
+// every entry of the on-chain cache, and needs a key resolver to bring the evicted items back.
+func ReconcileLocalNodeCache[CacheKey cacheKeys.LocalNodeCacheKey](
+	ctx context.Context,
+	cache *LocalNodeCache[CacheKey],
+) (InclusionReport, error) {
+	header, err := cache.onChain.ReadHeader()
+	if err != nil {
+		return InclusionReport{}, err
+	}
+	cache.currentGeneration = header.CurrentGeneration
+	// clamping keeps generations from decreasing along the LRU list
+	for node := cache.mru; node != nil && node.generation > header.CurrentGeneration; node = node.lessRecent {
+		node.generation = header.CurrentGeneration
+	}
+	return VerifyInclusion(ctx, cache, true)
+}
@@ -0,0 +1,74 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package cuckoocache
+
+import (
+	"context"
+	"github.com/offchainlabs/cuckoocache/cacheBackingStore"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/offchainlabs/cuckoocache/keyResolver"
+	"github.com/offchainlabs/cuckoocache/onChainIndex"
+	"github.com/offchainlabs/cuckoocache/onChainStorage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReorg(t *testing.T) {
+	onChainCapacity := uint64(32)
+	localCapacity := uint64(16)
+	journal := onChainStorage.NewJournalingOnChainStorage(onChainStorage.NewMockOnChainStorage())
+	onChain := onChainIndex.OpenOnChainCuckooTable(journal, onChainCapacity)
+	assert.Nil(t, onChain.Initialize(onChainCapacity))
+	backing := cacheBackingStore.NewMockBackingStore[cacheKeys.Uint64LocalCacheKey]()
+	cache, err := NewLocalNodeCache[cacheKeys.Uint64LocalCacheKey](localCapacity, onChain, backing)
+	assert.Nil(t, err)
+	SetLocalNodeCacheKeyResolver(cache, keyResolver.NewInMemoryKeyResolver[cacheKeys.Uint64LocalCacheKey]())
+
+	runBlock := func(block uint64, seed uint64) {
+		assert.Nil(t, journal.BeginBlock(block))
+		for i := uint64(0); i < onChainCapacity; i++ {
+			key := cacheKeys.NewUint64LocalCacheKey(seed + (i*i)%(3*onChainCapacity))
+			if seed != 0 {
+				key = cacheKeys.NewUint64LocalCacheKey(seed + block*onChainCapacity + i)
+			}
+			_, _, err := ReadItemFromLocalCache(context.Background(), cache, key)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, subsetPropertyHolds(t, cache), true)
+	}
+	headers := map[uint64]onChainIndex.OnChainCuckooHeader{}
+	for block := uint64(1); block <= 10; block++ {
+		runBlock(block, 0)
+		headers[block] = readHeader(t, onChain)
+	}
+
+	// the abandoned blocks access items that the rolled-back blocks don't, evicting the rolled-back blocks' items
+	for block := uint64(11); block <= 14; block++ {
+		runBlock(block, 1000)
+	}
+	assert.Greater(t, readHeader(t, onChain).CurrentGeneration, headers[10].CurrentGeneration)
+	assert.Nil(t, journal.Rollback(10))
+	assert.Equal(t, readHeader(t, onChain), headers[10])
+	assert.Equal(t, subsetPropertyHolds(t, cache), false)
+
+	report, err := ReconcileLocalNodeCache(context.Background(), cache)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), true)
+	assert.Greater(t, len(report.Missing), 0)
+	assert.Equal(t, subsetPropertyHolds(t, cache), true)
+	assert.Equal(t, cache.currentGeneration, headers[10].CurrentGeneration)
+	verifyCacheInvariants(t, cache)
+	verifyGenerationsInLruOrder(t, cache)
+	check, err := onChain.Check()
+	assert.Nil(t, err)
+	assert.Equal(t, check.OK(), true)
+
+	// the new branch keeps the subset property
+	for block := uint64(11); block <= 14; block++ {
+		runBlock(block, 2000)
+	}
+	report, err = VerifyInclusion(context.Background(), cache, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Holds(), true)
+}
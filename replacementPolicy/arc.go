@@ -0,0 +1,95 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package replacementPolicy
+
+import (
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+)
+
+// ArcPolicy is the Adaptive Replacement Cache policy of Megiddo and Modha. Items seen once are kept in one LRU
+// list, and items seen more than once in another; the policy remembers the keys it recently evicted from each,
+// and adapts the share of the cache that goes to each list according to which list's evicted items come back.
+type ArcPolicy[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	capacity       uint64
+	target         uint64          // the share of the cache that the recent list should get
+	recent         *queue[KeyType] // items seen once, T1
+	frequent       *queue[KeyType] // items seen more than once, T2
+	recentGhosts   *queue[KeyType] // keys recently evicted from the recent list, B1
+	frequentGhosts *queue[KeyType] // keys recently evicted from the frequent list, B2
+}
+
+// capacity should be the local cache's capacity.
+func NewArcPolicy[KeyType cacheKeys.LocalNodeCacheKey](capacity uint64) *ArcPolicy[KeyType] {
+	p := &ArcPolicy[KeyType]{capacity: max(capacity, 1)}
+	p.Clear()
+	return p
+}
+
+func (p *ArcPolicy[KeyType]) Inserted(key KeyType) {
+	recentGhosts, frequentGhosts := uint64(p.recentGhosts.len()), uint64(p.frequentGhosts.len())
+	switch {
+	case p.recentGhosts.remove(key):
+		p.target = min(p.target+max(frequentGhosts/recentGhosts, 1), p.capacity)
+		p.frequent.pushFront(key)
+	case p.frequentGhosts.remove(key):
+		p.target -= min(max(recentGhosts/frequentGhosts, 1), p.target)
+		p.frequent.pushFront(key)
+	default:
+		p.recent.pushFront(key)
+	}
+	p.trimGhosts()
+}
+
+func (p *ArcPolicy[KeyType]) Accessed(key KeyType) {
+	if p.recent.remove(key) {
+		p.frequent.pushFront(key)
+	} else {
+		p.frequent.moveToFront(key)
+	}
+}
+
+func (p *ArcPolicy[KeyType]) Removed(key KeyType) {
+	if !p.recent.remove(key) {
+		p.frequent.remove(key)
+	}
+}
+
+func (p *ArcPolicy[KeyType]) Victim(evictable func(key KeyType) bool) (KeyType, bool) {
+	from, fromGhosts := p.frequent, p.frequentGhosts
+	other, otherGhosts := p.recent, p.recentGhosts
+	if uint64(p.recent.len()) > p.target || p.frequent.len() == 0 {
+		from, fromGhosts, other, otherGhosts = other, otherGhosts, from, fromGhosts
+	}
+	key, found := from.oldest(evictable)
+	if !found {
+		from, fromGhosts = other, otherGhosts
+		key, found = from.oldest(evictable)
+		if !found {
+			return key, false
+		}
+	}
+	from.remove(key)
+	fromGhosts.pushFront(key)
+	p.trimGhosts()
+	return key, true
+}
+
+// Keep the recent list and its ghosts within the capacity, and all the lists and ghosts within twice it.
+func (p *ArcPolicy[KeyType]) trimGhosts() {
+	for p.recentGhosts.len() > 0 && uint64(p.recent.len()+p.recentGhosts.len()) > p.capacity {
+		p.recentGhosts.popBack()
+	}
+	for p.frequentGhosts.len() > 0 &&
+		uint64(p.recent.len()+p.frequent.len()+p.recentGhosts.len()+p.frequentGhosts.len()) > 2*p.capacity {
+		p.frequentGhosts.popBack()
+	}
+}
+
+func (p *ArcPolicy[KeyType]) Clear() {
+	p.target = 0
+	p.recent = newQueue[KeyType]()
+	p.frequent = newQueue[KeyType]()
+	p.recentGhosts = newQueue[KeyType]()
+	p.frequentGhosts = newQueue[KeyType]()
+}
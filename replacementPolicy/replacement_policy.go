@@ -0,0 +1,125 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package replacementPolicy
+
+import (
+	"container/list"
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+)
+
+// A ReplacementPolicy chooses which item a local node cache evicts when it is over its capacity. The cache tells
+// the policy about every item that enters the cache, is hit in it, or leaves it, and the policy keeps whatever
+// order and history it needs to choose.
+//
+// The cache must never evict an item that might still be in the on-chain cache, so it says which items the policy
+// may choose. Those are the items that haven't been accessed recently: if the policy may not choose an item, it
+// may not choose any item that has been inserted or read since. So a policy that keeps a list of items in the
+// order they were last inserted or read only needs to look at the oldest.
+type ReplacementPolicy[KeyType cacheKeys.LocalNodeCacheKey] interface {
+	Inserted(key KeyType) // the item has been brought into the cache
+	Accessed(key KeyType) // the item, which is in the cache, has been read
+	Removed(key KeyType)  // the item has left the cache, other than by being returned from Victim
+
+	// Choose an item to evict, among the items for which evictable returns true, and forget it as an item in the
+	// cache. The bool is false if there's no item that may be evicted.
+	Victim(evictable func(key KeyType) bool) (KeyType, bool)
+
+	Clear() // every item has left the cache
+}
+
+// LruPolicy evicts the least recently used item. It makes the same choices as a local node cache with no policy,
+// which uses its own LRU list, and so is mostly useful for comparison with other policies.
+type LruPolicy[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	items *queue[KeyType]
+}
+
+func NewLruPolicy[KeyType cacheKeys.LocalNodeCacheKey]() *LruPolicy[KeyType] {
+	return &LruPolicy[KeyType]{items: newQueue[KeyType]()}
+}
+
+func (p *LruPolicy[KeyType]) Inserted(key KeyType) {
+	p.items.pushFront(key)
+}
+
+func (p *LruPolicy[KeyType]) Accessed(key KeyType) {
+	p.items.moveToFront(key)
+}
+
+func (p *LruPolicy[KeyType]) Removed(key KeyType) {
+	p.items.remove(key)
+}
+
+func (p *LruPolicy[KeyType]) Victim(evictable func(key KeyType) bool) (KeyType, bool) {
+	key, found := p.items.oldest(evictable)
+	if found {
+		p.items.remove(key)
+	}
+	return key, found
+}
+
+func (p *LruPolicy[KeyType]) Clear() {
+	p.items = newQueue[KeyType]()
+}
+
+// A queue of distinct keys, from the newest at the front to the oldest at the back.
+type queue[KeyType comparable] struct {
+	list     *list.List
+	elements map[KeyType]*list.Element
+}
+
+func newQueue[KeyType comparable]() *queue[KeyType] {
+	return &queue[KeyType]{list: list.New(), elements: make(map[KeyType]*list.Element)}
+}
+
+func (q *queue[KeyType]) len() int {
+	return q.list.Len()
+}
+
+func (q *queue[KeyType]) contains(key KeyType) bool {
+	return q.elements[key] != nil
+}
+
+// Push a key that isn't in the queue as its newest.
+func (q *queue[KeyType]) pushFront(key KeyType) {
+	q.elements[key] = q.list.PushFront(key)
+}
+
+func (q *queue[KeyType]) moveToFront(key KeyType) {
+	if element := q.elements[key]; element != nil {
+		q.list.MoveToFront(element)
+	}
+}
+
+// Remove a key, and report whether it was in the queue.
+func (q *queue[KeyType]) remove(key KeyType) bool {
+	element := q.elements[key]
+	if element == nil {
+		return false
+	}
+	q.list.Remove(element)
+	delete(q.elements, key)
+	return true
+}
+
+func (q *queue[KeyType]) back() KeyType {
+	return q.list.Back().Value.(KeyType)
+}
+
+func (q *queue[KeyType]) popBack() KeyType {
+	key := q.back()
+	q.remove(key)
+	return key
+}
+
+// The oldest key, if evictable returns true for it. For a queue in the order its keys were last inserted or read,
+// evictable returns false for every key if it does for the oldest, so there's no need to look further.
+func (q *queue[KeyType]) oldest(evictable func(key KeyType) bool) (KeyType, bool) {
+	if q.len() > 0 {
+		if key := q.back(); evictable(key) {
+			return key, true
+		}
+	}
+	var none KeyType
+	return none, false
+}
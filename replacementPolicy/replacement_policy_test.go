@@ -0,0 +1,156 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package replacementPolicy
+
+import (
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+type key = cacheKeys.Uint64LocalCacheKey
+
+var policies = map[string]func(capacity uint64) ReplacementPolicy[key]{
+	"lru":     func(capacity uint64) ReplacementPolicy[key] { return NewLruPolicy[key]() },
+	"arc":     func(capacity uint64) ReplacementPolicy[key] { return NewArcPolicy[key](capacity) },
+	"2q":      func(capacity uint64) ReplacementPolicy[key] { return NewTwoQueuePolicy[key](capacity) },
+	"s3-fifo": func(capacity uint64) ReplacementPolicy[key] { return NewS3FifoPolicy[key](capacity) },
+}
+
+// A cache of the given capacity that evicts with a policy, and never evicts the items among its latest pinned
+// accesses.
+type simulatedCache struct {
+	t        *testing.T
+	policy   ReplacementPolicy[key]
+	capacity int
+	pinned   int
+	items    map[key]bool
+	latest   []key
+
+	evictableChecks int
+}
+
+func newSimulatedCache(t *testing.T, policy ReplacementPolicy[key], capacity int, pinned int) *simulatedCache {
+	return &simulatedCache{t: t, policy: policy, capacity: capacity, pinned: pinned, items: make(map[key]bool)}
+}
+
+func (c *simulatedCache) access(k key) bool {
+	c.latest = append(c.latest, k)
+	if len(c.latest) > c.pinned {
+		c.latest = c.latest[1:]
+	}
+	if c.items[k] {
+		c.policy.Accessed(k)
+		return true
+	}
+	c.items[k] = true
+	c.policy.Inserted(k)
+	for len(c.items) > c.capacity {
+		victim, found := c.policy.Victim(c.isEvictable)
+		if !found {
+			break
+		}
+		assert.Equal(c.t, c.items[victim], true)
+		assert.Equal(c.t, c.isEvictable(victim), true)
+		delete(c.items, victim)
+	}
+	return false
+}
+
+func (c *simulatedCache) isEvictable(k key) bool {
+	c.evictableChecks++
+	for _, latest := range c.latest {
+		if latest == k {
+			return false
+		}
+	}
+	return true
+}
+
+// Evict every item, checking that the policy knows exactly the items in the cache.
+func (c *simulatedCache) drain() {
+	for len(c.items) > 0 {
+		victim, found := c.policy.Victim(func(key) bool { return true })
+		assert.Equal(c.t, found, true)
+		assert.Equal(c.t, c.items[victim], true)
+		delete(c.items, victim)
+	}
+	_, found := c.policy.Victim(func(key) bool { return true })
+	assert.Equal(c.t, found, false)
+}
+
+func TestPoliciesOnlyEvictEvictableItems(t *testing.T) {
+	for name, newPolicy := range policies {
+		t.Run(name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(31))
+			c := newSimulatedCache(t, newPolicy(50), 50, 20)
+			for i := 0; i < 5000; i++ {
+				k := cacheKeys.NewUint64LocalCacheKey(uint64(rng.ExpFloat64() * 40))
+				c.access(k)
+				if rng.Intn(100) == 0 && c.items[k] {
+					delete(c.items, k)
+					c.policy.Removed(k)
+				}
+			}
+			assert.LessOrEqual(t, len(c.items), 50)
+			c.drain()
+
+			// when every item is pinned, nothing is evicted
+			c = newSimulatedCache(t, newPolicy(10), 10, 20)
+			for i := uint64(0); i < 20; i++ {
+				c.access(cacheKeys.NewUint64LocalCacheKey(i))
+			}
+			assert.Equal(t, len(c.items), 20)
+			c.drain()
+
+			c.policy.Inserted(cacheKeys.NewUint64LocalCacheKey(1))
+			c.policy.Clear()
+			_, found := c.policy.Victim(func(key) bool { return true })
+			assert.Equal(t, found, false)
+		})
+	}
+}
+
+func TestScanResistance(t *testing.T) {
+	// a hot set of items that are each read twice, between scans of items that are read once
+	hits := map[string]int{}
+	for name, newPolicy := range policies {
+		c := newSimulatedCache(t, newPolicy(40), 40, 1)
+		scanned := uint64(1000)
+		for round := 0; round < 50; round++ {
+			for i := uint64(0); i < 20; i++ {
+				if c.access(cacheKeys.NewUint64LocalCacheKey(i)) {
+					hits[name]++
+				}
+				c.access(cacheKeys.NewUint64LocalCacheKey(i))
+			}
+			for i := 0; i < 30; i++ {
+				c.access(cacheKeys.NewUint64LocalCacheKey(scanned))
+				scanned++
+			}
+		}
+	}
+	assert.Equal(t, hits["lru"], 0)
+	for _, name := range []string{"arc", "2q", "s3-fifo"} {
+		assert.Greater(t, hits[name], 40*20/2, name)
+	}
+}
+
+func TestVictimDoesNotScanPinnedItems(t *testing.T) {
+	for name, newPolicy := range policies {
+		// most of the cache is pinned, and each of the items is read a few times before it is evicted
+		c := newSimulatedCache(t, newPolicy(1000), 1000, 900)
+		misses := 0
+		for i := uint64(0); i < 20000; i++ {
+			if !c.access(cacheKeys.NewUint64LocalCacheKey((i + i%3) % 1200)) {
+				misses++
+			}
+		}
+		evictions := misses - len(c.items)
+		assert.Greater(t, evictions, 0, name)
+		// access checks each victim once more
+		assert.LessOrEqual(t, c.evictableChecks, 5*evictions, name)
+	}
+}
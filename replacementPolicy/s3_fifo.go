@@ -0,0 +1,98 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package replacementPolicy
+
+import (
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+)
+
+const s3FifoMaxFrequency = 3
+
+// S3FifoPolicy is the S3-FIFO policy of Yang et al. New items go into a small FIFO queue that takes a tenth of the
+// cache, and are evicted from it quickly unless they are read again; the rest of the cache is a FIFO queue that
+// gives each item another lap for every time it was read, up to three. Like 2Q, it remembers the keys it evicted
+// from the small queue, and puts items that come back straight into the main queue.
+type S3FifoPolicy[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	smallTarget uint64
+	ghostTarget uint64
+	small       *queue[KeyType]
+	main        *queue[KeyType]
+	ghosts      *queue[KeyType] // keys recently evicted from the small queue
+	frequencies map[KeyType]uint8
+}
+
+// capacity should be the local cache's capacity.
+func NewS3FifoPolicy[KeyType cacheKeys.LocalNodeCacheKey](capacity uint64) *S3FifoPolicy[KeyType] {
+	smallTarget := max(capacity/10, 1)
+	p := &S3FifoPolicy[KeyType]{smallTarget: smallTarget, ghostTarget: max(capacity-min(smallTarget, capacity), 1)}
+	p.Clear()
+	return p
+}
+
+func (p *S3FifoPolicy[KeyType]) Inserted(key KeyType) {
+	if p.ghosts.remove(key) {
+		p.main.pushFront(key)
+	} else {
+		p.small.pushFront(key)
+	}
+	p.frequencies[key] = 0
+}
+
+func (p *S3FifoPolicy[KeyType]) Accessed(key KeyType) {
+	if frequency, cached := p.frequencies[key]; cached {
+		p.frequencies[key] = min(frequency+1, s3FifoMaxFrequency)
+	}
+}
+
+func (p *S3FifoPolicy[KeyType]) Removed(key KeyType) {
+	if !p.small.remove(key) {
+		p.main.remove(key)
+	}
+	delete(p.frequencies, key)
+}
+
+// Items that may not be evicted are treated as if they had been read again, so they are moved from the small queue
+// to the main queue, or given another lap of the main queue. If no item may be evicted, this gives up once every
+// item has had as many laps as it could, having reordered the queues as if it had evicted nothing.
+func (p *S3FifoPolicy[KeyType]) Victim(evictable func(key KeyType) bool) (KeyType, bool) {
+	for steps := (s3FifoMaxFrequency+1)*(p.small.len()+p.main.len()) + 1; steps > 0; steps-- {
+		if p.small.len() > 0 && (uint64(p.small.len()) >= p.smallTarget || p.main.len() == 0) {
+			key := p.small.back()
+			if p.frequencies[key] > 1 || !evictable(key) {
+				p.small.remove(key)
+				p.main.pushFront(key)
+				p.frequencies[key] = 0
+				continue
+			}
+			p.small.remove(key)
+			delete(p.frequencies, key)
+			p.ghosts.pushFront(key)
+			for uint64(p.ghosts.len()) > p.ghostTarget {
+				p.ghosts.popBack()
+			}
+			return key, true
+		}
+		if p.main.len() == 0 {
+			break
+		}
+		key := p.main.back()
+		if frequency := p.frequencies[key]; frequency > 0 || !evictable(key) {
+			p.frequencies[key] = frequency - min(frequency, 1)
+			p.main.moveToFront(key)
+			continue
+		}
+		p.main.remove(key)
+		delete(p.frequencies, key)
+		return key, true
+	}
+	var none KeyType
+	return none, false
+}
+
+func (p *S3FifoPolicy[KeyType]) Clear() {
+	p.small = newQueue[KeyType]()
+	p.main = newQueue[KeyType]()
+	p.ghosts = newQueue[KeyType]()
+	p.frequencies = make(map[KeyType]uint8)
+}
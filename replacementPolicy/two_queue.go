@@ -0,0 +1,79 @@
+// Copyright 2024, Offchain Labs, Inc.
+// For license information, see https://github.com/OffchainLabs/nitro/blob/master/LICENSE
+
+package replacementPolicy
+
+import (
+	"github.com/offchainlabs/cuckoocache/cacheKeys"
+)
+
+// TwoQueuePolicy is the full 2Q policy of Johnson and Shasha. New items go into a FIFO queue that takes a quarter
+// of the cache, and only items that come back after being evicted from it are promoted to the LRU list that takes
+// the rest, so a scan of items that are read once can't push out the items that are read again and again.
+type TwoQueuePolicy[KeyType cacheKeys.LocalNodeCacheKey] struct {
+	inTarget  uint64          // the size of the FIFO queue, Kin
+	outTarget uint64          // the number of keys evicted from the FIFO queue to remember, Kout
+	in        *queue[KeyType] // A1in
+	out       *queue[KeyType] // keys recently evicted from A1in, A1out
+	main      *queue[KeyType] // Am
+}
+
+// capacity should be the local cache's capacity.
+func NewTwoQueuePolicy[KeyType cacheKeys.LocalNodeCacheKey](capacity uint64) *TwoQueuePolicy[KeyType] {
+	p := &TwoQueuePolicy[KeyType]{inTarget: max(capacity/4, 1), outTarget: max(capacity/2, 1)}
+	p.Clear()
+	return p
+}
+
+func (p *TwoQueuePolicy[KeyType]) Inserted(key KeyType) {
+	if p.out.remove(key) {
+		p.main.pushFront(key)
+	} else {
+		p.in.pushFront(key)
+	}
+}
+
+// A hit in the FIFO queue doesn't promote the item, since it might be part of one burst of reads, but it does move
+// it to the front of the FIFO queue, so that the queue stays in the order its items were last read, as Victim needs.
+func (p *TwoQueuePolicy[KeyType]) Accessed(key KeyType) {
+	p.in.moveToFront(key)
+	p.main.moveToFront(key)
+}
+
+func (p *TwoQueuePolicy[KeyType]) Removed(key KeyType) {
+	if !p.in.remove(key) {
+		p.main.remove(key)
+	}
+}
+
+func (p *TwoQueuePolicy[KeyType]) Victim(evictable func(key KeyType) bool) (KeyType, bool) {
+	if uint64(p.in.len()) > p.inTarget {
+		if key, found := p.in.oldest(evictable); found {
+			p.evictFromIn(key)
+			return key, true
+		}
+	}
+	if key, found := p.main.oldest(evictable); found {
+		p.main.remove(key)
+		return key, true
+	}
+	key, found := p.in.oldest(evictable)
+	if found {
+		p.evictFromIn(key)
+	}
+	return key, found
+}
+
+func (p *TwoQueuePolicy[KeyType]) evictFromIn(key KeyType) {
+	p.in.remove(key)
+	p.out.pushFront(key)
+	for uint64(p.out.len()) > p.outTarget {
+		p.out.popBack()
+	}
+}
+
+func (p *TwoQueuePolicy[KeyType]) Clear() {
+	p.in = newQueue[KeyType]()
+	p.out = newQueue[KeyType]()
+	p.main = newQueue[KeyType]()
+}